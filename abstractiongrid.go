@@ -9,8 +9,8 @@ func EmptyAbstractionGrid(w, h int) *AbstractionGrid {
 }
 
 func NewAbstractionGrid(t *TextGrid, cells *CellSet) *AbstractionGrid {
-	g := EmptyAbstractionGrid(3*t.Width(), 3*t.Height())
-	for c := range cells.Set {
+	g := EmptyAbstractionGrid(t.Width(), t.Height())
+	for _, c := range cells.Cells() {
 		if t.IsBlank(c) {
 			continue
 		}
@@ -1,93 +1,193 @@
 package main
 
-import (
-	"fmt"
-	"os"
-)
+import "math/bits"
 
+/*
+CellSet is a set of cells, stored as a bitmap covering their bounding box
+(plus some room to grow). The cells are always visited in row-major order,
+so that processing a diagram gives the same result every time.
+*/
 type CellSet struct {
-	Set map[Cell]struct{}
-	typ CellSetType
+	origin Cell // top-left corner of the bitmap
+	w, h   int
+	bits   []uint64
+	n      int
+	typ    CellSetType
 }
 type CellBounds struct{ Min, Max Cell }
 
 func NewCellSet() *CellSet {
-	return &CellSet{Set: make(map[Cell]struct{})}
+	return &CellSet{}
+}
+
+func (s *CellSet) index(c Cell) (int, bool) {
+	x, y := c.X-s.origin.X, c.Y-s.origin.Y
+	if x < 0 || y < 0 || x >= s.w || y >= s.h {
+		return 0, false
+	}
+	return y*s.w + x, true
+}
+
+func (s *CellSet) Add(c Cell) {
+	i, ok := s.index(c)
+	if !ok {
+		s.grow(c)
+		i, _ = s.index(c)
+	}
+	if s.bits[i/64]&(1<<uint(i%64)) == 0 {
+		s.bits[i/64] |= 1 << uint(i%64)
+		s.n++
+	}
 }
 
-func (s *CellSet) Add(c Cell) { s.Set[c] = struct{}{} }
+// grow extends the bitmap to cover c. Some room is left for further cells
+// in the same direction, as sets are usually built by walking or flooding.
+func (s *CellSet) grow(c Cell) {
+	min, max := c, c
+	if s.w > 0 {
+		omin, omax := s.origin, Cell{s.origin.X + s.w - 1, s.origin.Y + s.h - 1}
+		switch {
+		case c.X < omin.X:
+			min.X -= s.w / 2
+			max.X = omax.X
+		case c.X > omax.X:
+			min.X = omin.X
+			max.X += s.w / 2
+		default:
+			min.X, max.X = omin.X, omax.X
+		}
+		switch {
+		case c.Y < omin.Y:
+			min.Y -= s.h / 2
+			max.Y = omax.Y
+		case c.Y > omax.Y:
+			min.Y = omin.Y
+			max.Y += s.h / 2
+		default:
+			min.Y, max.Y = omin.Y, omax.Y
+		}
+	}
+	old := *s
+	s.origin = min
+	s.w, s.h = max.X-min.X+1, max.Y-min.Y+1
+	s.bits = make([]uint64, (s.w*s.h+63)/64)
+	s.n = 0
+	old.each(func(c Cell) bool {
+		s.Add(c)
+		return true
+	})
+}
 
 func (s *CellSet) Remove(c Cell) {
 	s.typ = SET_UNINITIALIZED
-	delete(s.Set, c)
+	i, ok := s.index(c)
+	if ok && s.bits[i/64]&(1<<uint(i%64)) != 0 {
+		s.bits[i/64] &^= 1 << uint(i%64)
+		s.n--
+	}
 }
 
 func (s *CellSet) Contains(c Cell) bool {
-	_, ok := s.Set[c]
-	return ok
+	i, ok := s.index(c)
+	return ok && s.bits[i/64]&(1<<uint(i%64)) != 0
 }
 
-func (s *CellSet) AddAll(s2 *CellSet) {
-	for c := range s2.Set {
-		s.Set[c] = struct{}{}
+// Len returns the number of cells in the set.
+func (s *CellSet) Len() int { return s.n }
+
+// each calls f for the cells in row-major order, until f returns false.
+func (s *CellSet) each(f func(c Cell) bool) {
+	for k, word := range s.bits {
+		for word != 0 {
+			b := bits.TrailingZeros64(word)
+			word &^= 1 << uint(b)
+			i := 64*k + b
+			if !f(Cell{s.origin.X + i%s.w, s.origin.Y + i/s.w}) {
+				return
+			}
+		}
 	}
 }
 
+// Cells returns the cells of the set in row-major order.
+func (s *CellSet) Cells() []Cell {
+	cells := make([]Cell, 0, s.n)
+	s.each(func(c Cell) bool {
+		cells = append(cells, c)
+		return true
+	})
+	return cells
+}
+
+// Map returns the cells of the set as a map, like the Set field of the
+// map-based CellSet held them. Changing the map doesn't change the set.
+func (s *CellSet) Map() map[Cell]struct{} {
+	m := make(map[Cell]struct{}, s.n)
+	s.each(func(c Cell) bool {
+		m[c] = struct{}{}
+		return true
+	})
+	return m
+}
+
+func (s *CellSet) AddAll(s2 *CellSet) {
+	s2.each(func(c Cell) bool {
+		s.Add(c)
+		return true
+	})
+}
+
 func (s *CellSet) HasCommonCells(s2 *CellSet) bool {
-	for c := range s2.Set {
-		if s.Contains(c) {
-			return true
-		}
-	}
-	return false
+	common := false
+	s2.each(func(c Cell) bool {
+		common = s.Contains(c)
+		return !common
+	})
+	return common
 }
 
 func (s *CellSet) Bounds() CellBounds {
-	var bb *CellBounds
-	for c := range s.Set {
-		if bb == nil {
-			bb = &CellBounds{Min: c, Max: c}
-			continue
-		}
+	if s.n == 0 {
+		return CellBounds{}
+	}
+	bb := CellBounds{Min: s.SomeCell()}
+	bb.Max = bb.Min
+	s.each(func(c Cell) bool {
 		if c.X < bb.Min.X {
 			bb.Min.X = c.X
 		}
 		if c.X > bb.Max.X {
 			bb.Max.X = c.X
 		}
-		if c.Y < bb.Min.Y {
-			bb.Min.Y = c.Y
-		}
-		if c.Y > bb.Max.Y {
-			bb.Max.Y = c.Y
-		}
-	}
-	if bb == nil {
-		return CellBounds{}
-	}
-	return *bb
+		bb.Max.Y = c.Y
+		return true
+	})
+	return bb
 }
 
 func (s1 *CellSet) Equals(s2 *CellSet) bool {
-	if len(s1.Set) != len(s2.Set) {
+	if s1.n != s2.n {
 		return false
 	}
-	for k := range s1.Set {
-		if _, ok := s2.Set[k]; !ok {
-			return false
-		}
-	}
-	return true
+	equal := true
+	s1.each(func(c Cell) bool {
+		equal = s2.Contains(c)
+		return equal
+	})
+	return equal
 }
 
-func (s *CellSet) Type(grid *TextGrid) (typ CellSetType) {
+// Type tells if the set is an open line, a closed shape, or a mix of both.
+// The result is cached until the set changes. Problems found while telling
+// it are reported to diags.
+func (s *CellSet) Type(grid *TextGrid, diags *Diagnostics) (typ CellSetType) {
 	if s.typ != SET_UNINITIALIZED {
 		return s.typ
 	}
 	defer func() {
 		s.typ = typ
 	}()
-	if len(s.Set) <= 1 {
+	if s.n <= 1 {
 		return SET_OPEN
 	}
 
@@ -99,7 +199,7 @@ func (s *CellSet) Type(grid *TextGrid) (typ CellSetType) {
 		return SET_UNDETERMINED // [akavel] can this happen?
 	}
 
-	filled := s.getTypeAccordingToFillMethod(grid)
+	filled := s.getTypeAccordingToFillMethod(grid, diags)
 	switch filled {
 	case SET_HAS_CLOSED_AREA:
 		return SET_MIXED
@@ -115,23 +215,35 @@ func (s *CellSet) getTypeAccordingToTraceMethod(grid *TextGrid) CellSetType {
 	workGrid := NewTextGrid(grid.Width(), grid.Height())
 	CopySelectedCells(workGrid, s, grid)
 
-	//start with a line end if it exists or with a "random" cell if not
+	//start with a line end if it exists or with the first cell if not
 	start := s.SomeCell()
-	for c := range s.Set {
+	for _, c := range s.Cells() {
 		if workGrid.IsLinesEnd(c) {
 			start = c
 			break // [akavel] added this; is it ok?
 		}
 	}
 	prev := start
-	nexts := workGrid.FollowCell(prev, nil)
-	if len(nexts.Set) == 0 {
+	nexts, err := workGrid.FollowCell(prev, nil)
+	switch {
+	case err != nil:
+		// leave it to the fill method
+		return SET_UNDETERMINED
+	case nexts.Len() == 0:
 		return SET_OPEN
 	}
 	cell := nexts.SomeCell()
-	for cell != start {
-		nexts = workGrid.FollowCell(cell, &prev)
-		switch len(nexts.Set) {
+	// a trace longer than the set has run into a loop which doesn't
+	// contain start
+	for steps := 0; cell != start; steps++ {
+		if steps > s.n {
+			return SET_UNDETERMINED
+		}
+		nexts, err = workGrid.FollowCell(cell, &prev)
+		if err != nil {
+			return SET_UNDETERMINED
+		}
+		switch nexts.Len() {
 		case 0:
 			// found dead end, shape is open
 			return SET_OPEN
@@ -146,9 +258,9 @@ func (s *CellSet) getTypeAccordingToTraceMethod(grid *TextGrid) CellSetType {
 	return SET_CLOSED
 }
 
-func (s *CellSet) getTypeAccordingToFillMethod(grid *TextGrid) CellSetType {
+func (s *CellSet) getTypeAccordingToFillMethod(grid *TextGrid, diags *Diagnostics) CellSetType {
 	tempSet := NewCellSet()
-	tempSet.Set = s.Set
+	tempSet.AddAll(s)
 	bb := s.Bounds()
 	tempSet.translate(-bb.Min.X+1, -bb.Min.Y+1)
 	subGrid := grid.SubGrid(bb.Min.X-1, bb.Min.Y-1, bb.Max.X-bb.Min.X+3, bb.Max.Y-bb.Min.Y+3)
@@ -164,7 +276,7 @@ func (s *CellSet) getTypeAccordingToFillMethod(grid *TextGrid) CellSetType {
 		}
 	}
 	if fillCell == nil {
-		fmt.Fprintln(os.Stderr, "Unexpected error: fill method cannot fill anywhere")
+		diags.Warnf(grid.SourcePos(topLeftCell(s)), DIAG_UNFILLABLE_BOUNDARY, "cannot find any room around boundary to tell if it is closed")
 		return SET_UNDETERMINED
 	}
 	temp.fillContinuousArea(*fillCell, '*')
@@ -174,29 +286,40 @@ func (s *CellSet) getTypeAccordingToFillMethod(grid *TextGrid) CellSetType {
 	return SET_OPEN
 }
 
+// hash returns a value which is the same for sets with equal cells,
+// regardless of how they were built.
+func (s *CellSet) hash() uint64 {
+	h := uint64(s.n)
+	s.each(func(c Cell) bool {
+		m := (uint64(uint32(c.X))<<32 | uint64(uint32(c.Y))) * 0x9E3779B97F4A7C15
+		h += m ^ m>>29
+		return true
+	})
+	return h
+}
+
+// SomeCell returns the first cell of the set in row-major order.
 func (s *CellSet) SomeCell() Cell {
-	for c := range s.Set {
-		return c
-	}
-	return Cell{} // [akavel] TODO: or panic("should not reach") ?
+	var first Cell
+	s.each(func(c Cell) bool {
+		first = c
+		return false
+	})
+	return first // [akavel] TODO: or panic("should not reach") if empty?
 }
 
 func (s *CellSet) translate(dx, dy int) {
 	s.typ = SET_UNINITIALIZED
-	result := map[Cell]struct{}{}
-	for c := range s.Set {
-		c.X += dx
-		c.Y += dy
-		result[c] = struct{}{}
-	}
-	s.Set = result
+	s.origin.X += dx
+	s.origin.Y += dy
 }
 
 func (s *CellSet) SubtractSet(s2 *CellSet) {
 	s.typ = SET_UNINITIALIZED
-	for c := range s2.Set {
-		delete(s.Set, c)
-	}
+	s2.each(func(c Cell) bool {
+		s.Remove(c)
+		return s.n > 0
+	})
 }
 
 type CellSetType int
@@ -212,7 +335,7 @@ const (
 
 func (s CellSet) GetCellsAsString() string {
 	out := ""
-	for c := range s.Set {
+	for _, c := range s.Cells() {
 		out += "/" + c.String()
 	}
 	if out == "" {
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestCellSetMatchesMap(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for round := 0; round < 100; round++ {
+		s := NewCellSet()
+		ref := map[Cell]bool{}
+		for i := 0; i < 200; i++ {
+			c := Cell{r.Intn(40) - 10, r.Intn(30) - 5}
+			if r.Intn(4) == 0 {
+				s.Remove(c)
+				delete(ref, c)
+			} else {
+				s.Add(c)
+				ref[c] = true
+			}
+		}
+
+		want := []Cell{}
+		for c := range ref {
+			want = append(want, c)
+		}
+		sort.Slice(want, func(i, j int) bool {
+			if want[i].Y != want[j].Y {
+				return want[i].Y < want[j].Y
+			}
+			return want[i].X < want[j].X
+		})
+		got := s.Cells()
+		if s.Len() != len(want) || len(got) != len(want) {
+			t.Fatalf("round %d: Len()=%d, len(Cells())=%d, want %d", round, s.Len(), len(got), len(want))
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("round %d: Cells()[%d]=%v, want %v", round, i, got[i], want[i])
+			}
+		}
+		m := s.Map()
+		for c := range ref {
+			delete(m, c)
+		}
+		if len(m) > 0 || len(s.Map()) != len(ref) {
+			t.Fatalf("round %d: Map()=%v, want %v", round, s.Map(), ref)
+		}
+		if len(want) > 0 && s.SomeCell() != want[0] {
+			t.Errorf("round %d: SomeCell()=%v, want %v", round, s.SomeCell(), want[0])
+		}
+
+		bb := CellBounds{}
+		for i, c := range want {
+			if i == 0 {
+				bb = CellBounds{c, c}
+			}
+			bb.Min.X, bb.Max.X = minInt(bb.Min.X, c.X), maxInt(bb.Max.X, c.X)
+			bb.Min.Y, bb.Max.Y = minInt(bb.Min.Y, c.Y), maxInt(bb.Max.Y, c.Y)
+		}
+		if s.Bounds() != bb {
+			t.Errorf("round %d: Bounds()=%v, want %v", round, s.Bounds(), bb)
+		}
+
+		// the same cells added in another order make an equal set
+		s2 := NewCellSet()
+		for i := len(want) - 1; i >= 0; i-- {
+			s2.Add(want[i])
+		}
+		if !s.Equals(s2) || !s2.Equals(s) || s.hash() != s2.hash() {
+			t.Errorf("round %d: sets with the same cells differ", round)
+		}
+		s2.translate(1, 0)
+		if len(want) > 0 && s.Equals(s2) {
+			t.Errorf("round %d: translated set equals the original", round)
+		}
+		s2.translate(-1, 0)
+		s2.SubtractSet(s)
+		if s2.Len() != 0 || (len(want) > 0 && !s.HasCommonCells(s)) {
+			t.Errorf("round %d: SubtractSet left %d cells", round, s2.Len())
+		}
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
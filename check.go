@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// renderHash identifies the source of a diagram together with the options
+// and fonts it is rendered with. Images rendered from the same source with
+// the same options and fonts have the same hash.
+func renderHash(source string, opt ConversionOptions) string {
+	key := opt.Directive() + "\n" + source
+	if opt.Fonts != nil {
+		// the default fonts are left out, keeping hashes of images
+		// rendered with them as they were
+		key = "fonts " + opt.Fonts.ID() + "\n" + key
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Results of checking the image rendered from a source.
+const (
+	CHECK_OK      = "ok"
+	CHECK_STALE   = "stale"
+	CHECK_MISSING = "missing"
+)
+
+// checkMain implements the "ditaa check DIR..." command. It finds the
+// diagram sources in the given trees and checks that the images rendered
+// from them are up to date, without writing anything. Images keep the
+// renderHash of the source they were rendered from; those which don't are
+// rendered again and compared pixel by pixel. Stale and missing images are
+// printed to stdout. Returns the process exit code: 0 if all images are up
+// to date, 1 if some are not, 2 if some file couldn't be read.
+func checkMain(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	ext := flags.String("ext", ".txt", "extension of the diagram sources")
+	imageExt := flags.String("image-ext", ".png", "extension of the images, replacing the extension of the source")
+	keepExt := flags.Bool("keep-ext", false, "append the image extension to the name of the source instead, as in diagram.txt.png")
+	encoding := flags.String("encoding", "auto", "encoding of the sources: auto, utf-8, utf-16, utf-16le, utf-16be, latin1 or windows-1252")
+	fontName := flags.String("font", "", "font `FILE`, FILE.ttc:N or installed font family the images were rendered with")
+	systemFonts := flags.Bool("system-fonts", true, "the images were rendered with -system-fonts")
+	lineHops := flags.Bool("line-hops", false, "the images were rendered with -line-hops")
+	junctionDots := flags.Bool("junction-dots", false, "the images were rendered with -junction-dots")
+	fallbacks := stringList{}
+	flags.Var(&fallbacks, "fallback-font", "fallback font `FILE`, FILE.ttc:N or family name the images were rendered with; may be repeated")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "USAGE: %s check [OPTIONS] DIR...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	opt := DefaultConversionOptions()
+	var err error
+	opt.Processing.Encoding, err = ParseEncoding(*encoding)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 2
+	}
+	opt.Processing.LineHops = *lineHops
+	opt.Processing.JunctionDots = *junctionDots
+	opt.Fonts, err = loadFonts(*fontName, fallbacks, *systemFonts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 2
+	}
+
+	imagePath := func(source string) string {
+		if *keepExt {
+			return source + *imageExt
+		}
+		return strings.TrimSuffix(source, filepath.Ext(source)) + *imageExt
+	}
+	status := 0
+	for _, root := range flags.Args() {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			switch {
+			case err != nil:
+				return err
+			case info.IsDir() && path != root && strings.HasPrefix(info.Name(), "."):
+				return filepath.SkipDir
+			case info.IsDir() || filepath.Ext(path) != *ext:
+				return nil
+			}
+			img := imagePath(path)
+			result, err := checkImage(path, img, opt)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: %s\n", err)
+				status = 2
+				return nil
+			}
+			if result != CHECK_OK {
+				fmt.Printf("%s: %s image %s\n", path, result, img)
+				if status == 0 {
+					status = 1
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			status = 2
+		}
+	}
+	return status
+}
+
+// checkImage checks if the image at imagePath is rendered from the source
+// at sourcePath with opt.
+func checkImage(sourcePath, imagePath string, opt ConversionOptions) (string, error) {
+	src, err := ioutil.ReadFile(sourcePath)
+	if err != nil {
+		return "", err
+	}
+	img, err := ioutil.ReadFile(imagePath)
+	if os.IsNotExist(err) {
+		return CHECK_MISSING, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	texts, err := readPNGText(img)
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", imagePath, err)
+	}
+	for _, t := range texts {
+		if t.Keyword != PNG_KEYWORD_HASH {
+			continue
+		}
+		source, _ := decode(src, opt.Processing.Encoding)
+		if t.Text == renderHash(string(source), opt) {
+			return CHECK_OK, nil
+		}
+		return CHECK_STALE, nil
+	}
+
+	// no hash in the image, it must be rendered again to tell
+	rendered := bytes.NewBuffer(nil)
+	_, err = renderPNG(bytes.NewReader(src), rendered, opt, nil)
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", sourcePath, err)
+	}
+	committed, err := png.Decode(bytes.NewReader(img))
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", imagePath, err)
+	}
+	fresh, err := png.Decode(rendered)
+	if err != nil {
+		return "", err
+	}
+	if !samePixels(committed, fresh) {
+		return CHECK_STALE, nil
+	}
+	return CHECK_OK, nil
+}
+
+func samePixels(a, b image.Image) bool {
+	if a.Bounds().Size() != b.Bounds().Size() {
+		return false
+	}
+	da := a.Bounds().Min.Sub(b.Bounds().Min)
+	for y := b.Bounds().Min.Y; y < b.Bounds().Max.Y; y++ {
+		for x := b.Bounds().Min.X; x < b.Bounds().Max.X; x++ {
+			r1, g1, b1, a1 := a.At(x+da.X, y+da.Y).RGBA()
+			r2, g2, b2, a2 := b.At(x, y).RGBA()
+			if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"math"
+	"sort"
+
+	"github.com/akavel/ditaa/fontmeasure"
+	"github.com/akavel/ditaa/graphical"
+)
+
+// lineEnd is an end of an open line, with the next point of the line.
+type lineEnd struct {
+	end, next graphical.Point
+}
+
+func endsOf(s *graphical.Shape) (start, end lineEnd) {
+	n := len(s.Points)
+	return lineEnd{s.Points[0], s.Points[1]}, lineEnd{s.Points[n-1], s.Points[n-2]}
+}
+
+// xy strips a point of everything but its position, for use as a map key.
+func xy(p graphical.Point) graphical.Point { return graphical.Point{X: p.X, Y: p.Y} }
+
+// findConnectors relates the open lines of d, joined across line hops and
+// at junctions, to the closed shapes and arrowheads at their ends and to the
+// text written on them.
+func findConnectors(d *graphical.Diagram, font *fontmeasure.Font) []graphical.Connector {
+	isLine := func(s *graphical.Shape) bool {
+		return s.Type == graphical.TYPE_SIMPLE && !s.Closed && len(s.Points) >= 2
+	}
+	linesAt := map[graphical.Point][]int{}
+	hopsAt := map[graphical.Point]int{}
+	for i := range d.Shapes {
+		s := &d.Shapes[i]
+		switch {
+		case isLine(s):
+			start, end := endsOf(s)
+			linesAt[xy(start.end)] = append(linesAt[xy(start.end)], i)
+			linesAt[xy(end.end)] = append(linesAt[xy(end.end)], i)
+		case s.Type == graphical.TYPE_LINE_HOP && len(s.Points) == 2:
+			hopsAt[xy(s.Points[0])] = i
+			hopsAt[xy(s.Points[1])] = i
+		}
+	}
+
+	used := map[int]bool{}
+	// follow goes from the end e of a line over line hops and the lines
+	// behind them, returning those and the end reached
+	follow := func(e lineEnd) ([]int, lineEnd) {
+		shapes := []int{}
+		for {
+			hop, ok := hopsAt[xy(e.end)]
+			if !ok || used[hop] {
+				return shapes, e
+			}
+			far := d.Shapes[hop].Points[0]
+			if xy(far) == xy(e.end) {
+				far = d.Shapes[hop].Points[1]
+			}
+			line := -1
+			for _, i := range linesAt[xy(far)] {
+				if !used[i] {
+					line = i
+					break
+				}
+			}
+			if line < 0 {
+				return shapes, e
+			}
+			used[hop], used[line] = true, true
+			shapes = append(shapes, hop, line)
+			start, end := endsOf(&d.Shapes[line])
+			if xy(start.end) == xy(far) {
+				e = end
+			} else {
+				e = start
+			}
+		}
+	}
+
+	// chains are the lines joined across line hops, from start to end
+	type chain struct {
+		lines      []int
+		start, end lineEnd
+	}
+	chains := []chain{}
+	for i := range d.Shapes {
+		if !isLine(&d.Shapes[i]) || used[i] {
+			continue
+		}
+		used[i] = true
+		start, end := endsOf(&d.Shapes[i])
+		back, start := follow(start)
+		forth, end := follow(end)
+		c := chain{start: start, end: end}
+		for j := len(back) - 1; j >= 0; j-- {
+			c.lines = append(c.lines, back[j])
+		}
+		c.lines = append(c.lines, i)
+		c.lines = append(c.lines, forth...)
+		chains = append(chains, c)
+	}
+
+	// chains meet at a junction where an end of one touches a line of
+	// another, or of itself; such ends are not attached to anything
+	group := make([]int, len(chains))
+	for i := range group {
+		group[i] = i
+	}
+	var root func(i int) int
+	root = func(i int) int {
+		if group[i] != i {
+			group[i] = root(group[i])
+		}
+		return group[i]
+	}
+	joined := map[graphical.Point]bool{}
+	for i := range chains {
+		for _, e := range []lineEnd{chains[i].start, chains[i].end} {
+			for j := range chains {
+				if !touchesChain(d, chains[j].lines, e, j == i) {
+					continue
+				}
+				joined[xy(e.end)] = true
+				group[root(i)] = root(j)
+			}
+		}
+	}
+
+	connectors := []graphical.Connector{}
+	for i := range chains {
+		if root(i) != i {
+			continue
+		}
+		conn := graphical.Connector{}
+		ends := []graphical.ConnectorEnd{}
+		for j := range chains {
+			if root(j) != i {
+				continue
+			}
+			conn.Lines = append(conn.Lines, chains[j].lines...)
+			for _, e := range []lineEnd{chains[j].start, chains[j].end} {
+				if !joined[xy(e.end)] {
+					shape, side, arrow := attachEnd(d, e)
+					ends = append(ends, graphical.ConnectorEnd{Shape: shape, Side: side, Arrow: arrow})
+				}
+			}
+		}
+		// ends without arrowheads come first, so that the connector
+		// points from Source to the other ends
+		if len(ends) == 2 && ends[0].Arrow >= 0 && ends[1].Arrow < 0 {
+			for j, k := 0, len(conn.Lines)-1; j < k; j, k = j+1, k-1 {
+				conn.Lines[j], conn.Lines[k] = conn.Lines[k], conn.Lines[j]
+			}
+		}
+		sort.SliceStable(ends, func(a, b int) bool { return ends[a].Arrow < 0 && ends[b].Arrow >= 0 })
+		for len(ends) < 2 {
+			ends = append(ends, graphical.ConnectorEnd{Shape: -1, Side: graphical.SIDE_NONE, Arrow: -1})
+		}
+		conn.Source, conn.SourceSide, conn.SourceArrow = ends[0].Shape, ends[0].Side, ends[0].Arrow
+		conn.Target, conn.TargetSide, conn.TargetArrow = ends[1].Shape, ends[1].Side, ends[1].Arrow
+		if len(ends) > 2 {
+			conn.Branches = ends[2:]
+		}
+		for j := range d.Labels {
+			if d.Labels[j].OnLine && crossesLabel(d, conn.Lines, d.Labels[j].BoundsFor(font)) {
+				conn.Labels = append(conn.Labels, j)
+			}
+		}
+		connectors = append(connectors, conn)
+	}
+	return connectors
+}
+
+// attachEnd finds the closed shape the end of a line is attached to, the
+// side of it, and the arrowhead at the end. Ends are attached to the
+// outlines they touch, or reach one cell further, past an arrowhead or a
+// gap left for looks.
+func attachEnd(d *graphical.Diagram, e lineEnd) (shape int, side graphical.Side, arrow int) {
+	gg := d.Grid
+	arrow = -1
+	for i := range d.Shapes {
+		s := &d.Shapes[i]
+		if s.Type != graphical.TYPE_ARROWHEAD {
+			continue
+		}
+		b := graphical.Bounds(s.Points)
+		center := graphical.Point{X: (b.Min.X + b.Max.X) / 2, Y: (b.Min.Y + b.Max.Y) / 2}
+		if gg.CellFor(center) == gg.CellFor(e.end) {
+			arrow = i
+			break
+		}
+	}
+
+	probe := e.end
+	switch {
+	case e.next.NorthOf(e.end):
+		side, probe.Y = graphical.SIDE_NORTH, probe.Y+float64(gg.CellH)
+	case e.next.SouthOf(e.end):
+		side, probe.Y = graphical.SIDE_SOUTH, probe.Y-float64(gg.CellH)
+	case e.next.WestOf(e.end):
+		side, probe.X = graphical.SIDE_WEST, probe.X+float64(gg.CellW)
+	case e.next.EastOf(e.end):
+		side, probe.X = graphical.SIDE_EAST, probe.X-float64(gg.CellW)
+	}
+	shape = -1
+	for i := range d.Shapes {
+		s := &d.Shapes[i]
+		if !s.Closed || s.Type == graphical.TYPE_ARROWHEAD || s.Type == graphical.TYPE_POINT_MARKER {
+			continue
+		}
+		if !onOutline(s, e.end) && !onOutline(s, probe) {
+			continue
+		}
+		if shape < 0 || s.SmallerThan(&d.Shapes[shape]) {
+			shape = i
+		}
+	}
+	if shape < 0 {
+		side = graphical.SIDE_NONE
+	}
+	return shape, side, arrow
+}
+
+// onOutline checks if p lies on the outline of the closed shape s.
+func onOutline(s *graphical.Shape, p graphical.Point) bool {
+	for i, a := range s.Points {
+		if onSegment(a, s.Points[(i+1)%len(s.Points)], p) {
+			return true
+		}
+	}
+	return false
+}
+
+// touchesChain checks if the end e of a chain touches any of the lines of a
+// chain, not counting line hops. Lines of the chain the end belongs to are
+// touched only away from their own ends, so that an end is not taken for a
+// junction with itself.
+func touchesChain(d *graphical.Diagram, lines []int, e lineEnd, own bool) bool {
+	for _, i := range lines {
+		if d.Shapes[i].Type != graphical.TYPE_SIMPLE {
+			continue
+		}
+		pts := d.Shapes[i].Points
+		for j := 1; j < len(pts); j++ {
+			if !onSegment(pts[j-1], pts[j], e.end) {
+				continue
+			}
+			if !own || xy(e.end) != xy(pts[0]) && xy(e.end) != xy(pts[len(pts)-1]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// onSegment checks if p lies on the segment from a to b.
+func onSegment(a, b, p graphical.Point) bool {
+	const tolerance = 1
+	dx, dy := b.X-a.X, b.Y-a.Y
+	t := 0.0
+	if l := dx*dx + dy*dy; l > 0 {
+		t = math.Max(0, math.Min(1, ((p.X-a.X)*dx+(p.Y-a.Y)*dy)/l))
+	}
+	return math.Hypot(a.X+t*dx-p.X, a.Y+t*dy-p.Y) <= tolerance
+}
+
+// crossesLabel checks if any horizontal or vertical segment of the lines
+// passes through r. Text is written only across such segments.
+func crossesLabel(d *graphical.Diagram, lines []int, r graphical.Rect) bool {
+	for _, i := range lines {
+		pts := d.Shapes[i].Points
+		for j := 1; j < len(pts); j++ {
+			a, b := pts[j-1], pts[j]
+			switch {
+			case a.Y == b.Y:
+				if a.Y >= r.Min.Y && a.Y <= r.Max.Y &&
+					math.Min(a.X, b.X) <= r.Max.X && math.Max(a.X, b.X) >= r.Min.X {
+					return true
+				}
+			case a.X == b.X:
+				if a.X >= r.Min.X && a.X <= r.Max.X &&
+					math.Min(a.Y, b.Y) <= r.Max.Y && math.Max(a.Y, b.Y) >= r.Min.Y {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
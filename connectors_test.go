@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/akavel/ditaa/graphical"
+)
+
+// describeConnectors lists the connectors of d, naming shapes after the
+// text inside them.
+func describeConnectors(d *graphical.Diagram) []string {
+	name := func(shape int) string {
+		if shape < 0 {
+			return "-"
+		}
+		bounds := graphical.Bounds(d.Shapes[shape].Points)
+		for _, l := range d.Labels {
+			if !l.OnLine && bounds.Contains(graphical.Point{X: float64(l.X), Y: float64(l.Y)}) {
+				return l.Text
+			}
+		}
+		return "?"
+	}
+	arrow := func(i int, head string) string {
+		if i < 0 {
+			return "-"
+		}
+		return head
+	}
+	result := []string{}
+	for _, c := range d.Connectors {
+		labels := []string{}
+		for _, i := range c.Labels {
+			labels = append(labels, d.Labels[i].Text)
+		}
+		branches := ""
+		for _, b := range c.Branches {
+			head := ""
+			if b.Arrow >= 0 {
+				head = ">"
+			}
+			branches += fmt.Sprintf(" +%s%s:%s", head, name(b.Shape), b.Side)
+		}
+		result = append(result, fmt.Sprintf("%s:%s %s-%d-%s %s:%s%s [%s]",
+			name(c.Source), c.SourceSide, arrow(c.SourceArrow, "<"), len(c.Lines), arrow(c.TargetArrow, ">"),
+			name(c.Target), c.TargetSide, branches, strings.Join(labels, " ")))
+	}
+	sort.Strings(result)
+	return result
+}
+
+func TestConnectors(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected []string
+	}{
+		{"testdata/text_on_lines.txt", []string{
+			"-:none --1-> -:none [hit]",
+			"Client:east --1-> Server:west [sends]",
+			"Server:south --1-> Store:north [reads]",
+		}},
+		{"testdata/line_hops.txt", []string{
+			"-:none --1-- -:none []",
+			"-:none --1-- -:none []",
+			"-:none --5-- -:none []",
+			"I/O:east --5-- Bus:west []",
+			// lines meeting at junctions make a single connector
+			"RAM:south --7-- Bus:north +Clock:east +CPU:south []",
+		}},
+		{"testdata/art18.txt", []string{
+			"-:none --5-> this is the triena bug:west +>window system abstraction:west +>math library:west []",
+		}},
+	}
+	for _, tt := range tests {
+		got := describeConnectors(&loadDiagram(t, tt.path).G)
+		if strings.Join(got, "\n") != strings.Join(tt.expected, "\n") {
+			t.Errorf("%s: got connectors:\n%s\nexpected:\n%s", tt.path, strings.Join(got, "\n"), strings.Join(tt.expected, "\n"))
+		}
+	}
+}
+
+func TestDescribeJunctions(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"testdata/art18.txt", "Connections: from a loose end to this is the triena bug, window system abstraction and math library."},
+		{"testdata/line_hops.txt", "Connections: between I/O and Bus; between RAM, Bus, Clock and CPU."},
+	}
+	for _, tt := range tests {
+		got := describeDiagram(&loadDiagram(t, tt.path).G)
+		if !strings.Contains(got, "\n"+tt.expected) {
+			t.Errorf("%s: got description:\n%s\nexpected it to contain:\n%s", tt.path, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/akavel/ditaa/graphical"
+)
+
+// Decorations are written right after the end of a line. For horizontal
+// lines they are:
+//
+//	--)    (--    open arrow
+//	--|>   <|--   hollow triangle
+//	--<>   <>--   hollow diamond
+//	--<#>  <#>--  filled diamond
+//	--o    o--    circle
+//	--|    |--    bar
+//	--||   ||--   exactly one
+//	--o|   |o--   zero or one
+//	--{    }--    many (crow's foot)
+//	--|{   }|--   one or many
+//	--o{   }o--   zero or many
+//
+// At the ends of vertical lines, 'o' is a circle, a lone '-' a bar, and 'M'
+// above or 'W' below a line a crow's foot.
+type decorationToken struct {
+	text       string // as written at the east or south end of a line
+	decoration graphical.Decoration
+}
+
+// horizontalDecorations are ordered so that longer tokens are matched first.
+var horizontalDecorations = []decorationToken{
+	{"<#>", graphical.DECORATION_FILLED_DIAMOND},
+	{"|>", graphical.DECORATION_TRIANGLE},
+	{"<>", graphical.DECORATION_DIAMOND},
+	{"||", graphical.DECORATION_ONE},
+	{"o|", graphical.DECORATION_ZERO_OR_ONE},
+	{"|{", graphical.DECORATION_ONE_OR_MANY},
+	{"o{", graphical.DECORATION_ZERO_OR_MANY},
+	{")", graphical.DECORATION_OPEN_ARROW},
+	{"o", graphical.DECORATION_CIRCLE},
+	{"|", graphical.DECORATION_BAR},
+	{"{", graphical.DECORATION_MANY},
+}
+
+var verticalDecorations = []decorationToken{
+	{"o", graphical.DECORATION_CIRCLE},
+	{"-", graphical.DECORATION_BAR},
+	{"W", graphical.DECORATION_MANY},
+}
+
+// outward returns the characters of the token in the order they are met
+// going away from the line. At the west and north ends of lines the token
+// is mirrored.
+func (d decorationToken) outward(mirror, vertical bool) []rune {
+	if !mirror {
+		return []rune(d.text)
+	}
+	swap := strings.NewReplacer("(", ")", ")", "(", "<", ">", ">", "<", "{", "}", "}", "{")
+	if vertical {
+		swap = strings.NewReplacer("W", "M")
+	}
+	return []rune(swap.Replace(d.text))
+}
+
+// lineDecoration is a decoration found in the grid, covering cells from the
+// end of a line outwards.
+type lineDecoration struct {
+	cells      []Cell
+	decoration graphical.Decoration
+	line       rune // character of the decorated line
+}
+
+// FindLineDecorations finds the decorations at the ends of lines, keyed by
+// their outermost cell.
+func (t *TextGrid) FindLineDecorations() map[Cell]lineDecoration {
+	lineLike := func(c Cell) bool { return isOneOf(t.Get(c), text_boundaries+text_cornerChars) }
+	result := map[Cell]lineDecoration{}
+	// match tries the tokens at the end of the line at c, going away from
+	// it with step
+	match := func(c Cell, step func(Cell) Cell, tokens []decorationToken, mirror, vertical bool) {
+	tokens:
+		for _, token := range tokens {
+			cells := []Cell{}
+			next := step(c)
+			for _, ch := range token.outward(mirror, vertical) {
+				if t.Get(next) != ch || !t.isLoneDecorationChar(next, vertical) {
+					continue tokens
+				}
+				cells = append(cells, next)
+				next = step(next)
+			}
+			// the line must not go on after the decoration
+			after := t.Get(next)
+			if isAlphNum(after) || (!vertical && t.IsHorizontalLine(next)) || (vertical && t.IsVerticalLine(next)) {
+				continue
+			}
+			result[cells[len(cells)-1]] = lineDecoration{cells, token.decoration, t.Get(c)}
+			return
+		}
+	}
+	for it := t.Iter(); it.Next(); {
+		c := it.Cell()
+		switch {
+		case t.IsHorizontalLine(c):
+			if lineLike(c.West()) {
+				match(c, Cell.East, horizontalDecorations, false, false)
+			}
+			if lineLike(c.East()) {
+				match(c, Cell.West, horizontalDecorations, true, false)
+			}
+		case t.IsVerticalLine(c):
+			if lineLike(c.North()) {
+				match(c, Cell.South, verticalDecorations, false, true)
+			}
+			if lineLike(c.South()) {
+				match(c, Cell.North, verticalDecorations, true, true)
+			}
+		}
+	}
+	return result
+}
+
+// isLoneDecorationChar checks that a character of a decoration of a
+// horizontal line isn't a part of a vertical line or of text, and the other
+// way round.
+func (t *TextGrid) isLoneDecorationChar(c Cell, vertical bool) bool {
+	lineLike := func(c Cell) bool {
+		return isOneOf(t.Get(c), text_boundaries+text_cornerChars) || isAlphNum(t.Get(c))
+	}
+	switch {
+	case vertical:
+		return !lineLike(c.West()) && !lineLike(c.East())
+	case t.Get(c) == '|':
+		return !lineLike(c.North()) && !lineLike(c.South())
+	}
+	return true
+}
+
+// ReplaceLineDecorations extends the lines over their decorations, and
+// returns the decorations found.
+func (t *TextGrid) ReplaceLineDecorations() map[Cell]lineDecoration {
+	decorations := t.FindLineDecorations()
+	for _, d := range decorations {
+		for _, c := range d.cells {
+			t.Set(c, d.line)
+		}
+	}
+	return decorations
+}
+
+// decorateEnds sets the decorations of the ends of an open shape, and moves
+// those ends to the outer edge of the decorations.
+func decorateEnds(s *graphical.Shape, decorations map[Cell]lineDecoration, gg graphical.Grid) {
+	if s.Closed || len(s.Points) < 2 {
+		return
+	}
+	n := len(s.Points)
+	for _, line := range []struct {
+		end, next  *graphical.Point
+		decoration *graphical.Decoration
+	}{
+		{&s.Points[0], &s.Points[1], &s.StartDecoration},
+		{&s.Points[n-1], &s.Points[n-2], &s.EndDecoration},
+	} {
+		cell := gg.CellFor(*line.end)
+		d, ok := decorations[Cell(cell)]
+		if !ok {
+			continue
+		}
+		switch {
+		case line.next.NorthOf(*line.end):
+			line.end.Y = gg.CellMaxY(cell)
+		case line.next.SouthOf(*line.end):
+			line.end.Y = gg.CellMinY(cell)
+		case line.next.WestOf(*line.end):
+			line.end.X = gg.CellMaxX(cell)
+		case line.next.EastOf(*line.end):
+			line.end.X = gg.CellMinX(cell)
+		default:
+			continue
+		}
+		line.end.Locked = true
+		*line.decoration = d.decoration
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/akavel/ditaa/graphical"
+)
+
+// describeDiagram tells in plain text what the diagram shows: the text of
+// its shapes, the connections between them, and any other text. It is meant
+// for readers who cannot see the image.
+func describeDiagram(d *graphical.Diagram) string {
+	texts := d.ShapeTexts()
+	labelShapes := d.LabelShapes()
+	name := func(i int) string {
+		switch {
+		case i < 0:
+			return "a loose end"
+		case texts[i] != "":
+			return texts[i]
+		}
+		return "a shape without text"
+	}
+
+	shapes, total, untitled := []string{}, 0, 0
+	for i, s := range d.Shapes {
+		if !s.Closed || s.Type == graphical.TYPE_ARROWHEAD || s.Type == graphical.TYPE_POINT_MARKER {
+			continue
+		}
+		total++
+		switch {
+		case texts[i] == "":
+			untitled++
+		case s.Tip != "":
+			shapes = append(shapes, fmt.Sprintf("%s (%s)", texts[i], s.Tip))
+		default:
+			shapes = append(shapes, texts[i])
+		}
+	}
+	if untitled > 0 {
+		shapes = append(shapes, fmt.Sprintf("%d without text", untitled))
+	}
+
+	connections := []string{}
+	for _, c := range d.Connectors {
+		ends := append([]graphical.ConnectorEnd{
+			{Shape: c.Source, Side: c.SourceSide, Arrow: c.SourceArrow},
+			{Shape: c.Target, Side: c.TargetSide, Arrow: c.TargetArrow},
+		}, c.Branches...)
+		all, plain, pointed, attached := []string{}, []string{}, []string{}, false
+		for _, e := range ends {
+			all = append(all, name(e.Shape))
+			if e.Arrow >= 0 {
+				pointed = append(pointed, name(e.Shape))
+			} else {
+				plain = append(plain, name(e.Shape))
+			}
+			attached = attached || e.Shape >= 0
+		}
+		if !attached {
+			continue
+		}
+		var desc string
+		switch {
+		case len(plain) == 0 && len(all) == 2:
+			desc = fmt.Sprintf("between %s, both ways", joinNames(all))
+		case len(plain) == 0:
+			desc = fmt.Sprintf("between %s, all ways", joinNames(all))
+		case len(pointed) > 0:
+			desc = fmt.Sprintf("from %s to %s", joinNames(plain), joinNames(pointed))
+		default:
+			desc = fmt.Sprintf("between %s", joinNames(all))
+		}
+		labels := []string{}
+		for _, i := range c.Labels {
+			labels = append(labels, d.Labels[i].Text)
+		}
+		if len(labels) > 0 {
+			desc += ", labelled " + strings.Join(labels, " ")
+		}
+		connections = append(connections, desc)
+	}
+
+	other := []string{}
+	for j, l := range d.Labels {
+		if !l.OnLine && labelShapes[j] < 0 {
+			other = append(other, l.Text)
+		}
+	}
+
+	lines := []string{fmt.Sprintf("A diagram of %d shape(s) and %d connection(s).", total, len(connections))}
+	if len(shapes) > 0 {
+		lines = append(lines, "Shapes: "+strings.Join(shapes, "; ")+".")
+	}
+	if len(connections) > 0 {
+		lines = append(lines, "Connections: "+strings.Join(connections, "; ")+".")
+	}
+	if len(other) > 0 {
+		lines = append(lines, "Other text: "+strings.Join(other, " ")+".")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// joinNames lists names as in "a, b and c".
+func joinNames(names []string) string {
+	if len(names) < 2 {
+		return strings.Join(names, "")
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+type Severity int
+
+const (
+	SEVERITY_WARNING Severity = iota
+	SEVERITY_ERROR
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SEVERITY_WARNING:
+		return "warning"
+	case SEVERITY_ERROR:
+		return "error"
+	}
+	return fmt.Sprintf("severity(%d)", int(s))
+}
+
+func (s Severity) MarshalText() ([]byte, error) { return []byte(s.String()), nil }
+
+func (s *Severity) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "warning":
+		*s = SEVERITY_WARNING
+	case "error":
+		*s = SEVERITY_ERROR
+	default:
+		return fmt.Errorf("unknown severity %q", text)
+	}
+	return nil
+}
+
+// SourcePos is a 1-based line and column in the diagram source text. Columns
+// are counted in characters, a tab or a wide character being one column.
+// Zero values mean the position is unknown.
+type SourcePos struct {
+	Line, Col int
+}
+
+func (p SourcePos) String() string {
+	switch {
+	case p.Line == 0:
+		return ""
+	case p.Col == 0:
+		return fmt.Sprintf("%d", p.Line)
+	}
+	return fmt.Sprintf("%d:%d", p.Line, p.Col)
+}
+
+// Codes identifying kinds of diagnostics, for use by tools consuming them.
+const (
+	DIAG_INVALID_ENCODING      = "invalid-encoding"
+	DIAG_BAD_DIRECTIVE         = "bad-directive"
+	DIAG_UNKNOWN_TAG           = "unknown-tag"
+	DIAG_TAG_OUTSIDE_SHAPE     = "tag-outside-shape"
+	DIAG_COLOR_OUTSIDE_SHAPE   = "color-outside-shape"
+	DIAG_AMBIGUOUS_BOUNDARY    = "ambiguous-boundary"
+	DIAG_UNDETERMINED_BOUNDARY = "undetermined-boundary"
+	DIAG_UNFILLABLE_BOUNDARY   = "unfillable-boundary"
+	DIAG_UNTRACEABLE_SHAPE     = "untraceable-shape"
+	DIAG_UNTRACEABLE_LINE      = "untraceable-line"
+	DIAG_DEGENERATE_CORNER     = "degenerate-corner"
+	DIAG_LINE_GAP              = "line-gap"
+	DIAG_LINE_NOT_CONNECTED    = "line-not-connected"
+	DIAG_ARROWHEAD_DETACHED    = "arrowhead-detached"
+	DIAG_ARROWHEAD_FAILED      = "arrowhead-failed"
+	DIAG_TEXT_ON_LINE          = "text-on-line"
+	DIAG_DUPLICATE_ID          = "duplicate-id"
+)
+
+type Diagnostic struct {
+	SourcePos
+	Severity Severity
+	Code     string
+	Message  string
+}
+
+// Format renders the diagnostic in the usual compiler style:
+// "file:line:col: warning: message".
+func (d Diagnostic) Format(filename string) string {
+	prefix := filename
+	if pos := d.SourcePos.String(); pos != "" {
+		prefix += ":" + pos
+	}
+	return fmt.Sprintf("%s: %s: %s", prefix, d.Severity, d.Message)
+}
+
+// Diagnostics collects warnings and errors found while parsing a diagram.
+// A nil *Diagnostics is valid and silently discards everything.
+type Diagnostics struct {
+	List []Diagnostic
+}
+
+func (d *Diagnostics) add(sev Severity, pos SourcePos, code, format string, args ...interface{}) {
+	if d == nil {
+		return
+	}
+	d.List = append(d.List, Diagnostic{
+		SourcePos: pos,
+		Severity:  sev,
+		Code:      code,
+		Message:   fmt.Sprintf(format, args...),
+	})
+}
+
+func (d *Diagnostics) Warnf(pos SourcePos, code, format string, args ...interface{}) {
+	d.add(SEVERITY_WARNING, pos, code, format, args...)
+}
+
+func (d *Diagnostics) Errorf(pos SourcePos, code, format string, args ...interface{}) {
+	d.add(SEVERITY_ERROR, pos, code, format, args...)
+}
+
+func (d *Diagnostics) Count(sev Severity) int {
+	if d == nil {
+		return 0
+	}
+	n := 0
+	for _, diag := range d.List {
+		if diag.Severity == sev {
+			n++
+		}
+	}
+	return n
+}
+
+// Sort orders the diagnostics by position in source, keeping the order in
+// which they were reported for equal positions.
+func (d *Diagnostics) Sort() {
+	if d == nil {
+		return
+	}
+	sort.SliceStable(d.List, func(i, j int) bool {
+		pi, pj := d.List[i].SourcePos, d.List[j].SourcePos
+		if pi.Line != pj.Line {
+			return pi.Line < pj.Line
+		}
+		return pi.Col < pj.Col
+	})
+}
+
+func (d *Diagnostics) Print(w io.Writer, filename string) {
+	if d == nil {
+		return
+	}
+	for _, diag := range d.List {
+		fmt.Fprintln(w, diag.Format(filename))
+	}
+}
+
+// SourcePos translates a cell of a grid built with LoadFrom back to the
+// position in the original source text.
+func (t *TextGrid) SourcePos(c Cell) SourcePos {
+	row, x := c.Y-blankBorderSize, c.X-blankBorderSize
+	line, col := row+1, x+1
+	if row >= 0 && row < len(t.srcLines) {
+		line = t.srcLines[row]
+	}
+	if row >= 0 && row < len(t.srcCols) && x >= 0 {
+		cols := t.srcCols[row]
+		switch {
+		case x < len(cols):
+			col = cols[x]
+		case len(cols) > 0:
+			// past the end of the line
+			col = cols[len(cols)-1] + x - len(cols) + 1
+		}
+	}
+	return SourcePos{Line: line, Col: col}
+}
+
+// topLeftCell returns the first cell of the set in reading order, so that
+// diagnostics about a whole set point at a stable position.
+func topLeftCell(cells *CellSet) Cell {
+	first := cells.SomeCell()
+	for _, c := range cells.Cells() {
+		if c.Y < first.Y || c.Y == first.Y && c.X < first.X {
+			first = c
+		}
+	}
+	return first
+}
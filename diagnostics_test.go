@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiagnosticPositions(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected []string
+	}{
+		{"{xx}\n", []string{"1:1: warning: unknown markup tag {xx}"}},
+		{"// comment\n\n  {xx}\n", []string{"3:3: warning: unknown markup tag {xx}"}},
+		// columns are counted in source characters, not in cells
+		{"\t{xx}\n", []string{"1:2: warning: unknown markup tag {xx}"}},
+		{"a\t\tb {xx}\n", []string{"1:6: warning: unknown markup tag {xx}"}},
+		{"中文 {xx}\n", []string{"1:4: warning: unknown markup tag {xx}"}},
+		{"#!ditaa tabs=x   shadows\n{xx}\n", []string{
+			`1:9: warning: tabs: expected a number from 1 to 32, got "x"`,
+			"2:1: warning: unknown markup tag {xx}",
+		}},
+		{"ab\xffc {xx}\n", []string{
+			"1:3: warning: invalid byte sequence in input, replaced with U+FFFD",
+			"1:6: warning: unknown markup tag {xx}",
+		}},
+	}
+	for _, tt := range tests {
+		diags := &Diagnostics{}
+		grid := NewTextGrid(0, 0)
+		directives, err := grid.LoadFrom(strings.NewReader(tt.source), ProcessingOptions{}, diags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opt := DefaultConversionOptions()
+		directives.Apply(&opt, diags)
+		diags.Sort()
+		got := []string{}
+		for _, d := range diags.List {
+			got = append(got, strings.TrimPrefix(d.Format(""), ":"))
+		}
+		if strings.Join(got, "\n") != strings.Join(tt.expected, "\n") {
+			t.Errorf("%q: got diagnostics:\n%s\nexpected:\n%s", tt.source, strings.Join(got, "\n"), strings.Join(tt.expected, "\n"))
+		}
+	}
+}
+
+func TestDiagnosticCodes(t *testing.T) {
+	tests := []struct {
+		source string
+		code   string
+	}{
+		{"+---+\n|   |\n+-- +\n", DIAG_LINE_GAP},
+		{"#!ditaa bogus\n", DIAG_BAD_DIRECTIVE},
+		{"+----+\n|{zz}|\n+----+\n", DIAG_UNKNOWN_TAG},
+		{"{d}\n", DIAG_TAG_OUTSIDE_SHAPE},
+		{"+----+ +----+\n|{id=a}| |{id=a}|\n+----+ +----+\n", DIAG_DUPLICATE_ID},
+		{"0++\n-+", DIAG_UNTRACEABLE_LINE},
+		{"---a-\n", DIAG_TEXT_ON_LINE},
+	}
+	for _, tt := range tests {
+		diags := &Diagnostics{}
+		grid := NewTextGrid(0, 0)
+		directives, err := grid.LoadFrom(strings.NewReader(tt.source), ProcessingOptions{}, diags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opt := DefaultConversionOptions()
+		directives.Apply(&opt, diags)
+		NewDiagram(grid, opt, diags)
+		codes := []string{}
+		for _, d := range diags.List {
+			codes = append(codes, d.Code)
+		}
+		if !strings.Contains(" "+strings.Join(codes, " ")+" ", " "+tt.code+" ") {
+			t.Errorf("%q: got diagnostics %v, expected one with code %s", tt.source, codes, tt.code)
+		}
+	}
+}
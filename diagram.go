@@ -2,24 +2,26 @@ package main
 
 import (
 	"fmt"
-	"os"
-
-	"github.com/golang/freetype"
-	"github.com/golang/freetype/truetype"
 
 	"github.com/akavel/ditaa/embd"
 	"github.com/akavel/ditaa/fontmeasure"
 	"github.com/akavel/ditaa/graphical"
 )
 
-var baseFont = func() *truetype.Font {
-	f, err := freetype.ParseFont(embd.File_font_ttf)
+var baseFont = func() *fontmeasure.Face {
+	f, err := fontmeasure.ParseFace(embd.File_font_ttf, 0)
 	if err != nil {
 		panic(err)
 	}
 	return f
 }()
 
+// baseFamily has only the embedded regular face; other styles of text are
+// synthesized from it. Installed fonts are not searched for missing glyphs,
+// so that rendering doesn't depend on the host; the command line turns that
+// on with -system-fonts.
+var baseFamily = &fontmeasure.Family{Regular: baseFont}
+
 type Diagram struct {
 	G graphical.Diagram
 }
@@ -29,8 +31,10 @@ An outline of the inner wor210kings of this very important (and monstrous)
 constructor is presented here. Boundary processing is the first step
 of the process:
 
-  1. Copy the grid into a work grid and remove all type-on-line
-     and point markers from the work grid
+  1. Copy the grid into a work grid and remove all type-on-line,
+     point markers and tags with values from the work grid. Replace line hops
+     with the vertical lines they hop over, and extend lines over
+     their end decorations.
   2. Split grid into distinct shapes by plotting the grid
      onto an AbstractionGrid and its getDistinctShapes() method.
   3. Find all the possible boundary sets of each of the
@@ -65,131 +69,73 @@ proceed with using those boundaries to create the shapes:
   3. Assign color codes to closed shapes.
   4. Assign extended markup tags to closed shapes.
   5. Create arrowheads.
-  6. Create point markers.
+  6. Create point markers, line hops and junction dots.
 
-Finally, the text processing occurs: [pending]
+Finally, the text processing occurs: [pending], and the open lines are
+related to the closed shapes they connect.
 
+Problems found along the way are reported to diags, which may be nil.
 */
-func NewDiagram(grid *TextGrid) *Diagram {
+func NewDiagram(grid *TextGrid, opt ConversionOptions, diags *Diagnostics) *Diagram {
 
 	workGrid := CopyTextGrid(grid)
-	workGrid.ReplaceTypeOnLine()
-	workGrid.ReplacePointMarkersOnLine()
-
-	if DEBUG {
-		fmt.Print(workGrid.DEBUG())
-	}
-
-	boundaries := getAllBoundaries(workGrid)
-	boundarySetsStep1 := getDistinctShapes(NewAbstractionGrid(workGrid, boundaries))
-
-	if DEBUG {
-		fmt.Println("******* Distinct shapes found using AbstractionGrid *******")
-		for _, cells := range boundarySetsStep1 {
-			cells.printAsGrid()
-		}
-		fmt.Println("******* Same set of shapes after processing them by filling *******")
-	}
-
-	//Find all the boundaries by using the special version of the filling method
-	//(fills in a different buffer than the buffer it reads from)
-	w, h := grid.Width(), grid.Height()
-	boundarySetsStep2 := []*CellSet{}
-	for _, cells := range boundarySetsStep1 {
-		//the fill buffer keeps track of which cells have been
-		//filled already
-		fillBuffer := NewTextGrid(3*w, 3*h)
-
-		for yi := 0; yi < 3*h; yi++ {
-			for xi := 0; xi < 3*w; xi++ {
-				if !fillBuffer.IsBlankXY(Cell{xi, yi}) {
-					continue
-				}
-
-				copyGrid := NewTextGrid(0, 0)
-				copyGrid.Rows = NewAbstractionGrid(workGrid, cells).Rows
-
-				boundaries := findBoundariesExpandingFrom(copyGrid, Cell{xi, yi})
-				if len(boundaries.Set) == 0 {
-					continue //i'm not sure why these occur
-				}
-				boundarySetsStep2 = append(boundarySetsStep2, makeScaledOneThirdEquivalent(boundaries))
-
-				copyGrid.Rows = NewAbstractionGrid(workGrid, cells).Rows
-				filled := copyGrid.fillContinuousArea(Cell{xi, yi}, '*')
-				FillCellsWith(fillBuffer.Rows, filled, '*')
-				FillCellsWith(fillBuffer.Rows, boundaries, '-')
-
-				if DEBUG {
-					makeScaledOneThirdEquivalent(boundaries).printAsGrid()
-					fmt.Println("-----------------------------------")
-				}
-			}
+	workGrid.RemoveValueTags()
+	typeOnLine, replacedOnLine, replacedOnVertical := NewCellSet(), NewCellSet(), NewCellSet()
+	for _, c := range workGrid.ReplaceTypeOnLine() {
+		typeOnLine.Add(c)
+		replacedOnLine.Add(c)
+		if workGrid.IsVerticalLine(c) {
+			replacedOnVertical.Add(c)
 		}
 	}
-
-	boundarySetsStep2 = removeDuplicateSets(boundarySetsStep2)
-	//TODO: debug print to verify duplicates removed
-
-	if DEBUG {
-		fmt.Println("******* First evaluation of openess *******")
+	for _, c := range workGrid.GetTypeBreakingLines() {
+		diags.Warnf(grid.SourcePos(c), DIAG_TEXT_ON_LINE, "text %q breaks a line; write it across a line at least two characters long on each side", grid.Get(c))
 	}
-	open, closed, mixed := categorizeBoundaries(boundarySetsStep2, workGrid)
+	workGrid.ReplacePointMarkersOnLine()
 
-	hadToEliminateMixed := false
-	if len(mixed) > 0 && len(closed) > 0 {
-		// mixed shapes can be eliminated by
-		// subtracting all the closed shapes from them
-		hadToEliminateMixed = true
-		//subtract from each of the mixed sets all the closed sets
-		for _, set := range mixed {
-			for _, closedSet := range closed {
-				set.SubtractSet(closedSet)
-			}
-			// this is necessary because some mixed sets produce
-			// several distinct open sets after you subtract the
-			// closed sets from them
-			if set.Type(workGrid) == SET_OPEN {
-				boundarySetsStep2 = remove(boundarySetsStep2, set)
-				boundarySetsStep2 = append(boundarySetsStep2, breakIntoDistinctBoundaries2(set, workGrid)...)
+	hops := workGrid.ReplaceLineHops()
+	decorations := workGrid.ReplaceLineDecorations()
+	if opt.Processing.LineHops {
+		// crossings on the outlines of closed shapes are corners, not hops
+		crossings := []Cell{}
+		for it := workGrid.Iter(); it.Next(); {
+			if workGrid.IsStraightCross(it.Cell()) {
+				crossings = append(crossings, it.Cell())
 			}
 		}
-	} else if len(mixed) > 0 && len(closed) == 0 {
-		// no closed shape exists, will have to
-		// handle mixed shape on its own
-		// an example of this case is the following:
-		// +-----+
-		// |  A  |C                 B
-		// +  ---+-------------------
-		// |     |
-		// +-----+
-		hadToEliminateMixed = true
-		for _, set := range mixed {
-			boundarySetsStep2 = remove(boundarySetsStep2, set)
-			boundarySetsStep2 = append(boundarySetsStep2, breakTrulyMixedBoundaries(set, workGrid)...)
+		if len(crossings) > 0 {
+			_, closed := findBoundarySets(workGrid, nil)
+			for _, c := range crossings {
+				if !anyContains(closed, c) {
+					workGrid.Set(c, workGrid.Get(c.South()))
+					hops = append(hops, c)
+				}
+			}
 		}
 	}
 
-	if hadToEliminateMixed {
-		open, closed, mixed = categorizeBoundaries(boundarySetsStep2, workGrid)
-	}
+	open, closed := findBoundarySets(workGrid, diags)
 
-	closed = removeObsoleteShapes(workGrid, closed)
-
-	//TODO: handle allCornersRound commandline option
-	allCornersRound := false
+	allCornersRound := opt.Processing.AllCornersRound
 
+	scale := opt.Rendering.Scale
+	if scale == 0 {
+		scale = 1
+	}
 	d := Diagram{}
 	d.G.Grid = graphical.Grid{
-		CellW: CELL_WIDTH,
-		CellH: CELL_HEIGHT,
-		W:     len(grid.Rows[0]) * CELL_WIDTH,
-		H:     len(grid.Rows) * CELL_HEIGHT,
+		CellW: int(CELL_WIDTH*scale + 0.5),
+		CellH: int(CELL_HEIGHT*scale + 0.5),
 	}
+	d.G.Grid.W = len(grid.Rows[0]) * d.G.Grid.CellW
+	d.G.Grid.H = len(grid.Rows) * d.G.Grid.CellH
 	//closedShapes := []interface{}{}
 	for _, set := range closed {
 		shape := createClosedComponentFromBoundaryCells(workGrid, set, d.G.Grid, allCornersRound)
 		if shape == nil {
+			if set.Len() >= 2 {
+				diags.Warnf(grid.SourcePos(topLeftCell(set)), DIAG_UNTRACEABLE_SHAPE, "cannot trace outline of closed shape, ignoring it")
+			}
 			continue
 		}
 		//switch shape := shape.(type) {
@@ -212,8 +158,14 @@ func NewDiagram(grid *TextGrid) *Diagram {
 	}
 
 	//make open shapes
+	lineEnds := NewCellSet()
+	for _, c := range hops {
+		// the ends of lines broken by a hop are joined by its arc
+		lineEnds.Add(c.West())
+		lineEnds.Add(c.East())
+	}
 	for _, set := range open {
-		switch len(set.Set) {
+		switch set.Len() {
 		case 1: //single cell "shape"
 			c := set.SomeCell()
 			if grid.CellContainsDashedLineChar(c) {
@@ -223,20 +175,31 @@ func NewDiagram(grid *TextGrid) *Diagram {
 			if shape != nil {
 				d.G.Shapes = append(d.G.Shapes, *shape)
 				ConnectEndsToAnchors(shape, workGrid, d.G.Grid)
+				checkLineEnds(shape, workGrid, d.G.Grid, lineEnds, diags)
 			}
 		default: //normal shape
 			if DEBUG {
 				fmt.Println(set.GetCellsAsString())
 			}
-			shapes := createOpenFromBoundaryCells(workGrid, set, d.G.Grid, allCornersRound)
+			shapes := createOpenFromBoundaryCells(workGrid, set, d.G.Grid, allCornersRound, diags)
 			for i := range shapes {
 				if !shapes[i].Closed {
+					decorateEnds(&shapes[i], decorations, d.G.Grid)
 					ConnectEndsToAnchors(&shapes[i], workGrid, d.G.Grid)
+					checkLineEnds(&shapes[i], workGrid, d.G.Grid, lineEnds, diags)
 				}
 			}
 			d.G.Shapes = append(d.G.Shapes, shapes...)
 		}
 	}
+	for i := range d.G.Shapes {
+		s := &d.G.Shapes[i]
+		for _, j := range s.DegenerateCorners(d.G.Grid) {
+			c := Cell(d.G.Grid.CellFor(s.Points[j]))
+			diags.Warnf(grid.SourcePos(c), DIAG_DEGENERATE_CORNER, "cannot round corner %q, drawing it sharp", grid.Get(c))
+			s.Points[j].Type = graphical.POINT_NORMAL
+		}
+	}
 
 	//assign color codes to shapes
 	//TODO: text on line should not change its color
@@ -245,18 +208,41 @@ func NewDiagram(grid *TextGrid) *Diagram {
 		c := graphical.Cell(pair.Cell)
 		p := graphical.Point{X: d.G.Grid.CellMidX(c), Y: d.G.Grid.CellMidY(c)}
 		containingShape := FindSmallestShapeContaining(p, d.G.Shapes)
-		if containingShape != nil {
-			color := pair.Color
-			containingShape.FillColor = &color
+		if containingShape == nil {
+			diags.Warnf(grid.SourcePos(pair.Cell), DIAG_COLOR_OUTSIDE_SHAPE, "color code %s is not inside any shape", grid.GetStringAt(pair.Cell, 4))
+			continue
 		}
+		color := pair.Color
+		containingShape.FillColor = &color
 	}
 
 	//assign markup to shapes
+	ids := map[string]bool{}
 	for _, pair := range grid.findMarkupTags() {
 		cell := graphical.Cell(pair.Cell)
 		p := graphical.Point{X: d.G.Grid.CellMidX(cell), Y: d.G.Grid.CellMidY(cell)}
 		containingShape := FindSmallestShapeContaining(p, d.G.Shapes)
 		if containingShape == nil {
+			diags.Warnf(grid.SourcePos(pair.Cell), DIAG_TAG_OUTSIDE_SHAPE, "markup tag {%s} is not inside any shape", pair.Tag)
+			continue
+		}
+		if _, ok := alignTags[pair.Tag]; ok {
+			// applied when laying out text
+			continue
+		}
+		if name, value, ok := splitValueTag(pair.Tag); ok {
+			switch name {
+			case "id":
+				if ids[value] {
+					diags.Warnf(grid.SourcePos(pair.Cell), DIAG_DUPLICATE_ID, "shape id %q is used more than once", value)
+				}
+				ids[value] = true
+				containingShape.ID = value
+			case "link", "href":
+				containingShape.Link = value
+			case "tip":
+				containingShape.Tip = value
+			}
 			continue
 		}
 		shapeCodes := map[string]graphical.ShapeType{
@@ -282,11 +268,14 @@ func NewDiagram(grid *TextGrid) *Diagram {
 
 	//make arrowheads
 	for _, c := range workGrid.FindArrowheads() {
+		if !workGrid.IsAttachedArrowhead(c) {
+			diags.Warnf(grid.SourcePos(c), DIAG_ARROWHEAD_DETACHED, "arrowhead %q is not attached to a line", workGrid.Get(c))
+		}
 		s := createArrowhead(workGrid, c, d.G.Grid)
 		if s != nil {
 			d.G.Shapes = append(d.G.Shapes, *s)
 		} else {
-			fmt.Fprintf(os.Stderr, "Could not create arrowhead shape. Unexpected error.")
+			diags.Errorf(grid.SourcePos(c), DIAG_ARROWHEAD_FAILED, "could not create arrowhead shape")
 		}
 	}
 
@@ -303,75 +292,140 @@ func NewDiagram(grid *TextGrid) *Diagram {
 		})
 	}
 
+	//make line hops
+	for _, c := range hops {
+		y := d.G.Grid.CellMidY(graphical.Cell(c))
+		hop := graphical.NewShape(
+			graphical.Point{X: d.G.Grid.CellMidX(graphical.Cell(c.West())), Y: y},
+			graphical.Point{X: d.G.Grid.CellMidX(graphical.Cell(c.East())), Y: y})
+		hop.Type = graphical.TYPE_LINE_HOP
+		hop.Dashed = grid.CellContainsDashedLineChar(c.West())
+		d.G.Shapes = append(d.G.Shapes, *hop)
+	}
+
+	//make junction dots, where open lines meet
+	if opt.Processing.JunctionDots {
+		for it := workGrid.Iter(); it.Next(); {
+			c := it.Cell()
+			if workGrid.Get(c) != '+' || !workGrid.IsIntersection(c) || anyContains(closed, c) {
+				continue
+			}
+			cell := graphical.Cell(c)
+			black := graphical.Color{0, 0, 0, 255}
+			d.G.Shapes = append(d.G.Shapes, graphical.Shape{
+				Points: []graphical.Point{
+					{X: d.G.Grid.CellMidX(cell), Y: d.G.Grid.CellMidY(cell)},
+				},
+				Type:        graphical.TYPE_POINT_MARKER,
+				FillColor:   &black,
+				StrokeColor: black,
+			})
+		}
+	}
+
 	d.G.Shapes = removeDuplicateShapes(d.G.Shapes)
 
 	//copy again
 	workGrid = CopyTextGrid(grid)
 	workGrid.RemoveNonText()
+	for _, c := range hops {
+		workGrid.Set(c, ' ')
+	}
+	for _, d := range decorations {
+		for _, c := range d.cells {
+			workGrid.Set(c, ' ')
+		}
+	}
 
 	// ****** handle text *******
 	//break up text into groups
+	w, h := grid.Width(), grid.Height()
 	textGroupGrid := CopyTextGrid(workGrid)
 	gaps := textGroupGrid.GetAllBlanksBetweenCharacters()
 	//kludge
-	for c := range gaps.Set {
+	for _, c := range gaps.Cells() {
 		textGroupGrid.Set(c, '|')
 	}
-	nonBlank := textGroupGrid.GetAllNonBlank()
+	// text on lines, with the rest of the words crossing vertical lines, is
+	// kept apart from any text next to it
+	for _, c := range typeOnLine.Cells() {
+		for _, step := range []func(Cell) Cell{Cell.West, Cell.East} {
+			for next := step(c); !textGroupGrid.IsBlankXY(next) && !typeOnLine.Contains(next); next = step(next) {
+				typeOnLine.Add(next)
+			}
+		}
+	}
+	nonBlank, nonBlankOnLine := NewCellSet(), NewCellSet()
+	for _, c := range textGroupGrid.GetAllNonBlank().Cells() {
+		if typeOnLine.Contains(c) {
+			nonBlankOnLine.Add(c)
+		} else {
+			nonBlank.Add(c)
+		}
+	}
 	textGroups := breakIntoDistinctBoundaries(nonBlank)
+	textGroupsOnLine := breakIntoDistinctBoundaries(nonBlankOnLine)
+	textGroups = append(textGroups, textGroupsOnLine...)
 	if DEBUG {
 		fmt.Println(len(textGroups), "text groups found")
 	}
 
-	font := fontmeasure.GetFontForHeight(baseFont, d.G.Grid.CellH)
+	family := opt.fonts()
+	font := fontmeasure.GetFontForHeight(family.Regular, d.G.Grid.CellH)
+	font.Family = family
+
+	//find text alignment set with markup tags
+	aligns := map[*graphical.Shape]TextAlign{}
+	for _, pair := range grid.findMarkupTags() {
+		align, ok := alignTags[pair.Tag]
+		if !ok {
+			continue
+		}
+		cell := graphical.Cell(pair.Cell)
+		p := graphical.Point{X: d.G.Grid.CellMidX(cell), Y: d.G.Grid.CellMidY(cell)}
+		if shape := FindSmallestShapeContaining(p, d.G.Shapes); shape != nil {
+			aligns[shape] = align
+		}
+	}
+	shapeOf := func(c Cell) *graphical.Shape {
+		cell := graphical.Cell(c)
+		p := graphical.Point{X: d.G.Grid.CellMidX(cell), Y: d.G.Grid.CellMidY(cell)}
+		return FindSmallestShapeContaining(p, d.G.Shapes)
+	}
 
-	for _, textGroupCellSet := range textGroups {
+	for i, textGroupCellSet := range textGroups {
+		onLine := i >= len(textGroups)-len(textGroupsOnLine)
+		// the line the text is on runs through the first replaced cell
+		vertical, lineAt := false, 0.0
+		for _, c := range textGroupCellSet.Cells() {
+			if !replacedOnLine.Contains(c) {
+				continue
+			}
+			vertical = replacedOnVertical.Contains(c)
+			if vertical {
+				lineAt = d.G.Grid.CellMidX(graphical.Cell(c))
+			} else {
+				lineAt = d.G.Grid.CellMidY(graphical.Cell(c))
+			}
+			break
+		}
 		isolationGrid := NewTextGrid(w, h)
 		CopySelectedCells(isolationGrid, textGroupCellSet, workGrid)
 		strings := isolationGrid.FindStrings()
-		for _, pair := range strings {
-			cell := graphical.Cell(pair.C)
-			s := pair.S
-			if DEBUG {
-				fmt.Println("Found string", s)
-			}
-			lastCell := graphical.Cell{cell.X + len(s) - 1, cell.Y}
-
-			minX := d.G.Grid.CellMinX(cell)
-			y := d.G.Grid.CellMaxY(cell)
-			maxX := d.G.Grid.CellMaxX(lastCell)
-
-			textObject := graphical.Label{
-				Text:     s,
-				FontSize: font.Size,
-				X:        int(minX + 0.5),
-				Y:        int(y + 0.5),
-				Color:    graphical.Color{A: 255},
-			}
-			if float64(font.WidthFor(s)) > maxX-minX { // does not fit horizontally
-				lessWideFont := fontmeasure.GetFontForWidth(baseFont, int(maxX-minX+0.5), s)
-				textObject.FontSize = lessWideFont.Size
-			}
-
-			textObject.CenterVerticallyBetween(int(d.G.Grid.CellMinY(cell)), int(d.G.Grid.CellMaxY(cell)), font)
-
-			//TODO: if the strings start with bullets they should be aligned to the left
-
-			// position text correctly
-			otherStart := isolationGrid.OtherStringsStartInTheSameColumn(Cell(cell))
-			otherEnd := isolationGrid.OtherStringsEndInTheSameColumn(Cell(lastCell))
-			if otherStart == 0 && otherEnd == 0 {
-				textObject.CenterHorizontallyBetween(int(minX), int(maxX), font)
-			} else if otherEnd > 0 && otherStart == 0 {
-				textObject.AlignRightEdgeTo(int(maxX), font)
-			} else if otherEnd > 0 && otherStart > 0 {
-				if otherEnd > otherStart {
-					textObject.AlignRightEdgeTo(int(maxX), font)
-				} else if otherEnd == otherStart {
-					textObject.CenterHorizontallyBetween(int(minX), int(maxX), font)
+		if DEBUG {
+			for _, pair := range strings {
+				fmt.Println("Found string", pair.S)
+			}
+		}
+		for _, par := range groupParagraphs(strings, shapeOf) {
+			labels := layoutParagraph(par, isolationGrid, d.G.Grid, font, aligns[par.shape])
+			for j := range labels {
+				labels[j].OnLine = onLine
+				if onLine {
+					labels[j].LineVertical, labels[j].LineAt = vertical, lineAt
 				}
 			}
-			d.G.Labels = append(d.G.Labels, textObject)
+			d.G.Labels = append(d.G.Labels, labels...)
 		}
 	}
 	// for _, l := range d.G.Labels {
@@ -389,8 +443,31 @@ func NewDiagram(grid *TextGrid) *Diagram {
 	for i := range d.G.Labels {
 		label := &d.G.Labels[i]
 		// FIXME(akavel): fix all usages of DPI/dpi
-		tmpFont := &fontmeasure.Font{Font: baseFont, DPI: 72}
-		shape := FindSmallestShapeIntersecting(label.BoundsFor(tmpFont), d.G.Shapes)
+		tmpFont := &fontmeasure.Font{Font: family.Regular, DPI: 72, Family: family}
+		bounds := label.BoundsFor(tmpFont)
+		if label.OnLine {
+			// the knockout behind the text matches the fill on either side
+			// of the line, which may be the outline of a shape
+			before := graphical.Point{X: (bounds.Min.X + bounds.Max.X) / 2, Y: label.LineAt - float64(d.G.Grid.CellH)/4}
+			after := graphical.Point{X: before.X, Y: label.LineAt + float64(d.G.Grid.CellH)/4}
+			if label.LineVertical {
+				before = graphical.Point{X: label.LineAt - float64(d.G.Grid.CellW)/4, Y: (bounds.Min.Y + bounds.Max.Y) / 2}
+				after = graphical.Point{X: label.LineAt + float64(d.G.Grid.CellW)/4, Y: before.Y}
+			}
+			if shape := FindSmallestShapeContaining(before, d.G.Shapes); shape != nil {
+				label.Background = shape.FillColor
+			}
+			if shape := FindSmallestShapeContaining(after, d.G.Shapes); shape != nil {
+				label.BackgroundAfter = shape.FillColor
+			}
+			// the text is read against both sides of the line
+			if label.Background != nil && IsDark(*label.Background) &&
+				label.BackgroundAfter != nil && IsDark(*label.BackgroundAfter) {
+				label.Color = graphical.WHITE
+			}
+			continue
+		}
+		shape := FindSmallestShapeIntersecting(bounds, d.G.Shapes)
 		if shape == nil || shape.FillColor == nil || !IsDark(*shape.FillColor) {
 			continue
 		}
@@ -400,6 +477,9 @@ func NewDiagram(grid *TextGrid) *Diagram {
 	//set outline to true for test within custom shapes
 	//[MC] TODO
 
+	//relate the lines to the shapes they connect
+	d.G.Connectors = findConnectors(&d.G, &fontmeasure.Font{Font: family.Regular, DPI: 72, Family: family})
+
 	return &d
 }
 
@@ -421,17 +501,21 @@ func removeDuplicateShapes(shapes []graphical.Shape) []graphical.Shape {
 	return origShapes
 }
 
+// createClosedComponentFromBoundaryCells traces the outline of a closed set
+// of cells. Returns nil if the outline can't be traced. The set must not be
+// open; findBoundarySets sorts the open ones out, so a panic here is a bug
+// in the caller.
 func createClosedComponentFromBoundaryCells(grid *TextGrid, cells *CellSet, gg graphical.Grid, allCornersRound bool) *graphical.Shape {
-	if cells.Type(grid) == SET_OPEN {
+	if cells.Type(grid, nil) == SET_OPEN {
 		panic("CellSet is open and cannot be handled by this method")
 	}
-	if len(cells.Set) < 2 {
+	if cells.Len() < 2 {
 		return nil
 	}
 
 	shape := graphical.NewShape()
 	shape.Closed = true
-	for c := range cells.Set {
+	for _, c := range cells.Cells() {
 		if isOneOf(grid.Get(c), text_dashedLines) {
 			shape.Dashed = true
 			break
@@ -441,31 +525,38 @@ func createClosedComponentFromBoundaryCells(grid *TextGrid, cells *CellSet, gg g
 	workGrid := NewTextGrid(grid.Width(), grid.Height())
 	CopySelectedCells(workGrid, cells, grid)
 
+	addCorner := func(c Cell) error {
+		if !workGrid.IsCorner(c) {
+			return nil
+		}
+		p, err := makePointForCell(c, workGrid, gg, allCornersRound)
+		shape.Points = append(shape.Points, p)
+		return err
+	}
 	start := cells.SomeCell()
-	if workGrid.IsCorner(start) {
-		shape.Points = append(shape.Points, makePointForCell(start, workGrid, gg, allCornersRound))
+	if addCorner(start) != nil {
+		return nil
 	}
 	prev := start
-	nextCells := workGrid.FollowCell(prev, nil)
-	if len(nextCells.Set) == 0 {
+	nextCells, err := workGrid.FollowCell(prev, nil)
+	if err != nil || nextCells.Len() == 0 {
 		return nil
 	}
 	cell := nextCells.SomeCell()
-	if workGrid.IsCorner(cell) {
-		shape.Points = append(shape.Points, makePointForCell(cell, workGrid, gg, allCornersRound))
+	if addCorner(cell) != nil {
+		return nil
 	}
 
-	for cell != start {
-		nextCells = workGrid.FollowCell(cell, &prev)
-		if len(nextCells.Set) > 1 {
+	for steps := 0; cell != start; steps++ {
+		nextCells, err = workGrid.FollowCell(cell, &prev)
+		// give up on forks, dead ends and loops which don't contain start
+		if err != nil || nextCells.Len() != 1 || steps > cells.Len() {
 			return nil
 		}
-		if len(nextCells.Set) == 1 {
-			prev = cell
-			cell = nextCells.SomeCell()
-			if cell != start && workGrid.IsCorner(cell) {
-				shape.Points = append(shape.Points, makePointForCell(cell, workGrid, gg, allCornersRound))
-			}
+		prev = cell
+		cell = nextCells.SomeCell()
+		if cell != start && addCorner(cell) != nil {
+			return nil
 		}
 	}
 
@@ -509,7 +600,7 @@ func removeObsoleteShapes(grid *TextGrid, sets []*CellSet) []*CellSet {
 		//find largest set
 		largest := set
 		for _, set2 := range common {
-			if len(set2.Set) > len(largest.Set) {
+			if set2.Len() > largest.Len() {
 				largest = set2
 			}
 		}
@@ -533,8 +624,10 @@ func removeObsoleteShapes(grid *TextGrid, sets []*CellSet) []*CellSet {
 	}
 
 	setsToRemove := []*CellSet{}
-	for i := range toRemove {
-		setsToRemove = append(setsToRemove, sets[i])
+	for i := range sets {
+		if toRemove[i] {
+			setsToRemove = append(setsToRemove, sets[i])
+		}
 	}
 
 	for _, set := range setsToRemove {
@@ -544,7 +637,7 @@ func removeObsoleteShapes(grid *TextGrid, sets []*CellSet) []*CellSet {
 }
 
 func getFilledEquivalent(cells *CellSet, grid *TextGrid) *CellSet {
-	if cells.Type(grid) == SET_OPEN {
+	if cells.Type(grid, nil) == SET_OPEN {
 		result := NewCellSet()
 		result.AddAll(cells)
 		return result
@@ -583,10 +676,10 @@ func indexof(vec []*CellSet, elem *CellSet) int {
 	return -1
 }
 
-func categorizeBoundaries(sets []*CellSet, grid *TextGrid) (open, closed, mixed []*CellSet) {
+func categorizeBoundaries(sets []*CellSet, grid *TextGrid, diags *Diagnostics) (open, closed, mixed []*CellSet) {
 	//split boundaries to open, closed and mixed
 	for _, set := range sets {
-		switch set.Type(grid) {
+		switch set.Type(grid, diags) {
 		case SET_CLOSED:
 			if DEBUG {
 				fmt.Println("Closed boundaries:")
@@ -622,9 +715,11 @@ func remove(vec []*CellSet, elem *CellSet) []*CellSet {
 
 func removeDuplicateSets(list []*CellSet) []*CellSet {
 	uniques := []*CellSet{}
+	byHash := map[uint64][]*CellSet{}
 	for _, set := range list {
+		h := set.hash()
 		original := true
-		for _, u := range uniques {
+		for _, u := range byHash[h] {
 			if set.Equals(u) {
 				original = false
 				break
@@ -632,52 +727,197 @@ func removeDuplicateSets(list []*CellSet) []*CellSet {
 		}
 		if original {
 			uniques = append(uniques, set)
+			byHash[h] = append(byHash[h], set)
 		}
 	}
 	return uniques
 }
 
-func makeScaledOneThirdEquivalent(cells *CellSet) *CellSet {
-	bb := cells.Bounds()
-	gridBig := NewTextGrid(bb.Max.X+2, bb.Max.Y+2)
-	FillCellsWith(gridBig.Rows, cells, '*')
+// findBoundarySets finds the sets of boundary cells of all the open and
+// closed shapes in the work grid.
+func findBoundarySets(workGrid *TextGrid, diags *Diagnostics) (open, closed []*CellSet) {
+	if DEBUG {
+		fmt.Print(workGrid.DEBUG())
+	}
+
+	boundaries := getAllBoundaries(workGrid)
+	boundarySetsStep1 := getDistinctShapes(NewAbstractionGrid(workGrid, boundaries))
+
+	if DEBUG {
+		fmt.Println("******* Distinct shapes found using AbstractionGrid *******")
+		for _, cells := range boundarySetsStep1 {
+			cells.printAsGrid()
+		}
+		fmt.Println("******* Same set of shapes after processing them by filling *******")
+	}
 
-	gridSmall := NewTextGrid((bb.Max.X+2)/3, (bb.Max.Y+2)/3)
-	for it := gridBig.Iter(); it.Next(); {
-		c := it.Cell()
-		if !gridBig.IsBlank(c) {
-			gridSmall.Set(Cell{c.X / 3, c.Y / 3}, '*')
+	//Find all the boundaries of areas enclosed by each of the shapes
+	boundarySetsStep2 := []*CellSet{}
+	for _, cells := range boundarySetsStep1 {
+		for _, boundaries := range findAreaBoundaries(workGrid, cells) {
+			boundarySetsStep2 = append(boundarySetsStep2, boundaries)
+			if DEBUG {
+				boundaries.printAsGrid()
+				fmt.Println("-----------------------------------")
+			}
 		}
 	}
-	return gridSmall.GetAllNonBlank()
+
+	boundarySetsStep2 = removeDuplicateSets(boundarySetsStep2)
+	//TODO: debug print to verify duplicates removed
+
+	if DEBUG {
+		fmt.Println("******* First evaluation of openess *******")
+	}
+	open, closed, mixed := categorizeBoundaries(boundarySetsStep2, workGrid, diags)
+
+	hadToEliminateMixed := false
+	if len(mixed) > 0 && len(closed) > 0 {
+		// mixed shapes can be eliminated by
+		// subtracting all the closed shapes from them
+		hadToEliminateMixed = true
+		//subtract from each of the mixed sets all the closed sets
+		for _, set := range mixed {
+			for _, closedSet := range closed {
+				set.SubtractSet(closedSet)
+			}
+			// this is necessary because some mixed sets produce
+			// several distinct open sets after you subtract the
+			// closed sets from them
+			if set.Type(workGrid, diags) == SET_OPEN {
+				boundarySetsStep2 = remove(boundarySetsStep2, set)
+				boundarySetsStep2 = append(boundarySetsStep2, breakIntoDistinctBoundaries2(set, workGrid)...)
+			}
+		}
+	} else if len(mixed) > 0 && len(closed) == 0 {
+		// no closed shape exists, will have to
+		// handle mixed shape on its own
+		// an example of this case is the following:
+		// +-----+
+		// |  A  |C                 B
+		// +  ---+-------------------
+		// |     |
+		// +-----+
+		hadToEliminateMixed = true
+		for _, set := range mixed {
+			boundarySetsStep2 = remove(boundarySetsStep2, set)
+			boundarySetsStep2 = append(boundarySetsStep2, breakTrulyMixedBoundaries(set, workGrid, diags)...)
+		}
+	}
+
+	if hadToEliminateMixed {
+		open, closed, mixed = categorizeBoundaries(boundarySetsStep2, workGrid, diags)
+	}
+	for _, set := range mixed {
+		diags.Warnf(workGrid.SourcePos(topLeftCell(set)), DIAG_AMBIGUOUS_BOUNDARY, "ambiguous boundary: cannot separate open lines from closed shapes, ignoring it")
+	}
+	for _, set := range boundarySetsStep2 {
+		if set.Type(workGrid, diags) == SET_UNDETERMINED {
+			diags.Warnf(workGrid.SourcePos(topLeftCell(set)), DIAG_UNDETERMINED_BOUNDARY, "cannot determine if boundary is open or closed, ignoring it")
+		}
+	}
+
+	closed = removeObsoleteShapes(workGrid, closed)
+	return open, closed
+
 }
 
-func findBoundariesExpandingFrom(grid *TextGrid, seed Cell) *CellSet {
-	boundaries := NewCellSet()
-	if grid.IsOutOfBounds(seed) {
-		return boundaries
-	}
-	oldChar := grid.Get(seed)
-	newChar := rune(1) //TODO: kludge
-	stack := []Cell{seed}
-	expand := func(c Cell) {
-		switch grid.Get(c) {
-		case oldChar:
-			stack = append(stack, c)
-		case '*':
-			boundaries.Add(c)
-		}
-	}
-	for len(stack) > 0 {
-		var c Cell
-		c, stack = stack[len(stack)-1], stack[:len(stack)-1]
-		grid.Set(c, newChar)
-		expand(c.North())
-		expand(c.South())
-		expand(c.East())
-		expand(c.West())
-	}
-	return boundaries
+func anyContains(sets []*CellSet, c Cell) bool {
+	for _, set := range sets {
+		if set.Contains(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// makeScaledOneThirdEquivalent maps cells of an AbstractionGrid back to the
+// cells of the TextGrid they were plotted from.
+func makeScaledOneThirdEquivalent(cells *CellSet) *CellSet {
+	result := NewCellSet()
+	for _, c := range cells.Cells() {
+		result.Add(Cell{c.X / 3, c.Y / 3})
+	}
+	return result
+}
+
+/*
+findAreaBoundaries finds the boundary of each area delimited by the
+cells of a shape. The shape is plotted on an AbstractionGrid, whose blank
+parts are labelled as connected areas in a single pass. For each area
+touching the shape, the cells of the shape adjacent to it are returned,
+scaled back to the size of the grid. Areas are ordered by their top-left
+corner.
+
+Only the bounding box of the shape, with a margin of one blank cell, is
+plotted: everything outside it is a single area, connected through the
+margin. When the margin would fall outside the grid, the whole grid is
+used, to keep the order of areas split by the shape.
+*/
+func findAreaBoundaries(grid *TextGrid, cells *CellSet) []*CellSet {
+	result := []*CellSet{}
+	if cells.Len() == 0 {
+		return result
+	}
+	bb := cells.Bounds()
+	x0, y0 := 3*bb.Min.X-1, 3*bb.Min.Y-1
+	x1, y1 := 3*bb.Max.X+4, 3*bb.Max.Y+4
+	if x0 < 0 || y0 < 0 || x1 > 3*grid.Width() || y1 > 3*grid.Height() {
+		x0, y0 = 0, 0
+		x1, y1 = 3*grid.Width(), 3*grid.Height()
+	}
+	w, h := x1-x0, y1-y0
+	rows := BlankRows(w, h)
+	for _, c := range cells.Cells() {
+		if grid.IsBlank(c) {
+			continue
+		}
+		for _, check := range abstractionChecks {
+			if check.check(grid, c) {
+				for dy := 0; dy < 3; dy++ {
+					for dx := 0; dx < 3; dx++ {
+						if check.result.Get(dx, dy) {
+							rows[3*c.Y+dy-y0][3*c.X+dx-x0] = '*'
+						}
+					}
+				}
+				break
+			}
+		}
+	}
+
+	label := make([]int, w*h) // 0 for not yet visited
+	area := 0
+	stack := []Cell{}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if rows[y][x] != ' ' || label[y*w+x] != 0 {
+				continue
+			}
+			area++
+			boundaries := NewCellSet()
+			label[y*w+x] = area
+			stack = append(stack[:0], Cell{x, y})
+			for len(stack) > 0 {
+				var c Cell
+				c, stack = stack[len(stack)-1], stack[:len(stack)-1]
+				for _, n := range [...]Cell{c.North(), c.South(), c.East(), c.West()} {
+					switch {
+					case n.X < 0 || n.Y < 0 || n.X >= w || n.Y >= h:
+					case rows[n.Y][n.X] != ' ':
+						boundaries.Add(Cell{n.X + x0, n.Y + y0})
+					case label[n.Y*w+n.X] == 0:
+						label[n.Y*w+n.X] = area
+						stack = append(stack, n)
+					}
+				}
+			}
+			if boundaries.Len() > 0 {
+				result = append(result, makeScaledOneThirdEquivalent(boundaries))
+			}
+		}
+	}
+	return result
 }
 
 func getDistinctShapes(g *AbstractionGrid) []*CellSet {
@@ -688,9 +928,7 @@ func getDistinctShapes(g *AbstractionGrid) []*CellSet {
 
 	distinct := breakIntoDistinctBoundaries(nonBlank)
 	for _, set := range distinct {
-		temp := EmptyAbstractionGrid(g.Width(), g.Height())
-		FillCellsWith(temp.Rows, set, '*')
-		result = append(result, temp.GetAsTextGrid().GetAllNonBlank())
+		result = append(result, makeScaledOneThirdEquivalent(set))
 	}
 	return result
 }
@@ -701,7 +939,7 @@ func breakIntoDistinctBoundaries(cells *CellSet) []*CellSet {
 	boundaryGrid := NewTextGrid(bb.Max.X+2, bb.Max.Y+2)
 	FillCellsWith(boundaryGrid.Rows, cells, '*')
 
-	for c := range cells.Set {
+	for _, c := range cells.Cells() {
 		if boundaryGrid.IsBlankXY(c) {
 			continue
 		}
@@ -736,13 +974,14 @@ into the following 3:
 	       -------------------
 
 Returns a list of boundaries that are either open or closed but not mixed.
+Lines which can't be traced are reported to diags.
 */
-func breakTrulyMixedBoundaries(cells *CellSet, grid *TextGrid) []*CellSet {
+func breakTrulyMixedBoundaries(cells *CellSet, grid *TextGrid, diags *Diagnostics) []*CellSet {
 	result := []*CellSet{}
 	visitedEnds := NewCellSet()
 	workGrid := NewTextGrid(grid.Width(), grid.Height())
 	CopySelectedCells(workGrid, cells, grid)
-	for start := range cells.Set {
+	for _, start := range cells.Cells() {
 		if !workGrid.IsLinesEnd(start) || visitedEnds.Contains(start) {
 			continue
 		}
@@ -750,9 +989,14 @@ func breakTrulyMixedBoundaries(cells *CellSet, grid *TextGrid) []*CellSet {
 		set.Add(start)
 
 		prev := start
-		nexts := workGrid.FollowCell(prev, nil)
-		if len(nexts.Set) == 0 {
-			panic("This shape is either open but multipart or has only one cell, and cannot be processed by this method")
+		nexts, err := workGrid.FollowCell(prev, nil)
+		if err != nil {
+			diags.Warnf(grid.SourcePos(start), DIAG_UNTRACEABLE_LINE, "%s, ignoring the line", err)
+			continue
+		}
+		if nexts.Len() == 0 {
+			// a lone cell; it's left in whatsLeft below
+			continue
 		}
 		cell := nexts.SomeCell()
 		set.Add(cell)
@@ -763,11 +1007,16 @@ func breakTrulyMixedBoundaries(cells *CellSet, grid *TextGrid) []*CellSet {
 			finished = true
 		}
 
-		for !finished {
-			nexts = workGrid.FollowCell(cell, &prev)
-			switch len(nexts.Set) {
-			case 0: // do nothing
-			case 1:
+		for steps := 0; !finished; steps++ {
+			nexts, err = workGrid.FollowCell(cell, &prev)
+			switch {
+			case err != nil:
+				diags.Warnf(grid.SourcePos(cell), DIAG_UNTRACEABLE_LINE, "%s, cutting the line short", err)
+				finished = true
+			case nexts.Len() == 0 || steps > cells.Len():
+				// dead end, or a loop without another end
+				finished = true
+			case nexts.Len() == 1:
 				set.Add(cell)
 				prev = cell
 				cell = nexts.SomeCell()
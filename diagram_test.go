@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/akavel/ditaa/graphical"
+)
+
+func corpusFiles(tb testing.TB) []string {
+	paths, err := filepath.Glob("testdata/*.txt")
+	if err != nil || len(paths) == 0 {
+		tb.Fatalf("no testdata found: %v", err)
+	}
+	return paths
+}
+
+func loadGrid(tb testing.TB, path string) *TextGrid {
+	r, err := os.Open(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer r.Close()
+	grid := NewTextGrid(0, 0)
+	_, err = grid.LoadFrom(r, ProcessingOptions{}, nil)
+	if err != nil {
+		tb.Fatalf("%s: %s", path, err)
+	}
+	return grid
+}
+
+// largeDiagram draws a cols x rows matrix of boxes, each connected with
+// arrows to its neighbours, similar to big deployment diagrams.
+func largeDiagram(cols, rows int) string {
+	buf := &bytes.Buffer{}
+	line := func(cell func(col int) string) {
+		for col := 0; col < cols; col++ {
+			buf.WriteString(cell(col))
+		}
+		buf.WriteString("\n")
+	}
+	for row := 0; row < rows; row++ {
+		line(func(int) string { return "+--------+     " })
+		line(func(col int) string {
+			if col == cols-1 {
+				return fmt.Sprintf("| n%-5d |     ", row*cols+col)
+			}
+			return fmt.Sprintf("| n%-5d +---->", row*cols+col) + " "
+		})
+		line(func(int) string { return "|   c1FF |     " })
+		line(func(int) string { return "+---+----+     " })
+		if row < rows-1 {
+			line(func(int) string { return "    |          " })
+			line(func(int) string { return "    v          " })
+		}
+	}
+	return buf.String()
+}
+
+// prepareWorkGrid repeats the first steps of NewDiagram.
+func prepareWorkGrid(grid *TextGrid) (*TextGrid, []*CellSet) {
+	workGrid := CopyTextGrid(grid)
+	workGrid.ReplaceTypeOnLine()
+	workGrid.ReplacePointMarkersOnLine()
+	boundaries := getAllBoundaries(workGrid)
+	return workGrid, getDistinctShapes(NewAbstractionGrid(workGrid, boundaries))
+}
+
+// findAreaBoundariesSlow is the original implementation of
+// findAreaBoundaries, kept as reference: it rebuilds the AbstractionGrid and
+// floods it from every blank cell not yet filled.
+func findAreaBoundariesSlow(workGrid *TextGrid, cells *CellSet) []*CellSet {
+	result := []*CellSet{}
+	w, h := workGrid.Width(), workGrid.Height()
+	fillBuffer := NewTextGrid(3*w, 3*h)
+	for yi := 0; yi < 3*h; yi++ {
+		for xi := 0; xi < 3*w; xi++ {
+			if !fillBuffer.IsBlankXY(Cell{xi, yi}) {
+				continue
+			}
+			copyGrid := NewTextGrid(0, 0)
+			copyGrid.Rows = NewAbstractionGrid(workGrid, cells).Rows
+			boundaries := NewCellSet()
+			if copyGrid.Get(Cell{xi, yi}) == ' ' {
+				for _, c := range copyGrid.fillContinuousArea(Cell{xi, yi}, 1).Cells() {
+					for _, n := range []Cell{c.North(), c.South(), c.East(), c.West()} {
+						if copyGrid.Get(n) == '*' {
+							boundaries.Add(n)
+						}
+					}
+				}
+			}
+			if boundaries.Len() == 0 {
+				continue
+			}
+			result = append(result, makeScaledOneThirdEquivalent(boundaries))
+
+			copyGrid.Rows = NewAbstractionGrid(workGrid, cells).Rows
+			filled := copyGrid.fillContinuousArea(Cell{xi, yi}, '*')
+			FillCellsWith(fillBuffer.Rows, filled, '*')
+			FillCellsWith(fillBuffer.Rows, boundaries, '-')
+		}
+	}
+	return result
+}
+
+func removeDuplicateSetsSlow(list []*CellSet) []*CellSet {
+	uniques := []*CellSet{}
+	for _, set := range list {
+		original := true
+		for _, u := range uniques {
+			if set.Equals(u) {
+				original = false
+				break
+			}
+		}
+		if original {
+			uniques = append(uniques, set)
+		}
+	}
+	return uniques
+}
+
+func touchingEdgePairsSlow(edges []edge) [][2]edge {
+	pairs := [][2]edge{}
+	for i, edge1 := range edges {
+		for _, edge2 := range edges[i+1:] {
+			if edge1.TouchesWith(edge2) {
+				pairs = append(pairs, [2]edge{edge1, edge2})
+			}
+		}
+	}
+	return pairs
+}
+
+func equalSetLists(a, b []*CellSet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equals(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestBoundaryDetectionUnchanged(t *testing.T) {
+	grids := map[string]*TextGrid{}
+	for _, path := range corpusFiles(t) {
+		grids[path] = loadGrid(t, path)
+	}
+	large := NewTextGrid(0, 0)
+	large.LoadFrom(strings.NewReader(largeDiagram(4, 3)), ProcessingOptions{}, nil)
+	grids["large"] = large
+
+	for name, grid := range grids {
+		workGrid, shapes := prepareWorkGrid(grid)
+		all := []*CellSet{}
+		for _, cells := range shapes {
+			got := findAreaBoundaries(workGrid, cells)
+			want := findAreaBoundariesSlow(workGrid, cells)
+			if !equalSetLists(got, want) {
+				t.Errorf("%s: findAreaBoundaries found %d sets, differing from the %d expected", name, len(got), len(want))
+			}
+			all = append(all, got...)
+		}
+		if !equalSetLists(removeDuplicateSets(all), removeDuplicateSetsSlow(all)) {
+			t.Errorf("%s: removeDuplicateSets differs from expected", name)
+		}
+
+		d := NewDiagram(grid, DefaultConversionOptions(), nil)
+		edges := shapeEdges(d.G.Shapes)
+		got, want := touchingEdgePairs(edges), touchingEdgePairsSlow(edges)
+		if len(got) != len(want) {
+			t.Errorf("%s: touchingEdgePairs found %d pairs, want %d", name, len(got), len(want))
+			continue
+		}
+		for i := range got {
+			if !got[i][0].Equals(want[i][0]) || !got[i][1].Equals(want[i][1]) {
+				t.Errorf("%s: touchingEdgePairs pair %d = %v, want %v", name, i, got[i], want[i])
+			}
+		}
+	}
+}
+
+func BenchmarkNewDiagram(b *testing.B) {
+	b.Run("corpus", func(b *testing.B) {
+		grids := []*TextGrid{}
+		for _, path := range corpusFiles(b) {
+			grids = append(grids, loadGrid(b, path))
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, grid := range grids {
+				NewDiagram(grid, DefaultConversionOptions(), nil)
+			}
+		}
+	})
+	b.Run("large", func(b *testing.B) {
+		// about 200x150 characters
+		grid := NewTextGrid(0, 0)
+		grid.LoadFrom(strings.NewReader(largeDiagram(13, 25)), ProcessingOptions{}, nil)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			NewDiagram(grid, DefaultConversionOptions(), nil)
+		}
+	})
+}
+
+func BenchmarkFindAreaBoundaries(b *testing.B) {
+	type input struct {
+		workGrid *TextGrid
+		shapes   []*CellSet
+	}
+	inputs := []input{}
+	for _, path := range corpusFiles(b) {
+		workGrid, shapes := prepareWorkGrid(loadGrid(b, path))
+		inputs = append(inputs, input{workGrid, shapes})
+	}
+	for _, impl := range []struct {
+		name string
+		find func(*TextGrid, *CellSet) []*CellSet
+	}{
+		{"slow", findAreaBoundariesSlow},
+		{"labelling", findAreaBoundaries},
+	} {
+		b.Run(impl.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for _, in := range inputs {
+					for _, cells := range in.shapes {
+						impl.find(in.workGrid, cells)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestTextOnLineBackground(t *testing.T) {
+	blue := graphical.Color{R: 0x55, G: 0x55, B: 0xbb, A: 0xff}
+	tests := []struct {
+		source        string
+		vertical      bool
+		before, after *graphical.Color
+	}{
+		// a label on the outline of a box is knocked out with white above
+		// the outline, and with the fill of the box below it
+		{"+--- ab ---+\n| cBLU     |\n+----------+\n", false, nil, &blue},
+		{"+----------+\n|          |\n|          |\nab   cBLU  |\n|          |\n|          |\n+----------+\n", true, nil, &blue},
+		{"+---------+\n| cBLU    |\n| --ab--> |\n+---------+\n", false, &blue, &blue},
+	}
+	for _, tt := range tests {
+		grid := NewTextGrid(0, 0)
+		_, err := grid.LoadFrom(strings.NewReader(tt.source), ProcessingOptions{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := NewDiagram(grid, DefaultConversionOptions(), nil)
+		found := false
+		for _, l := range d.G.Labels {
+			if !l.OnLine {
+				continue
+			}
+			found = true
+			if l.LineVertical != tt.vertical || !sameColor(l.Background, tt.before) || !sameColor(l.BackgroundAfter, tt.after) {
+				t.Errorf("%q: got label %q on vertical line %v with backgrounds %v, %v, expected %v, %v, %v",
+					tt.source, l.Text, l.LineVertical, l.Background, l.BackgroundAfter, tt.vertical, tt.before, tt.after)
+			}
+		}
+		if !found {
+			t.Errorf("%q: no text on line found", tt.source)
+		}
+	}
+}
+
+func sameColor(c1, c2 *graphical.Color) bool {
+	if c1 == nil || c2 == nil {
+		return c1 == c2
+	}
+	return *c1 == *c2
+}
@@ -24,15 +24,22 @@ func NewSmallLine(grid *TextGrid, c Cell, gg graphical.Grid) *graphical.Shape {
 }
 
 func ConnectEndsToAnchors(s *graphical.Shape, grid *TextGrid, gg graphical.Grid) {
-	if s.Closed {
+	if s.Closed || len(s.Points) < 2 {
 		return
 	}
 	n := len(s.Points)
 	// println(n)
-	for _, line := range []struct{ end, next *graphical.Point }{
-		{&s.Points[0], &s.Points[1]},
-		{&s.Points[n-1], &s.Points[n-2]},
+	for _, line := range []struct {
+		end, next  *graphical.Point
+		decoration graphical.Decoration
+	}{
+		{&s.Points[0], &s.Points[1], s.StartDecoration},
+		{&s.Points[n-1], &s.Points[n-2], s.EndDecoration},
 	} {
+		if line.decoration != graphical.DECORATION_NONE {
+			// already ends at the edge of the decoration
+			continue
+		}
 		var x, y float64
 		switch {
 		case line.next.NorthOf(*line.end):
@@ -53,11 +60,59 @@ func ConnectEndsToAnchors(s *graphical.Shape, grid *TextGrid, gg graphical.Grid)
 	}
 }
 
-func createOpenFromBoundaryCells(grid *TextGrid, cells *CellSet, gg graphical.Grid, allCornersRound bool) []graphical.Shape {
-	if cells.Type(grid) != SET_OPEN {
+// checkLineEnds reports line ends of s which stop one blank cell short of
+// another boundary, which usually means a box was not closed because of a
+// stray space, and ends which touch a boundary but could not be connected to
+// it by ConnectEndsToAnchors. Each problem is reported only once, seen
+// remembers the cells already reported.
+func checkLineEnds(s *graphical.Shape, grid *TextGrid, gg graphical.Grid, seen *CellSet, diags *Diagnostics) {
+	if s.Closed || len(s.Points) < 2 {
+		return
+	}
+	n := len(s.Points)
+	for _, line := range []struct{ end, next graphical.Point }{
+		{s.Points[0], s.Points[1]},
+		{s.Points[n-1], s.Points[n-2]},
+	} {
+		end := Cell(gg.CellFor(line.end))
+		if line.end.Locked || !grid.IsLinesEnd(end) {
+			continue
+		}
+		var dx, dy int
+		switch {
+		case line.next.NorthOf(line.end):
+			dy = 1
+		case line.next.SouthOf(line.end):
+			dy = -1
+		case line.next.WestOf(line.end):
+			dx = 1
+		case line.next.EastOf(line.end):
+			dx = -1
+		default:
+			continue
+		}
+		gap := Cell{end.X + dx, end.Y + dy}
+		beyond := Cell{gap.X + dx, gap.Y + dy}
+		switch {
+		case grid.IsBoundary(gap) && !seen.Contains(end):
+			seen.Add(end)
+			diags.Warnf(grid.SourcePos(end), DIAG_LINE_NOT_CONNECTED, "line ends next to a boundary without connecting to it")
+		case grid.IsBlank(gap) && grid.IsBoundary(beyond) && !seen.Contains(gap):
+			seen.Add(gap)
+			diags.Warnf(grid.SourcePos(gap), DIAG_LINE_GAP, "gap in line, shape may be unclosed because of a stray space")
+		}
+	}
+}
+
+// createOpenFromBoundaryCells makes the lines of an open set of cells.
+// Problems found while tracing them are reported to diags. The set must be
+// open; findBoundarySets sorts the closed ones out, so a panic here is a bug
+// in the caller.
+func createOpenFromBoundaryCells(grid *TextGrid, cells *CellSet, gg graphical.Grid, allCornersRound bool, diags *Diagnostics) []graphical.Shape {
+	if cells.Type(grid, nil) != SET_OPEN {
 		panic("CellSet is closed and cannot be handled by this method")
 	}
-	if len(cells.Set) == 0 {
+	if cells.Len() == 0 {
 		return []graphical.Shape{}
 	}
 
@@ -71,13 +126,21 @@ func createOpenFromBoundaryCells(grid *TextGrid, cells *CellSet, gg graphical.Gr
 	// }
 
 	visited := NewCellSet()
-	for c := range cells.Set {
+	for _, c := range cells.Cells() {
 		// fmt.Println("cell", c)
 		if workGrid.IsLinesEnd(c) {
 			// fmt.Println("- is lines end")
-			nextCells := workGrid.FollowCell(c, nil)
+			nextCells, err := workGrid.FollowCell(c, nil)
 			// fmt.Println("- nextCells", nextCells)
-			shapes = append(shapes, growEdgesFromCell(workGrid, gg, allCornersRound, nextCells.SomeCell(), c, visited)...)
+			if err != nil {
+				diags.Warnf(grid.SourcePos(c), DIAG_UNTRACEABLE_LINE, "%s, ignoring the line", err)
+				continue
+			}
+			if nextCells.Len() == 0 {
+				// a stray line end, not connected to anything
+				continue
+			}
+			shapes = append(shapes, growEdgesFromCell(workGrid, gg, allCornersRound, nextCells.SomeCell(), c, visited, diags)...)
 			break
 		}
 	}
@@ -104,10 +167,19 @@ func createOpenFromBoundaryCells(grid *TextGrid, cells *CellSet, gg graphical.Gr
 // 	return line
 // }
 
-func growEdgesFromCell(grid *TextGrid, gg graphical.Grid, allCornersRound bool, c, prev Cell, visited *CellSet) []graphical.Shape {
+func growEdgesFromCell(grid *TextGrid, gg graphical.Grid, allCornersRound bool, c, prev Cell, visited *CellSet, diags *Diagnostics) []graphical.Shape {
 	result := []graphical.Shape{}
+	shape := graphical.NewShape()
+	addPoint := func(c Cell) {
+		p, err := makePointForCell(c, grid, gg, allCornersRound)
+		if err != nil {
+			diags.Warnf(grid.SourcePos(c), DIAG_UNTRACEABLE_LINE, "%s, leaving it out of the line", err)
+			return
+		}
+		shape.Points = append(shape.Points, p)
+	}
 	visited.Add(prev)
-	shape := graphical.NewShape(makePointForCell(prev, grid, gg, allCornersRound))
+	addPoint(prev)
 	// if DEBUG {
 	// 	fmt.Printf("point at %s (call from line: %d)", prev, callfromline())
 	// }
@@ -116,9 +188,16 @@ func growEdgesFromCell(grid *TextGrid, gg graphical.Grid, allCornersRound bool,
 	}
 
 	for finished := false; !finished; {
+		if visited.Contains(c) {
+			// went around a loop; end the edge here instead of circling
+			if grid.IsPointCell(c) {
+				addPoint(c)
+			}
+			break
+		}
 		visited.Add(c)
 		if grid.IsPointCell(c) {
-			shape.Points = append(shape.Points, makePointForCell(c, grid, gg, allCornersRound))
+			addPoint(c)
 		}
 		if grid.CellContainsDashedLineChar(c) {
 			shape.Dashed = true
@@ -126,14 +205,18 @@ func growEdgesFromCell(grid *TextGrid, gg graphical.Grid, allCornersRound bool,
 		if grid.IsLinesEnd(c) {
 			finished = true
 		}
-		nextCells := grid.FollowCell(c, &prev)
-		if len(nextCells.Set) == 1 {
+		nextCells, err := grid.FollowCell(c, &prev)
+		if err != nil {
+			diags.Warnf(grid.SourcePos(c), DIAG_UNTRACEABLE_LINE, "%s, cutting the line short", err)
+			break
+		}
+		if nextCells.Len() == 1 {
 			prev = c
 			c = nextCells.SomeCell()
 		} else { // 3- or 4- way intersection
 			finished = true
-			for nextCell := range nextCells.Set {
-				result = append(result, growEdgesFromCell(grid, gg, allCornersRound, nextCell, c, visited)...)
+			for _, nextCell := range nextCells.Cells() {
+				result = append(result, growEdgesFromCell(grid, gg, allCornersRound, nextCell, c, visited, diags)...)
 			}
 		}
 	}
@@ -142,7 +225,9 @@ func growEdgesFromCell(grid *TextGrid, gg graphical.Grid, allCornersRound bool,
 	return result
 }
 
-func makePointForCell(c Cell, grid *TextGrid, gg graphical.Grid, allCornersRound bool) graphical.Point {
+// makePointForCell returns the point of a shape's outline at c, which must be
+// a corner, a line end or an intersection.
+func makePointForCell(c Cell, grid *TextGrid, gg graphical.Grid, allCornersRound bool) (graphical.Point, error) {
 	var typ graphical.PointType
 	switch {
 	case grid.IsCorner(c) && allCornersRound:
@@ -151,16 +236,16 @@ func makePointForCell(c Cell, grid *TextGrid, gg graphical.Grid, allCornersRound
 		typ = graphical.POINT_NORMAL
 	case grid.IsRoundCorner(c):
 		typ = graphical.POINT_ROUND
-	case grid.IsLinesEnd(c) || grid.IsIntersection(c):
+	case grid.IsLinesEnd(c) || grid.IsIntersection(c) || grid.IsStub(c):
 		typ = graphical.POINT_NORMAL
 	default:
-		panic(fmt.Sprint("Cannot make point for cell", c))
+		return graphical.Point{}, fmt.Errorf("cannot make a point of %q: not a corner, line end or intersection", grid.Get(c))
 	}
 	return graphical.Point{
 		X:    gg.CellMidX(graphical.Cell(c)),
 		Y:    gg.CellMidY(graphical.Cell(c)),
 		Type: typ,
-	}
+	}, nil
 }
 
 func createArrowhead(grid *TextGrid, c Cell, gg graphical.Grid) *graphical.Shape {
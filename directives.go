@@ -0,0 +1,215 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	directivePrefix = "#!ditaa"
+	commentPrefix   = "//"
+)
+
+// Limits of settings given in the diagram source, which must not be able to
+// make the renderer allocate huge images.
+const (
+	MIN_DIRECTIVE_SCALE = 0.1
+	MAX_DIRECTIVE_SCALE = 10.0
+	MAX_DIRECTIVE_TABS  = 32
+)
+
+// Directive is a single setting given inside the diagram source, in a line
+// like:
+//
+//	#!ditaa scale=2 shadows=off title="Order flow"
+//
+// A key given without a value is the same as key=on. Values with blanks are
+// written in double quotes, inside which quotes, backslashes and line breaks
+// are escaped as in Go strings: \", \\ and \n. Known keys are tabs,
+// round-corners, line-hops, junction-dots, shadows, scale, title and
+// description. Colour themes (like theme=dark) are not supported; such
+// directives are reported and ignored.
+//
+// Lines whose first non-blank characters are // are comments. Text after //
+// elsewhere in a line is left alone, as it may be a part of the diagram.
+type Directive struct {
+	SourcePos
+	Key, Value string
+}
+
+type Directives []Directive
+
+// preExtractDirectives removes directive and comment lines from the source.
+// It returns the remaining lines, together with the source line numbers of
+// each of them.
+func preExtractDirectives(lines [][]rune) (kept [][]rune, srcLines []int, ds Directives) {
+	for i, line := range lines {
+		switch {
+		case isDirective(line):
+			for x := len(directivePrefix); x < len(line); {
+				if unicode.IsSpace(line[x]) {
+					x++
+					continue
+				}
+				start := x
+				quoted := false
+				for x < len(line) && (quoted || !unicode.IsSpace(line[x])) {
+					switch {
+					case line[x] == '"':
+						quoted = !quoted
+					case line[x] == '\\' && quoted && x+1 < len(line):
+						x++
+					}
+					x++
+				}
+				field := string(line[start:x])
+				d := Directive{SourcePos: SourcePos{Line: i + 1, Col: start + 1}, Key: field, Value: "on"}
+				if eq := strings.IndexByte(field, '='); eq >= 0 {
+					d.Key, d.Value = field[:eq], field[eq+1:]
+					if len(d.Value) >= 2 && strings.HasPrefix(d.Value, `"`) && strings.HasSuffix(d.Value, `"`) {
+						if unquoted, err := strconv.Unquote(d.Value); err == nil {
+							d.Value = unquoted
+						} else {
+							// not escaped, e.g. a Windows path
+							d.Value = d.Value[1 : len(d.Value)-1]
+						}
+					}
+				}
+				ds = append(ds, d)
+			}
+		case strings.HasPrefix(strings.TrimLeftFunc(string(line), unicode.IsSpace), commentPrefix):
+		default:
+			kept = append(kept, line)
+			srcLines = append(srcLines, i+1)
+		}
+	}
+	return kept, srcLines, ds
+}
+
+func isDirective(line []rune) bool {
+	n := len(directivePrefix)
+	if !strings.HasPrefix(string(line), directivePrefix) {
+		return false
+	}
+	return len(line) == n || unicode.IsSpace(line[n])
+}
+
+func parseSwitch(s string) (bool, bool) {
+	switch strings.ToLower(s) {
+	case "on", "yes", "true", "1":
+		return true, true
+	case "off", "no", "false", "0":
+		return false, true
+	}
+	return false, false
+}
+
+// ApplyProcessing overrides the processing options with the settings found
+// in the directives.
+func (ds Directives) ApplyProcessing(opt *ProcessingOptions, diags *Diagnostics) {
+	for _, d := range ds {
+		switch d.Key {
+		case "tabs":
+			n, err := strconv.Atoi(d.Value)
+			if err != nil || n <= 0 || n > MAX_DIRECTIVE_TABS {
+				diags.Warnf(d.SourcePos, DIAG_BAD_DIRECTIVE, "tabs: expected a number from 1 to %d, got %q", MAX_DIRECTIVE_TABS, d.Value)
+				continue
+			}
+			opt.TabSize = n
+		case "round-corners":
+			on, ok := parseSwitch(d.Value)
+			if !ok {
+				diags.Warnf(d.SourcePos, DIAG_BAD_DIRECTIVE, "round-corners: expected on or off, got %q", d.Value)
+				continue
+			}
+			opt.AllCornersRound = on
+		case "line-hops":
+			on, ok := parseSwitch(d.Value)
+			if !ok {
+				diags.Warnf(d.SourcePos, DIAG_BAD_DIRECTIVE, "line-hops: expected on or off, got %q", d.Value)
+				continue
+			}
+			opt.LineHops = on
+		case "junction-dots":
+			on, ok := parseSwitch(d.Value)
+			if !ok {
+				diags.Warnf(d.SourcePos, DIAG_BAD_DIRECTIVE, "junction-dots: expected on or off, got %q", d.Value)
+				continue
+			}
+			opt.JunctionDots = on
+		}
+	}
+}
+
+// Apply overrides the conversion options with the settings found in the
+// directives. Unknown directives are reported to diags.
+func (ds Directives) Apply(opt *ConversionOptions, diags *Diagnostics) {
+	ds.ApplyProcessing(&opt.Processing, nil)
+	for _, d := range ds {
+		switch d.Key {
+		case "tabs", "round-corners", "line-hops", "junction-dots":
+			// handled in ApplyProcessing
+		case "shadows":
+			on, ok := parseSwitch(d.Value)
+			if !ok {
+				diags.Warnf(d.SourcePos, DIAG_BAD_DIRECTIVE, "shadows: expected on or off, got %q", d.Value)
+				continue
+			}
+			opt.Rendering.DropShadows = on
+		case "scale":
+			f, err := strconv.ParseFloat(d.Value, 64)
+			if err != nil || !(f >= MIN_DIRECTIVE_SCALE && f <= MAX_DIRECTIVE_SCALE) {
+				diags.Warnf(d.SourcePos, DIAG_BAD_DIRECTIVE, "scale: expected a number from %g to %g, got %q", MIN_DIRECTIVE_SCALE, MAX_DIRECTIVE_SCALE, d.Value)
+				continue
+			}
+			opt.Rendering.Scale = f
+		case "title":
+			opt.Rendering.Title = d.Value
+		case "description":
+			opt.Rendering.Description = d.Value
+		case "theme":
+			diags.Warnf(d.SourcePos, DIAG_BAD_DIRECTIVE, "theme: colour themes are not supported, ignoring %q", d.Value)
+		default:
+			diags.Warnf(d.SourcePos, DIAG_BAD_DIRECTIVE, "unknown directive %q", d.Key)
+		}
+	}
+}
+
+// Directive returns a directive line with the settings of opt which differ
+// from DefaultConversionOptions, or "" if none do. Fonts and the encoding
+// of the source are left out. Put above the diagram source, the line makes
+// it render the same with the default options.
+func (opt ConversionOptions) Directive() string {
+	def := DefaultConversionOptions()
+	fields := []string{}
+	onOff := func(key string, on, defOn bool) {
+		switch {
+		case on == defOn:
+		case on:
+			fields = append(fields, key+"=on")
+		default:
+			fields = append(fields, key+"=off")
+		}
+	}
+	if opt.Processing.TabSize != 0 && opt.Processing.TabSize != DEFAULT_TAB_SIZE {
+		fields = append(fields, "tabs="+strconv.Itoa(opt.Processing.TabSize))
+	}
+	onOff("round-corners", opt.Processing.AllCornersRound, def.Processing.AllCornersRound)
+	onOff("line-hops", opt.Processing.LineHops, def.Processing.LineHops)
+	onOff("junction-dots", opt.Processing.JunctionDots, def.Processing.JunctionDots)
+	onOff("shadows", opt.Rendering.DropShadows, def.Rendering.DropShadows)
+	if opt.Rendering.Scale != 0 && opt.Rendering.Scale != 1 {
+		fields = append(fields, "scale="+strconv.FormatFloat(opt.Rendering.Scale, 'g', -1, 64))
+	}
+	if opt.Rendering.Title != "" {
+		fields = append(fields, "title="+strconv.Quote(opt.Rendering.Title))
+	}
+	if opt.Rendering.Description != "" {
+		fields = append(fields, "description="+strconv.Quote(opt.Rendering.Description))
+	}
+	if len(fields) == 0 {
+		return ""
+	}
+	return directivePrefix + " " + strings.Join(fields, " ")
+}
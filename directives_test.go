@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPreExtractDirectives(t *testing.T) {
+	tests := []struct {
+		source     string
+		kept       string
+		srcLines   []int
+		directives string
+	}{
+		{"+--+\n|  |\n", "+--+|  |", []int{1, 2}, ""},
+		{"// comment\n+--+\n  // indented comment\n|  |\n", "+--+|  |", []int{2, 4}, ""},
+		{"a // not a comment\nhttp://x\n", "a // not a commenthttp://x", []int{1, 2}, ""},
+		{"#!ditaa scale=2 shadows\n+--+\n", "+--+", []int{2}, "1:9 scale=2; 1:17 shadows=on"},
+		{"#!ditaa   title=\"Order flow\" x=\"\"\n", "", nil, "1:11 title=Order flow; 1:30 x="},
+		{"#!ditaa\n#!ditaaa x\n #!ditaa y\n", "#!ditaaa x #!ditaa y", []int{2, 3}, ""},
+		{`#!ditaa title="say \"hi\" \\o/" d="C:\dir"`, "", nil, `1:9 title=say "hi" \o/; 1:33 d=C:\dir`},
+	}
+	for _, tt := range tests {
+		lines := [][]rune{}
+		for _, l := range strings.Split(strings.TrimSuffix(tt.source, "\n"), "\n") {
+			lines = append(lines, []rune(l))
+		}
+		kept, srcLines, ds := preExtractDirectives(lines)
+		got := ""
+		for _, l := range kept {
+			got += string(l)
+		}
+		directives := []string{}
+		for _, d := range ds {
+			directives = append(directives, fmt.Sprintf("%s %s=%s", d.SourcePos, d.Key, d.Value))
+		}
+		if got != tt.kept || fmt.Sprint(srcLines) != fmt.Sprint(tt.srcLines) || strings.Join(directives, "; ") != tt.directives {
+			t.Errorf("%q: got %q %v %q, expected %q %v %q", tt.source, got, srcLines, strings.Join(directives, "; "),
+				tt.kept, tt.srcLines, tt.directives)
+		}
+	}
+}
+
+func TestApplyDirectives(t *testing.T) {
+	tests := []struct {
+		directive string
+		check     func(ConversionOptions) bool
+		warnings  int
+	}{
+		{"scale=2", func(o ConversionOptions) bool { return o.Rendering.Scale == 2 }, 0},
+		{"scale=100", func(o ConversionOptions) bool { return o.Rendering.Scale == 0 }, 1},
+		{"shadows=off", func(o ConversionOptions) bool { return !o.Rendering.DropShadows }, 0},
+		{"shadows=maybe", func(o ConversionOptions) bool { return o.Rendering.DropShadows }, 1},
+		{"tabs=4 line-hops", func(o ConversionOptions) bool { return o.Processing.TabSize == 4 && o.Processing.LineHops }, 0},
+		{"round-corners junction-dots=yes", func(o ConversionOptions) bool {
+			return o.Processing.AllCornersRound && o.Processing.JunctionDots
+		}, 0},
+		{`title="A b" description=c`, func(o ConversionOptions) bool {
+			return o.Rendering.Title == "A b" && o.Rendering.Description == "c"
+		}, 0},
+		{"theme=dark", func(o ConversionOptions) bool { return true }, 1},
+		{"bogus", func(o ConversionOptions) bool { return true }, 1},
+	}
+	for _, tt := range tests {
+		_, _, ds := preExtractDirectives([][]rune{[]rune("#!ditaa " + tt.directive)})
+		opt := DefaultConversionOptions()
+		diags := &Diagnostics{}
+		ds.Apply(&opt, diags)
+		if !tt.check(opt) || len(diags.List) != tt.warnings {
+			t.Errorf("%q: got options %+v, diagnostics %+v", tt.directive, opt, diags.List)
+		}
+	}
+}
+
+func TestDirectiveRoundTrip(t *testing.T) {
+	opt := DefaultConversionOptions()
+	opt.Processing.TabSize = 4
+	opt.Processing.LineHops = true
+	opt.Rendering.DropShadows = false
+	opt.Rendering.Scale = 1.5
+	opt.Rendering.Title = `Orders "v2"`
+	opt.Rendering.Description = "Line one\nline two, C:\\dir"
+
+	line := opt.Directive()
+	if strings.ContainsAny(line, "\r\n") {
+		t.Fatalf("directive spans lines: %q", line)
+	}
+	_, _, ds := preExtractDirectives([][]rune{[]rune(line)})
+	got := DefaultConversionOptions()
+	diags := &Diagnostics{}
+	ds.Apply(&got, diags)
+	if got != opt || len(diags.List) != 0 {
+		t.Errorf("%s: got options %+v, diagnostics %+v, expected %+v", line, got, diags.List, opt)
+	}
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"flag"
 	"fmt"
 	"image"
 	"image/png"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 
+	"github.com/akavel/ditaa/fontmeasure"
 	"github.com/akavel/ditaa/graphical"
 )
 
@@ -19,68 +24,185 @@ const (
 	CELL_HEIGHT      = 14
 )
 
+// ConversionOptions gather all the settings of converting a diagram from
+// text to an image.
+type ConversionOptions struct {
+	Processing ProcessingOptions
+	Rendering  graphical.Options
+	// Fonts used for text; the embedded font if nil.
+	Fonts *fontmeasure.Family
+}
+
+func (opt ConversionOptions) fonts() *fontmeasure.Family {
+	if opt.Fonts == nil {
+		return baseFamily
+	}
+	return opt.Fonts
+}
+
+func DefaultConversionOptions() ConversionOptions {
+	return ConversionOptions{
+		Rendering: graphical.Options{DropShadows: true},
+	}
+}
+
 func main() {
-	args := os.Args[1:]
+	if len(os.Args) > 1 && os.Args[1] == "lint" {
+		os.Exit(lintMain(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "extract" {
+		os.Exit(extractMain(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(checkMain(os.Args[2:]))
+	}
+
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	showVersion := flags.Bool("version", false, "print version and exit")
+	strict := flags.Bool("strict", false, "fail if any warnings are found in the diagram")
+	encoding := flags.String("encoding", "auto", "encoding of INFILE: auto, utf-8, utf-16, utf-16le, utf-16be, latin1 or windows-1252")
+	fontName := flags.String("font", "", "font `FILE` (.ttf, .otf, or .ttc with FILE.ttc:N for its N-th font), or name of an installed font family, used for text")
+	systemFonts := flags.Bool("system-fonts", true, "search the installed fonts for characters missing from the other fonts")
+	lineHops := flags.Bool("line-hops", false, "draw plain crossings of lines as a horizontal line hopping over the vertical one")
+	junctionDots := flags.Bool("junction-dots", false, "mark the places where lines join with dots")
+	imageMap := flags.Bool("image-map", false, "also write an HTML image map of the shapes, named after OUTFILE with extension .map.html")
+	fallbacks := stringList{}
+	flags.Var(&fallbacks, "fallback-font", "font `FILE`, FILE.ttc:N or family name searched for characters missing from the main font; may be repeated")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "USAGE: %s [OPTIONS] INFILE OUTFILE.png\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s lint FILE...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s extract IMAGE [OUTFILE]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s check [OPTIONS] DIR...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(os.Args[1:])
+	args := flags.Args()
 	switch {
-	case len(args) == 1 && args[0] == "--version":
+	case *showVersion:
 		fmt.Fprintf(os.Stderr, "ditaa-go version %s\n", version)
 		os.Exit(1)
 	case len(args) != 2:
-		fmt.Fprintf(os.Stderr, "USAGE: %s INFILE OUTFILE.png\n", os.Args[0])
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	opt := DefaultConversionOptions()
+	var err error
+	opt.Processing.Encoding, err = ParseEncoding(*encoding)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
 		os.Exit(1)
 	}
 
-	err := run(args[0], args[1])
+	opt.Processing.LineHops = *lineHops
+	opt.Processing.JunctionDots = *junctionDots
+
+	opt.Fonts, err = loadFonts(*fontName, fallbacks, *systemFonts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+
+	err = run(args[0], args[1], opt, *strict, *imageMap)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %s\n", err)
 		os.Exit(2)
 	}
 }
 
-func run(infile, outfile string) error {
+func run(infile, outfile string, opt ConversionOptions, strict, imageMap bool) error {
 	r, err := os.Open(infile)
 	if err != nil {
 		return err
 	}
-	w, err := os.Create(outfile)
+	defer r.Close()
+	diags := &Diagnostics{}
+	buf := bytes.NewBuffer(nil)
+	diagram, err := renderPNG(r, buf, opt, diags)
+	diags.Sort()
+	diags.Print(os.Stderr, infile)
 	if err != nil {
 		return err
 	}
-	defer w.Close()
-	wbuf := bufio.NewWriter(w)
-	err = RenderPNG(r, wbuf)
-	if err != nil {
+	if n := diags.Count(SEVERITY_ERROR); n > 0 {
+		return fmt.Errorf("%d error(s) found in %s", n, infile)
+	}
+	if n := diags.Count(SEVERITY_WARNING); n > 0 && strict {
+		return fmt.Errorf("%d warning(s) found in %s (strict mode)", n, infile)
+	}
+	err = ioutil.WriteFile(outfile, buf.Bytes(), 0644)
+	if err != nil || !imageMap {
 		return err
 	}
-	err = wbuf.Flush()
+	base := strings.TrimSuffix(outfile, filepath.Ext(outfile))
+	mapBuf := bytes.NewBuffer(nil)
+	err = graphical.WriteImageMap(mapBuf, &diagram.G, filepath.Base(base))
 	if err != nil {
 		return err
 	}
-	return nil
+	return ioutil.WriteFile(base+".map.html", mapBuf.Bytes(), 0644)
+}
+
+// RenderPNG renders the diagram read from r as a PNG image into w. Any
+// problems found in the diagram are reported to diags, which may be nil.
+func RenderPNG(r io.Reader, w io.Writer, opt ConversionOptions, diags *Diagnostics) error {
+	_, err := renderPNG(r, w, opt, diags)
+	return err
 }
 
-func RenderPNG(r io.Reader, w io.Writer) error {
+// renderPNG is RenderPNG, also returning the rendered diagram.
+func renderPNG(r io.Reader, w io.Writer, opt ConversionOptions, diags *Diagnostics) (*Diagram, error) {
+	src, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
 	grid := NewTextGrid(0, 0)
-	err := grid.LoadFrom(r)
+	directives, err := grid.LoadFrom(bytes.NewReader(src), opt.Processing, diags)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	// the source and the options it was given are kept in the image, so
+	// that it can be rendered again
+	source, _ := decode(src, opt.Processing.Encoding)
+	texts := []pngText{{Keyword: PNG_KEYWORD_SOURCE, Text: string(source), Compressed: true}}
+	if d := opt.Directive(); d != "" {
+		texts = append(texts, pngText{Keyword: PNG_KEYWORD_OPTIONS, Text: d})
 	}
+	texts = append(texts, pngText{Keyword: PNG_KEYWORD_HASH, Text: renderHash(string(source), opt)})
+	directives.Apply(&opt, diags)
 	if DEBUG {
 		fmt.Println("Using grid:")
 		fmt.Print(grid.DEBUG())
 		//fmt.Print(grid.DEBUG()) // why this gets printed twice in Java code?
 	}
-	diagram := NewDiagram(grid)
+	diagram := NewDiagram(grid, opt, diags)
 
 	img := image.NewRGBA(image.Rect(0, 0, diagram.G.Grid.W, diagram.G.Grid.H))
-	err = graphical.RenderDiagram(img, &diagram.G, graphical.Options{DropShadows: true}, baseFont)
+	err = graphical.RenderDiagram(graphical.NewRasterCanvas(img), &diagram.G, opt.Rendering, opt.fonts())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = png.Encode(w, img)
+	buf := bytes.NewBuffer(nil)
+	err = png.Encode(buf, img)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	description := describeDiagram(&diagram.G)
+	if opt.Rendering.Description != "" {
+		description = opt.Rendering.Description + "\n\n" + description
+	}
+	texts = append([]pngText{{Keyword: "Description", Text: description}}, texts...)
+	if opt.Rendering.Title != "" {
+		texts = append([]pngText{{Keyword: "Title", Text: opt.Rendering.Title}}, texts...)
+	}
+	encoded, err := insertPNGText(buf.Bytes(), texts)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(encoded)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return diagram, nil
 }
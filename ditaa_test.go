@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/image/font/gofont/goregular"
+
+	"github.com/akavel/ditaa/fontmeasure"
+	"github.com/akavel/ditaa/graphical"
+)
+
+func renderFile(tb testing.TB, path string, opt ConversionOptions) []byte {
+	r, err := os.Open(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer r.Close()
+	w := bytes.NewBuffer(nil)
+	err = RenderPNG(r, w, opt, nil)
+	if err != nil {
+		tb.Fatalf("%s: %s", path, err)
+	}
+	return w.Bytes()
+}
+
+func TestRenderDeterministic(t *testing.T) {
+	runs := 5
+	if testing.Short() {
+		runs = 2
+	}
+	for _, path := range corpusFiles(t) {
+		first := sha256.Sum256(renderFile(t, path, DefaultConversionOptions()))
+		for i := 1; i < runs; i++ {
+			if sha256.Sum256(renderFile(t, path, DefaultConversionOptions())) != first {
+				t.Errorf("%s: run %d rendered a different image than run 0", path, i)
+				break
+			}
+		}
+	}
+}
+
+func TestImageMapScaled(t *testing.T) {
+	source := "+------+\n|{id=a}|\n+------+\n"
+	tests := []struct {
+		directive string
+		coords    string
+	}{
+		{"", `coords="25,35,95,35,95,63,25,63"`},
+		{"#!ditaa scale=2\n", `coords="50,70,190,70,190,126,50,126"`},
+	}
+	for _, tt := range tests {
+		diagram, err := renderPNG(strings.NewReader(tt.directive+source), ioutil.Discard, DefaultConversionOptions(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := bytes.NewBuffer(nil)
+		err = graphical.WriteImageMap(m, &diagram.G, "m")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(m.String(), tt.coords) {
+			t.Errorf("%q: got map:\n%s\nexpected area with %s", tt.directive, m.String(), tt.coords)
+		}
+	}
+}
+
+func TestPNGDescription(t *testing.T) {
+	source := "#!ditaa title=\"Café\" description=\"How clients are served\"\n" +
+		"+--------+     +--------+\n" +
+		"| Client |---->| Server |\n" +
+		"+--------+     +--------+\n"
+	buf := bytes.NewBuffer(nil)
+	_, err := renderPNG(strings.NewReader(source), buf, DefaultConversionOptions(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	texts, err := readPNGText(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []pngText{
+		{Keyword: "Title", Text: "Café"},
+		{Keyword: "Description", Text: "How clients are served\n\n" +
+			"A diagram of 2 shape(s) and 1 connection(s).\n" +
+			"Shapes: Client; Server.\n" +
+			"Connections: from Client to Server."},
+		{Keyword: PNG_KEYWORD_SOURCE, Text: source, Compressed: true},
+		{Keyword: PNG_KEYWORD_HASH, Text: renderHash(source, DefaultConversionOptions())},
+	}
+	if len(texts) != len(expected) {
+		t.Fatalf("got text chunks %+v, expected %+v", texts, expected)
+	}
+	for i := range expected {
+		if texts[i] != expected[i] {
+			t.Errorf("got text chunk %+v, expected %+v", texts[i], expected[i])
+		}
+	}
+}
+
+func TestExtractSource(t *testing.T) {
+	source := "#!ditaa scale=2\r\n+----+\r\n| Ωx |--+\r\n+----+  |\r\n"
+	opt := DefaultConversionOptions()
+	opt.Processing.LineHops = true
+	opt.Rendering.DropShadows = false
+	opt.Rendering.Title = "Ω flow"
+	buf := bytes.NewBuffer(nil)
+	_, err := renderPNG(strings.NewReader(source), buf, opt, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := extractSource(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "#!ditaa line-hops=on shadows=off title=\"Ω flow\"\n" + source
+	if got != expected {
+		t.Errorf("got source:\n%q\nexpected:\n%q", got, expected)
+	}
+
+	// rendered again with the default options, the source gives the same
+	// image
+	rerendered := bytes.NewBuffer(nil)
+	_, err = renderPNG(strings.NewReader(got), rerendered, DefaultConversionOptions(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldImg, err := png.Decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newImg, err := png.Decode(rerendered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(oldImg.(*image.RGBA).Pix, newImg.(*image.RGBA).Pix) {
+		t.Errorf("extracted source renders differently")
+	}
+}
+
+func TestCheckImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ditaa-check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source, img := dir+"/a.txt", dir+"/a.png"
+	write := func(path, content string) {
+		err := ioutil.WriteFile(path, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(step, expected string) {
+		got, err := checkImage(source, img, DefaultConversionOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != expected {
+			t.Errorf("%s: got %s, expected %s", step, got, expected)
+		}
+	}
+
+	write(source, "+---+\n| a |\n+---+\n")
+	check("not rendered", CHECK_MISSING)
+	err = run(source, img, DefaultConversionOptions(), false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("rendered", CHECK_OK)
+	write(source, "+---+\n| a |\n+---+\n// a comment\n")
+	check("source changed", CHECK_STALE)
+
+	// images without a hash are rendered again
+	m, err := png.Decode(bytes.NewReader(renderFile(t, source, DefaultConversionOptions())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(nil)
+	png.Encode(buf, m)
+	write(img, buf.String())
+	check("no hash", CHECK_OK)
+	write(source, "+---+\n| b |\n+---+\n")
+	check("no hash, source changed", CHECK_STALE)
+
+	// the fonts are a part of the hash
+	goFace, err := fontmeasure.ParseFace(goregular.TTF, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fonts := DefaultConversionOptions()
+	fonts.Fonts = &fontmeasure.Family{Regular: goFace}
+	err = run(source, img, fonts, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("rendered with other fonts", CHECK_STALE)
+	got, err := checkImage(source, img, fonts)
+	if err != nil || got != CHECK_OK {
+		t.Errorf("checked with the same fonts: got %s, %v, expected %s", got, err, CHECK_OK)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Encoding selects how the bytes of diagram source are decoded into text.
+type Encoding int
+
+const (
+	// ENCODING_AUTO is UTF-8, unless a UTF-8 or UTF-16 byte order mark is
+	// found at the start of input.
+	ENCODING_AUTO Encoding = iota
+	ENCODING_UTF8
+	// ENCODING_UTF16 detects endianness from the byte order mark,
+	// defaulting to big-endian if there is none.
+	ENCODING_UTF16
+	ENCODING_UTF16LE
+	ENCODING_UTF16BE
+	ENCODING_LATIN1
+	ENCODING_WINDOWS1252
+)
+
+var encodingNames = map[string]Encoding{
+	"auto":         ENCODING_AUTO,
+	"utf-8":        ENCODING_UTF8,
+	"utf8":         ENCODING_UTF8,
+	"utf-16":       ENCODING_UTF16,
+	"utf16":        ENCODING_UTF16,
+	"utf-16le":     ENCODING_UTF16LE,
+	"utf16le":      ENCODING_UTF16LE,
+	"utf-16be":     ENCODING_UTF16BE,
+	"utf16be":      ENCODING_UTF16BE,
+	"latin1":       ENCODING_LATIN1,
+	"latin-1":      ENCODING_LATIN1,
+	"iso-8859-1":   ENCODING_LATIN1,
+	"windows-1252": ENCODING_WINDOWS1252,
+	"cp1252":       ENCODING_WINDOWS1252,
+}
+
+// ParseEncoding finds an Encoding by its name, ignoring case.
+func ParseEncoding(name string) (Encoding, error) {
+	e, ok := encodingNames[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown encoding %q", name)
+	}
+	return e, nil
+}
+
+var (
+	bomUTF8    = []byte{0xEF, 0xBB, 0xBF}
+	bomUTF16LE = []byte{0xFF, 0xFE}
+	bomUTF16BE = []byte{0xFE, 0xFF}
+)
+
+// decode converts raw bytes to text according to encoding e, stripping any
+// byte order mark. Malformed input is replaced with utf8.RuneError, and the
+// indexes of those replacements in text are returned in invalid.
+func decode(buf []byte, e Encoding) (text []rune, invalid []int) {
+	if e == ENCODING_AUTO || e == ENCODING_UTF16 {
+		switch {
+		case bytes.HasPrefix(buf, bomUTF16LE):
+			e = ENCODING_UTF16LE
+		case bytes.HasPrefix(buf, bomUTF16BE):
+			e = ENCODING_UTF16BE
+		case e == ENCODING_UTF16:
+			e = ENCODING_UTF16BE
+		default:
+			e = ENCODING_UTF8
+		}
+	}
+
+	switch e {
+	case ENCODING_UTF16LE:
+		return decodeUTF16(bytes.TrimPrefix(buf, bomUTF16LE), func(b []byte) uint16 {
+			return uint16(b[0]) | uint16(b[1])<<8
+		})
+	case ENCODING_UTF16BE:
+		return decodeUTF16(bytes.TrimPrefix(buf, bomUTF16BE), func(b []byte) uint16 {
+			return uint16(b[0])<<8 | uint16(b[1])
+		})
+	case ENCODING_LATIN1:
+		text = make([]rune, len(buf))
+		for i, b := range buf {
+			text[i] = rune(b)
+		}
+		return text, nil
+	case ENCODING_WINDOWS1252:
+		text = make([]rune, len(buf))
+		for i, b := range buf {
+			text[i] = rune(b)
+			if 0x80 <= b && b < 0xA0 {
+				text[i] = windows1252[b-0x80]
+			}
+		}
+		return text, nil
+	}
+
+	buf = bytes.TrimPrefix(buf, bomUTF8)
+	text = make([]rune, 0, len(buf))
+	for len(buf) > 0 {
+		r, n := utf8.DecodeRune(buf)
+		if r == utf8.RuneError && n == 1 {
+			invalid = append(invalid, len(text))
+		}
+		text = append(text, r)
+		buf = buf[n:]
+	}
+	return text, invalid
+}
+
+func decodeUTF16(buf []byte, unit func([]byte) uint16) (text []rune, invalid []int) {
+	text = make([]rune, 0, len(buf)/2)
+	for ; len(buf) >= 2; buf = buf[2:] {
+		r := rune(unit(buf))
+		if utf16.IsSurrogate(r) {
+			if len(buf) >= 4 {
+				if pair := utf16.DecodeRune(r, rune(unit(buf[2:]))); pair != utf8.RuneError {
+					text = append(text, pair)
+					buf = buf[2:]
+					continue
+				}
+			}
+			// unpaired surrogate
+			invalid = append(invalid, len(text))
+			r = utf8.RuneError
+		}
+		text = append(text, r)
+	}
+	if len(buf) != 0 {
+		// odd trailing byte
+		invalid = append(invalid, len(text))
+		text = append(text, utf8.RuneError)
+	}
+	return text, invalid
+}
+
+// windows1252 maps bytes 0x80-0x9F of Windows-1252 to Unicode. Bytes left
+// undefined by the code page are mapped to the C1 controls, same as in
+// Latin-1.
+var windows1252 = [32]rune{
+	'€', '\u0081', '‚', 'ƒ', '„', '…', '†', '‡',
+	'ˆ', '‰', 'Š', '‹', 'Œ', '\u008D', 'Ž', '\u008F',
+	'\u0090', '‘', '’', '“', '”', '•', '–', '—',
+	'˜', '™', 'š', '›', 'œ', '\u009D', 'ž', 'Ÿ',
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		input    string
+		encoding Encoding
+		text     string
+		invalid  []int
+	}{
+		{"a-b", ENCODING_AUTO, "a-b", nil},
+		{"\xEF\xBB\xBFa-b", ENCODING_AUTO, "a-b", nil},
+		{"\xEF\xBB\xBFa-b", ENCODING_UTF8, "a-b", nil},
+		{"\xFF\xFEa\x00\xBD\x03", ENCODING_AUTO, "aν", nil},
+		{"\xFE\xFF\x00a\x03\xBD", ENCODING_AUTO, "aν", nil},
+		{"\xFE\xFF\x00a\x03\xBD", ENCODING_UTF16, "aν", nil},
+		{"\x00a\x03\xBD", ENCODING_UTF16, "aν", nil},
+		{"a\x00\xBD\x03", ENCODING_UTF16LE, "aν", nil},
+		{"\x00a\x03\xBD", ENCODING_UTF16BE, "aν", nil},
+		{"\x00a\xD8\x3D\xDE\x00", ENCODING_UTF16BE, "a😀", nil},
+		{"Caf\xE9 \x80", ENCODING_LATIN1, "Café \u0080", nil},
+		{"Caf\xE9 \x80\x81\x93", ENCODING_WINDOWS1252, "Café €\u0081“", nil},
+		// only the replacements of invalid input are reported, not
+		// U+FFFD written in the source
+		{"\xEF\xBF\xBDa\xFFb", ENCODING_UTF8, "�a�b", []int{2}},
+		{"\xFF\xFD\x00a\xD8\x00\x00b\x00", ENCODING_UTF16BE, "�a�b�", []int{2, 4}},
+	}
+	for _, tt := range tests {
+		text, invalid := decode([]byte(tt.input), tt.encoding)
+		if string(text) != tt.text || fmt.Sprint(invalid) != fmt.Sprint(tt.invalid) {
+			t.Errorf("decode(%q, %d) = %q, %v; expected %q, %v", tt.input, tt.encoding, string(text), invalid, tt.text, tt.invalid)
+		}
+	}
+}
+
+func TestPreSplit(t *testing.T) {
+	long := strings.Repeat("-", 100000)
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{"a\nb\n", []string{"a", "b"}},
+		{"a\r\nb\r\n", []string{"a", "b"}},
+		{"a\rb\r\rc", []string{"a", "b", "", "c"}},
+		{"a\r\n\nb", []string{"a", "", "b"}},
+		// longer than bufio.Scanner accepts by default
+		{"+" + long + "+\n", []string{"+" + long + "+"}},
+	}
+	for _, tt := range tests {
+		lines, err := preSplit(bytes.NewReader([]byte(tt.input)), ENCODING_AUTO, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, l := range lines {
+			got = append(got, string(l))
+		}
+		if strings.Join(got, "|") != strings.Join(tt.expected, "|") {
+			t.Errorf("%.20q: got lines %.60q, expected %.60q", tt.input, got, tt.expected)
+		}
+	}
+}
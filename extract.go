@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// extractMain implements the "ditaa extract IMAGE [OUTFILE]" command. It
+// recovers the diagram source kept in an image rendered by ditaa, and writes
+// it to OUTFILE, or to stdout if not given. Options the image was rendered
+// with are written as a directive line above the source. Returns the process
+// exit code: 0 on success, 1 if the image holds no source, 2 on other errors.
+func extractMain(args []string) int {
+	flags := flag.NewFlagSet("extract", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "USAGE: %s extract IMAGE [OUTFILE]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		return 2
+	}
+	img, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 2
+	}
+	source, err := extractSource(img)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s: %s\n", flags.Arg(0), err)
+		return 2
+	}
+	if source == "" {
+		fmt.Fprintf(os.Stderr, "error: %s: no diagram source found in the image\n", flags.Arg(0))
+		return 1
+	}
+	if flags.NArg() == 2 {
+		err = ioutil.WriteFile(flags.Arg(1), []byte(source), 0644)
+	} else {
+		_, err = os.Stdout.WriteString(source)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 2
+	}
+	return 0
+}
+
+// extractSource returns the diagram source kept in an encoded PNG image,
+// preceded by the directive line of the options it was rendered with, if
+// any. Returns "" if the image holds no source.
+func extractSource(img []byte) (string, error) {
+	texts, err := readPNGText(img)
+	if err != nil {
+		return "", err
+	}
+	var source, options string
+	found := false
+	for _, t := range texts {
+		switch t.Keyword {
+		case PNG_KEYWORD_SOURCE:
+			source, found = t.Text, true
+		case PNG_KEYWORD_OPTIONS:
+			options = t.Text
+		}
+	}
+	if !found || options == "" {
+		return source, nil
+	}
+	return options + "\n" + source, nil
+}
@@ -0,0 +1,98 @@
+package fontmeasure
+
+import (
+	"sync"
+
+	"golang.org/x/image/math/fixed"
+)
+
+// Laying out a diagram measures the same strings many times over: once for
+// choosing the font size, then again for each alignment. Results are
+// remembered here, keyed by everything that affects them.
+
+// maxCacheEntries bounds the memory used by long-running processes; the
+// caches are simply dropped when full.
+const maxCacheEntries = 1 << 16
+
+// noCache disables the caches, for comparison in benchmarks.
+var noCache = false
+
+type widthKey struct {
+	face      *Face
+	family    *Family
+	size, dpi float64
+	text      string
+}
+
+type glyphKey struct {
+	face  *Face
+	scale fixed.Int26_6
+	r     rune
+}
+
+var (
+	cacheMu       sync.Mutex
+	widthCache    = map[widthKey]int{}
+	heightCache   = map[glyphKey]fixed.Int26_6{}
+	hasGlyphCache = map[glyphKey]bool{}
+)
+
+func cachedWidth(key widthKey, compute func() int) int {
+	if noCache {
+		return compute()
+	}
+	cacheMu.Lock()
+	w, ok := widthCache[key]
+	cacheMu.Unlock()
+	if ok {
+		return w
+	}
+	w = compute()
+	cacheMu.Lock()
+	if len(widthCache) >= maxCacheEntries {
+		widthCache = map[widthKey]int{}
+	}
+	widthCache[key] = w
+	cacheMu.Unlock()
+	return w
+}
+
+func cachedHeight(key glyphKey, compute func() fixed.Int26_6) fixed.Int26_6 {
+	if noCache {
+		return compute()
+	}
+	cacheMu.Lock()
+	h, ok := heightCache[key]
+	cacheMu.Unlock()
+	if ok {
+		return h
+	}
+	h = compute()
+	cacheMu.Lock()
+	if len(heightCache) >= maxCacheEntries {
+		heightCache = map[glyphKey]fixed.Int26_6{}
+	}
+	heightCache[key] = h
+	cacheMu.Unlock()
+	return h
+}
+
+func cachedHasGlyph(key glyphKey, compute func() bool) bool {
+	if noCache {
+		return compute()
+	}
+	cacheMu.Lock()
+	has, ok := hasGlyphCache[key]
+	cacheMu.Unlock()
+	if ok {
+		return has
+	}
+	has = compute()
+	cacheMu.Lock()
+	if len(hasGlyphCache) >= maxCacheEntries {
+		hasGlyphCache = map[glyphKey]bool{}
+	}
+	hasGlyphCache[key] = has
+	cacheMu.Unlock()
+	return has
+}
@@ -0,0 +1,138 @@
+package fontmeasure
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/golang/freetype"
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+)
+
+// Face is a single font parsed from a TrueType (.ttf), OpenType (.otf) or
+// collection (.ttc) file. Plain TrueType fonts are handled by freetype;
+// others, including CFF outlines, by the x/image sfnt package.
+type Face struct {
+	tt *truetype.Font
+	sf *sfnt.Font
+	id string
+}
+
+var magicTrueType = []byte{0, 1, 0, 0}
+
+// ParseFace parses the index-th font of a font file. Index must be 0 for
+// files which are not collections.
+func ParseFace(data []byte, index int) (*Face, error) {
+	id := fmt.Sprintf("%x:%d", sha256.Sum256(data), index)
+	if bytes.HasPrefix(data, magicTrueType) && index == 0 {
+		f, err := freetype.ParseFont(data)
+		if err != nil {
+			return nil, err
+		}
+		return &Face{tt: f, id: id}, nil
+	}
+	c, err := sfnt.ParseCollection(data)
+	if err != nil {
+		return nil, err
+	}
+	if index < 0 || index >= c.NumFonts() {
+		return nil, fmt.Errorf("font index %d out of range, file has %d font(s)", index, c.NumFonts())
+	}
+	f, err := c.Font(index)
+	if err != nil {
+		return nil, err
+	}
+	return &Face{sf: f, id: id}, nil
+}
+
+// ID identifies the font data of the face: faces parsed from the same data
+// have the same ID, wherever the file came from.
+func (f *Face) ID() string { return f.id }
+
+// TrueType returns the font for drawing with freetype, or nil if the face
+// must be drawn through NewFace instead.
+func (f *Face) TrueType() *truetype.Font { return f.tt }
+
+// HasGlyph checks if the face has an outline for r.
+func (f *Face) HasGlyph(r rune) bool {
+	return cachedHasGlyph(glyphKey{f, 0, r}, func() bool { return f.hasGlyph(r) })
+}
+
+func (f *Face) hasGlyph(r rune) bool {
+	if f.tt != nil {
+		return f.tt.Index(r) != 0
+	}
+	buf := &sfnt.Buffer{}
+	i, err := f.sf.GlyphIndex(buf, r)
+	if err != nil || i == 0 {
+		return false
+	}
+	// color emoji fonts have bitmaps only, which we can't draw
+	_, err = f.sf.LoadGlyph(buf, i, fixed.I(12), nil)
+	return err == nil
+}
+
+// NewFace returns a font.Face for drawing and measuring text.
+func (f *Face) NewFace(size, dpi float64) font.Face {
+	if f.tt != nil {
+		return truetype.NewFace(f.tt, &truetype.Options{
+			Size: size,
+			DPI:  dpi,
+			// TODO(akavel): Hinting: font.HintingFull, // ?
+		})
+	}
+	face, err := opentype.NewFace(f.sf, &opentype.FaceOptions{Size: size, DPI: dpi})
+	if err != nil {
+		// only fails for invalid options
+		panic(err)
+	}
+	return face
+}
+
+// bounds returns the union of all glyph bounds, with Y growing upwards.
+func (f *Face) bounds(scale fixed.Int26_6) fixed.Rectangle26_6 {
+	if f.tt != nil {
+		return f.tt.Bounds(scale)
+	}
+	b, err := f.sf.Bounds(&sfnt.Buffer{}, scale, font.HintingNone)
+	if err != nil {
+		return fixed.Rectangle26_6{}
+	}
+	return fixed.Rectangle26_6{
+		Min: fixed.Point26_6{X: b.Min.X, Y: -b.Max.Y},
+		Max: fixed.Point26_6{X: b.Max.X, Y: -b.Min.Y},
+	}
+}
+
+// glyphHeight measures the outline of r.
+func (f *Face) glyphHeight(scale fixed.Int26_6, r rune) fixed.Int26_6 {
+	if f.tt != nil {
+		glyph := truetype.GlyphBuf{}
+		// TODO(akavel): font.HintingFull ?
+		glyph.Load(f.tt, scale, f.tt.Index(r), font.HintingNone)
+		return glyph.Bounds.Max.Y - glyph.Bounds.Min.Y
+	}
+	buf := &sfnt.Buffer{}
+	i, err := f.sf.GlyphIndex(buf, r)
+	if err != nil {
+		return 0
+	}
+	b, _, err := f.sf.GlyphBounds(buf, i, scale, font.HintingNone)
+	if err != nil {
+		return 0
+	}
+	return b.Max.Y - b.Min.Y
+}
+
+// FamilyName returns the name of the font family, like "DejaVu Sans".
+func (f *Face) FamilyName() string {
+	if f.tt != nil {
+		return f.tt.Name(truetype.NameIDFontFamily)
+	}
+	name, _ := f.sf.Name(&sfnt.Buffer{}, sfnt.NameIDFamily)
+	return name
+}
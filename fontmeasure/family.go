@@ -0,0 +1,179 @@
+package fontmeasure
+
+import (
+	"strings"
+	"sync"
+)
+
+// Style is a set of text style flags.
+type Style int
+
+const (
+	STYLE_BOLD Style = 1 << iota
+	STYLE_ITALIC
+	STYLE_MONO
+
+	STYLE_REGULAR Style = 0
+)
+
+// Family groups the faces used for drawing styled text. Only Regular is
+// required; missing faces are synthesized from the closest available one.
+type Family struct {
+	Regular    *Face
+	Bold       *Face
+	Italic     *Face
+	BoldItalic *Face
+	Mono       *Face
+
+	// Fallbacks are searched in order for glyphs missing from a face.
+	Fallbacks []*Face
+	// SystemFallbacks enables searching the installed fonts for glyphs
+	// missing from all of Fallbacks.
+	SystemFallbacks bool
+
+	mu       sync.Mutex
+	fallback map[rune]*Face
+}
+
+// ID identifies the faces of the family and its fallbacks, in order of use.
+// Families with the same ID draw text the same, except for glyphs found in
+// installed fonts, which can't be told by the ID.
+func (f *Family) ID() string {
+	ids := []string{}
+	for _, face := range []*Face{f.Regular, f.Bold, f.Italic, f.BoldItalic, f.Mono} {
+		if face == nil {
+			ids = append(ids, "-")
+		} else {
+			ids = append(ids, face.ID())
+		}
+	}
+	for _, face := range f.Fallbacks {
+		ids = append(ids, face.ID())
+	}
+	if f.SystemFallbacks {
+		ids = append(ids, "system")
+	}
+	return strings.Join(ids, " ")
+}
+
+// FallbackFor finds a face which has a glyph for r, or returns nil.
+func (f *Family) FallbackFor(r rune) *Face {
+	if f == nil {
+		return nil
+	}
+	for _, face := range f.Fallbacks {
+		if face.HasGlyph(r) {
+			return face
+		}
+	}
+	if !f.SystemFallbacks {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if face, ok := f.fallback[r]; ok {
+		return face
+	}
+	if f.fallback == nil {
+		f.fallback = map[rune]*Face{}
+	}
+	face := findSystemGlyph(r)
+	f.fallback[r] = face
+	return face
+}
+
+// Face returns the face best matching the style s, together with the
+// styles which the face lacks and must be synthesized when drawing.
+func (f *Family) Face(s Style) (face *Face, synth Style) {
+	if s&STYLE_MONO != 0 {
+		if f.Mono != nil {
+			return f.Mono, s &^ STYLE_MONO
+		}
+		synth |= STYLE_MONO
+	}
+	switch s &^ STYLE_MONO {
+	case STYLE_BOLD | STYLE_ITALIC:
+		switch {
+		case f.BoldItalic != nil:
+			return f.BoldItalic, synth
+		case f.Bold != nil:
+			return f.Bold, synth | STYLE_ITALIC
+		case f.Italic != nil:
+			return f.Italic, synth | STYLE_BOLD
+		}
+	case STYLE_BOLD:
+		if f.Bold != nil {
+			return f.Bold, synth
+		}
+	case STYLE_ITALIC:
+		if f.Italic != nil {
+			return f.Italic, synth
+		}
+	}
+	return f.Regular, synth | s&^STYLE_MONO
+}
+
+// Styled returns the font to use for text in style s, and the styles which
+// must be synthesized. Fonts without a Family only have the regular face.
+func (f Font) Styled(s Style) (Font, Style) {
+	family := f.Family
+	if family == nil {
+		family = &Family{Regular: f.Font}
+	}
+	face, synth := family.Face(s)
+	f.Font = face
+	return f, synth
+}
+
+// Segment is a piece of text drawn with a single face.
+type Segment struct {
+	Font Font
+	Text string
+}
+
+// Segments splits s into pieces drawn with the same face: the font's own
+// face where it has the glyphs, and fallbacks of the family elsewhere.
+// Glyphs missing from all faces are left to the font's own face.
+func (f Font) Segments(s string) []Segment {
+	segs := []Segment{}
+	start := 0
+	var cur *Face
+	for i, r := range s {
+		face := f.Font
+		if !f.Font.HasGlyph(r) {
+			if fb := f.Family.FallbackFor(r); fb != nil {
+				face = fb
+			}
+		}
+		if face != cur && i > start {
+			seg := Segment{f, s[start:i]}
+			seg.Font.Font = cur
+			segs = append(segs, seg)
+			start = i
+		}
+		cur = face
+	}
+	if start < len(s) {
+		seg := Segment{f, s[start:]}
+		seg.Font.Font = cur
+		segs = append(segs, seg)
+	}
+	return segs
+}
+
+// MonoPitch is the width of a single character of synthesized monospace
+// text.
+func (f Font) MonoPitch() int { return f.WidthFor("0") }
+
+// StyledWidthFor measures text s drawn in style style.
+func (f Font) StyledWidthFor(s string, style Style) int {
+	face, synth := f.Styled(style)
+	w := face.WidthFor(s)
+	if synth&STYLE_MONO != 0 {
+		w = face.MonoPitch() * len([]rune(s))
+	}
+	if synth&STYLE_BOLD != 0 && s != "" {
+		w++ // drawn twice, shifted by a pixel
+	}
+	return w
+}
@@ -0,0 +1,146 @@
+package fontmeasure
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+)
+
+// withFontDirs makes the installed fonts be the given files, for the
+// duration of the test.
+func withFontDirs(t *testing.T, files map[string][]byte) {
+	dir, err := ioutil.TempDir("", "fontmeasure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, name), data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldDirs := FontDirs
+	FontDirs = []string{dir}
+	systemFontsOnce, systemFontList = sync.Once{}, nil
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+		FontDirs = oldDirs
+		systemFontsOnce, systemFontList = sync.Once{}, nil
+	})
+}
+
+func TestFindFamily(t *testing.T) {
+	withFontDirs(t, map[string][]byte{
+		"Go-Regular.ttf": goregular.TTF,
+		"Go-Bold.ttf":    gobold.TTF,
+		"broken.ttf":     []byte("not a font"),
+		"notes.txt":      []byte("not a font either"),
+	})
+	tests := []struct {
+		name       string
+		found      bool
+		regular    string
+		bold       bool
+		italicless bool
+	}{
+		{"Go", true, "Go", true, true},
+		{"go", true, "Go", true, true},
+		{"Go Mono", false, "", false, false},
+		{"Quattrocento Sans", false, "", false, false},
+	}
+	for _, tt := range tests {
+		family, err := FindFamily(tt.name)
+		if !tt.found {
+			if err == nil {
+				t.Errorf("%q: found a family, expected none", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %s", tt.name, err)
+		}
+		if family.Regular.FamilyName() != tt.regular || (family.Bold != nil) != tt.bold || family.Italic != nil {
+			t.Errorf("%q: got regular %q, bold %v, italic %v", tt.name, family.Regular.FamilyName(), family.Bold != nil, family.Italic != nil)
+		}
+		if face, synth := family.Face(STYLE_BOLD | STYLE_ITALIC); face != family.Bold || synth != STYLE_ITALIC {
+			t.Errorf("%q: bold italic text drawn with %v, synthesizing %v", tt.name, face.FamilyName(), synth)
+		}
+	}
+}
+
+func TestFallbackChain(t *testing.T) {
+	goFace, err := ParseFace(goregular.TTF, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withFontDirs(t, map[string][]byte{"Go-Regular.ttf": goregular.TTF})
+
+	plain := Font{Font: testFace, DPI: 72, Size: 12}
+	chained := plain
+	chained.Family = &Family{Regular: testFace, Fallbacks: []*Face{goFace}}
+	system := plain
+	system.Family = &Family{Regular: testFace, SystemFallbacks: true}
+
+	// Ж is missing from the embedded font, 中 from both
+	s := "AЖB中"
+	for _, tt := range []struct {
+		font     Font
+		expected []string
+	}{
+		{plain, []string{"Quattrocento Sans:AЖB中"}},
+		{chained, []string{"Quattrocento Sans:A", "Go:Ж", "Quattrocento Sans:B中"}},
+		{system, []string{"Quattrocento Sans:A", "Go:Ж", "Quattrocento Sans:B中"}},
+	} {
+		got := []string{}
+		width := 0
+		for _, seg := range tt.font.Segments(s) {
+			got = append(got, seg.Font.Font.FamilyName()+":"+seg.Text)
+			width += seg.Font.faceWidthFor(seg.Text)
+		}
+		if len(got) != len(tt.expected) {
+			t.Errorf("got segments %q, expected %q", got, tt.expected)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.expected[i] {
+				t.Errorf("got segments %q, expected %q", got, tt.expected)
+				break
+			}
+		}
+		if w := tt.font.WidthFor(s); w != width {
+			t.Errorf("%q: WidthFor = %d, sum of segments %d", got, w, width)
+		}
+	}
+	goWidth := Font{Font: goFace, DPI: 72, Size: 12}.WidthFor("Ж")
+	if chained.WidthFor(s) != plain.WidthFor("A")+goWidth+plain.WidthFor("B中") {
+		t.Errorf("width of %q is not measured with the fallback", s)
+	}
+}
+
+func TestFamilyID(t *testing.T) {
+	go1, _ := ParseFace(goregular.TTF, 0)
+	go2, _ := ParseFace(goregular.TTF, 0)
+	bold, _ := ParseFace(gobold.TTF, 0)
+	families := []*Family{
+		{Regular: testFace},
+		{Regular: go1},
+		{Regular: go1, Bold: bold},
+		{Regular: go1, Fallbacks: []*Face{testFace}},
+		{Regular: go1, SystemFallbacks: true},
+	}
+	seen := map[string]int{}
+	for i, f := range families {
+		if j, ok := seen[f.ID()]; ok {
+			t.Errorf("families %d and %d have the same ID %q", j, i, f.ID())
+		}
+		seen[f.ID()] = i
+	}
+	if (&Family{Regular: go2}).ID() != families[1].ID() {
+		t.Errorf("faces parsed from the same data have different IDs")
+	}
+}
@@ -1,8 +1,10 @@
 package fontmeasure
 
 import (
+	"math"
+	"sort"
+
 	"github.com/golang/freetype"
-	"github.com/golang/freetype/truetype"
 	"golang.org/x/image/font"
 	"golang.org/x/image/math/fixed"
 )
@@ -12,9 +14,11 @@ import (
 //go:generate go run tools/embd.go -o embd/font.ttf.go -p embd orig-java/src/org/stathissideris/ascii2image/graphics/font.ttf
 
 type Font struct {
-	Font *truetype.Font
+	Font *Face
 	DPI  float64
 	Size float64
+	// Family, if not nil, provides faces for styled text.
+	Family *Family
 }
 
 func (f Font) scale() fixed.Int26_6 {
@@ -31,104 +35,170 @@ func (f Font) scale() fixed.Int26_6 {
 }
 
 func (f Font) Baseline() int {
-	return int(f.Font.Bounds(f.scale()).Max.Y >> 6)
+	return int(f.Font.bounds(f.scale()).Max.Y >> 6)
 	// or use f.Font.VMetric() for some glyph?
 }
 
 func (f Font) Advance() int {
-	b := f.Font.Bounds(f.scale())
+	b := f.Font.bounds(f.scale())
 	return int((b.Max.Y - b.Min.Y) >> 6) // or -1 in inner parens?
 	// or use f.Font.VMetric() for some glyph?
 }
 
 func (f Font) Ascent() int {
 	// ok or not?
-	b := f.Font.Bounds(f.scale())
+	b := f.Font.bounds(f.scale())
 	return int(b.Max.Y >> 6)
 }
 
+// WidthFor measures s, with glyphs missing from the font taken from the
+// fallbacks of its Family.
 func (f Font) WidthFor(s string) int {
-	face := truetype.NewFace(f.Font, &truetype.Options{
-		Size: f.Size,
-		DPI:  f.DPI,
-		// TODO(akavel): Hinting: font.HintingFull, // ?
+	return cachedWidth(widthKey{f.Font, f.Family, f.Size, f.DPI, s}, func() int {
+		w := 0
+		for _, seg := range f.Segments(s) {
+			w += seg.Font.faceWidthFor(seg.Text)
+		}
+		return w
 	})
-	drawer := font.Drawer{Face: face}
+}
+
+func (f Font) faceWidthFor(s string) int {
+	drawer := font.Drawer{Face: f.Font.NewFace(f.Size, f.DPI)}
 	advance := drawer.MeasureString(s)
 	return int(advance >> 6)
 }
 
 func (f Font) ZHeight() int {
-	z := f.Font.Index('Z')
-	glyph := truetype.GlyphBuf{}
-	// TODO(akavel): font.HintingFull ?
-	glyph.Load(f.Font, f.scale(), z, font.HintingNone)
 	// TODO(akavel): or, use MeasureString("Z")?
-	return int((glyph.Bounds.Max.Y - glyph.Bounds.Min.Y) >> 6)
+	scale := f.scale()
+	h := cachedHeight(glyphKey{f.Font, scale, 'Z'}, func() fixed.Int26_6 {
+		return f.Font.glyphHeight(scale, 'Z')
+	})
+	return int(h >> 6)
 }
 
-func prepFont(font *truetype.Font) Font {
+func prepFont(font *Face) Font {
 	// Note: that's the default value used in the truetype package
 	const dpi = 72
-	return Font{font, dpi, 12.0}
+	return Font{font, dpi, 12.0, nil}
 }
 
-func GetFontForHeight(font *truetype.Font, h int) *Font {
-	measure := prepFont(font)
-	// TODO(akavel): original code used 'ascent' (reporting that it's distance between the baseline and the tallest character); are we implementing it ok?
-	fontH := measure.Ascent()
-	direction := 1.0
-	if fontH > h {
-		direction = -1.0
+// maxSearchSize limits the search for growing font sizes.
+const maxSearchSize = 4096
+
+// searchSize finds the first size in the sequence start, start+step,
+// start+2*step, ... (but only while sizes are positive and not above
+// maxSearchSize) for which pred holds. pred must be monotonic along the
+// sequence. The search starts from guess, galloping away from it until the
+// answer is bracketed, then bisects.
+func searchSize(start, step, guess float64, pred func(size float64) bool) (float64, bool) {
+	at := func(k int) float64 { return start + float64(k)*step }
+	valid := func(k int) bool { return k >= 0 && at(k) > 0 && at(k) <= maxSearchSize }
+	k := 0
+	if kf := math.Floor((guess-start)/step + 0.5); kf > 0 && kf < 2*maxSearchSize/math.Abs(step) {
+		k = int(kf)
+	}
+	for k > 0 && !valid(k) {
+		k /= 2
 	}
-	measure.Size += direction
-	for measure.Size > 0 {
-		fontH = measure.Ascent()
-		if direction > 0 {
-			if fontH > h {
-				measure.Size -= 0.5
-				return &measure
+	if !valid(k) {
+		return 0, false
+	}
+
+	// find lo < hi, such that pred fails at lo (or lo is -1) and holds at hi
+	lo, hi := k-1, k
+	if pred(at(k)) {
+		for d := 1; lo >= 0 && pred(at(lo)); d *= 2 {
+			hi = lo
+			lo -= d
+		}
+		if lo < -1 {
+			lo = -1
+		}
+	} else {
+		lo = k
+		for d := 1; ; d *= 2 {
+			hi = lo + d
+			for hi > lo && !valid(hi) {
+				hi--
+			}
+			if hi == lo {
+				return 0, false
 			}
-		} else {
-			if fontH < h {
-				return &measure
+			if pred(at(hi)) {
+				break
 			}
+			lo = hi
 		}
-		measure.Size += 0.5 * direction
 	}
-	return nil // TODO(akavel): does it make sense? maybe panic?
+	i := sort.Search(hi-lo-1, func(i int) bool { return pred(at(lo + 1 + i)) })
+	return at(lo + 1 + i), true
+}
+
+func GetFontForHeight(font *Face, h int) *Font {
+	measure := prepFont(font)
+	// TODO(akavel): original code used 'ascent' (reporting that it's distance between the baseline and the tallest character); are we implementing it ok?
+	ascentAt := func(size float64) int {
+		m := measure
+		m.Size = size
+		return m.Ascent()
+	}
+	// ascent grows linearly with size, so start near the expected answer
+	h0 := ascentAt(measure.Size)
+	guess := measure.Size * float64(h) / float64(h0)
+	if h0 > h {
+		size, ok := searchSize(measure.Size-1, -0.5, guess, func(size float64) bool { return ascentAt(size) < h })
+		if !ok {
+			return nil // TODO(akavel): does it make sense? maybe panic?
+		}
+		measure.Size = size
+		return &measure
+	}
+	size, ok := searchSize(measure.Size+1, 0.5, guess+0.5, func(size float64) bool { return ascentAt(size) > h })
+	if !ok {
+		return nil
+	}
+	measure.Size = size - 0.5
+	return &measure
 }
 
 func prepCtx(font *Font) *freetype.Context {
 	ctx := freetype.NewContext()
 	ctx.SetDPI(font.DPI)
-	ctx.SetFont(font.Font)
+	ctx.SetFont(font.Font.TrueType())
 	ctx.SetFontSize(font.Size)
 	return ctx
 }
 
-func GetFontForWidth(font *truetype.Font, w int, s string) *Font {
-	// fmt.Println("MCDBG GetFontForWidth w=", w, "s=", s)
-	measure := prepFont(font)
-	fontW := measure.WidthFor(s)
-	direction := 1.0
-	if fontW > w {
-		direction = -1.0
+func GetFontForWidth(font *Face, w int, s string) *Font {
+	return GetFontForWidthMeasured(font, w, func(f Font) int { return f.WidthFor(s) })
+}
+
+// GetFontForWidthMeasured finds the largest font size for which measure
+// reports a width not exceeding w.
+func GetFontForWidthMeasured(font *Face, w int, measure func(Font) int) *Font {
+	m := prepFont(font)
+	widthAt := func(size float64) int {
+		sized := m
+		sized.Size = size
+		return measure(sized)
 	}
-	measure.Size += direction
-	for measure.Size > 0 {
-		fontW = measure.WidthFor(s)
-		if direction > 0 {
-			if fontW > w {
-				measure.Size -= 1
-				return &measure
-			}
-		} else {
-			if fontW < w {
-				return &measure
-			}
+	// width grows about linearly with size, so start near the expected answer
+	w0 := widthAt(m.Size)
+	guess := m.Size * float64(w) / float64(w0)
+	if w0 > w {
+		size, ok := searchSize(m.Size-1, -1, guess, func(size float64) bool { return widthAt(size) < w })
+		if !ok {
+			return nil
 		}
-		measure.Size += direction
+		m.Size = size
+		return &m
+	}
+	size, ok := searchSize(m.Size+1, 1, guess+1, func(size float64) bool { return widthAt(size) > w })
+	if !ok {
+		return nil
 	}
-	return nil
+	m.Size = size - 1
+	return &m
 }
@@ -0,0 +1,167 @@
+package fontmeasure
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/akavel/ditaa/embd"
+)
+
+var testFace = func() *Face {
+	f, err := ParseFace(embd.File_font_ttf, 0)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}()
+
+var nonText = regexp.MustCompile(`[^\pL\pN ]+|  +`)
+
+// corpus returns strings of text found in the diagrams in testdata.
+func corpus(tb testing.TB) []string {
+	paths, err := filepath.Glob("../testdata/*.txt")
+	if err != nil || len(paths) == 0 {
+		tb.Fatalf("no testdata found: %v", err)
+	}
+	result := []string{}
+	seen := map[string]bool{}
+	for _, path := range paths {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		for _, s := range nonText.Split(string(buf), -1) {
+			if s = strings.TrimSpace(s); s != "" && !seen[s] {
+				seen[s] = true
+				result = append(result, s)
+			}
+		}
+	}
+	return result
+}
+
+// linearFontForWidth is the original linear search, kept as reference.
+func linearFontForWidth(font *Face, w int, s string) *Font {
+	measure := prepFont(font)
+	fontW := measure.WidthFor(s)
+	direction := 1.0
+	if fontW > w {
+		direction = -1.0
+	}
+	measure.Size += direction
+	for measure.Size > 0 {
+		fontW = measure.WidthFor(s)
+		if direction > 0 {
+			if fontW > w {
+				measure.Size -= 1
+				return &measure
+			}
+		} else {
+			if fontW < w {
+				return &measure
+			}
+		}
+		measure.Size += direction
+	}
+	return nil
+}
+
+// linearFontForHeight is the original linear search, kept as reference.
+func linearFontForHeight(font *Face, h int) *Font {
+	measure := prepFont(font)
+	fontH := measure.Ascent()
+	direction := 1.0
+	if fontH > h {
+		direction = -1.0
+	}
+	measure.Size += direction
+	for measure.Size > 0 {
+		fontH = measure.Ascent()
+		if direction > 0 {
+			if fontH > h {
+				measure.Size -= 0.5
+				return &measure
+			}
+		} else {
+			if fontH < h {
+				return &measure
+			}
+		}
+		measure.Size += 0.5 * direction
+	}
+	return nil
+}
+
+func sizeOf(f *Font) float64 {
+	if f == nil {
+		return -1
+	}
+	return f.Size
+}
+
+func TestGetFontForWidthMatchesLinear(t *testing.T) {
+	for _, s := range corpus(t) {
+		w0 := prepFont(testFace).WidthFor(s)
+		for _, w := range []int{10*len(s) - 5, w0 / 3, w0 - 1, w0, w0 + 1, w0 * 2} {
+			got := sizeOf(GetFontForWidth(testFace, w, s))
+			want := sizeOf(linearFontForWidth(testFace, w, s))
+			if got != want {
+				t.Errorf("GetFontForWidth(%d, %q) = %v, want %v", w, s, got, want)
+			}
+		}
+	}
+}
+
+func TestGetFontForHeightMatchesLinear(t *testing.T) {
+	for h := 1; h <= 100; h++ {
+		got := sizeOf(GetFontForHeight(testFace, h))
+		want := sizeOf(linearFontForHeight(testFace, h))
+		if got != want {
+			t.Errorf("GetFontForHeight(%d) = %v, want %v", h, got, want)
+		}
+	}
+}
+
+// fitCorpus sizes every string of the corpus to fit in a width, like
+// NewDiagram does for text which doesn't fit its cells.
+func fitCorpus(b *testing.B, fit func(*Face, int, string) *Font) {
+	strs := corpus(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, s := range strs {
+			fit(testFace, 10*len(s)-5, s)
+		}
+	}
+}
+
+func BenchmarkGetFontForWidth(b *testing.B) {
+	b.Run("linear/nocache", func(b *testing.B) {
+		noCache = true
+		defer func() { noCache = false }()
+		fitCorpus(b, linearFontForWidth)
+	})
+	b.Run("binary/nocache", func(b *testing.B) {
+		noCache = true
+		defer func() { noCache = false }()
+		fitCorpus(b, GetFontForWidth)
+	})
+	b.Run("binary/cache", func(b *testing.B) {
+		fitCorpus(b, GetFontForWidth)
+	})
+}
+
+func BenchmarkGetFontForHeight(b *testing.B) {
+	b.Run("linear", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			linearFontForHeight(testFace, 14)
+		}
+	})
+	b.Run("binary", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			GetFontForHeight(testFace, 14)
+		}
+	})
+}
@@ -0,0 +1,213 @@
+package fontmeasure
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+)
+
+// FontDirs are searched for installed fonts, in order. A leading "~" stands
+// for the home directory of the user.
+var FontDirs = []string{
+	"~/.local/share/fonts",
+	"~/.fonts",
+	"/usr/local/share/fonts",
+	"/usr/share/fonts",
+}
+
+var fontExts = map[string]bool{".ttf": true, ".otf": true, ".ttc": true, ".otc": true}
+
+// systemFont is an installed font, read from its file only when needed.
+type systemFont struct {
+	path      string
+	index     int
+	family    string
+	subfamily string
+	sf        *sfnt.Font
+}
+
+var (
+	systemFontsOnce sync.Once
+	systemFontList  []*systemFont
+
+	loadedMu    sync.Mutex
+	loadedFaces = map[string]*Face{}
+)
+
+// systemFonts lists the installed fonts, those with a regular style first.
+func systemFonts() []*systemFont {
+	systemFontsOnce.Do(func() {
+		for _, dir := range FontDirs {
+			systemFontList = append(systemFontList, scanFontDir(expandHome(dir))...)
+		}
+		sort.SliceStable(systemFontList, func(i, j int) bool {
+			return styleOf(systemFontList[i].subfamily) == STYLE_REGULAR &&
+				styleOf(systemFontList[j].subfamily) != STYLE_REGULAR
+		})
+	})
+	return systemFontList
+}
+
+func expandHome(dir string) string {
+	if !strings.HasPrefix(dir, "~/") {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, dir[2:])
+}
+
+func scanFontDir(dir string) []*systemFont {
+	fonts := []*systemFont{}
+	if dir == "" {
+		return fonts
+	}
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !fontExts[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+		c, err := sfnt.ParseCollectionReaderAt(fileReaderAt(path))
+		if err != nil {
+			return nil
+		}
+		for i := 0; i < c.NumFonts(); i++ {
+			f, err := c.Font(i)
+			if err != nil {
+				continue
+			}
+			family, _ := f.Name(nil, sfnt.NameIDFamily)
+			subfamily, _ := f.Name(nil, sfnt.NameIDSubfamily)
+			fonts = append(fonts, &systemFont{path, i, family, subfamily, f})
+		}
+		return nil
+	})
+	return fonts
+}
+
+// fileReaderAt reads a file without keeping it open, so that all installed
+// fonts can be indexed at once.
+type fileReaderAt string
+
+func (p fileReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	f, err := os.Open(string(p))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return f.ReadAt(b, off)
+}
+
+// styleOf guesses the style of a font from its subfamily name, like "Bold
+// Italic". It returns -1 for styles which are neither regular, bold nor
+// italic, like "Light".
+func styleOf(subfamily string) Style {
+	s := STYLE_REGULAR
+	for _, word := range strings.Fields(strings.ToLower(subfamily)) {
+		switch word {
+		case "bold":
+			s |= STYLE_BOLD
+		case "italic", "oblique":
+			s |= STYLE_ITALIC
+		case "regular", "book", "normal", "roman":
+		default:
+			return -1
+		}
+	}
+	return s
+}
+
+// LoadFaceFile parses the index-th font of a font file.
+func LoadFaceFile(path string, index int) (*Face, error) {
+	key := fmt.Sprintf("%s:%d", path, index)
+	loadedMu.Lock()
+	defer loadedMu.Unlock()
+	if face, ok := loadedFaces[key]; ok {
+		return face, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	face, err := ParseFace(data, index)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	loadedFaces[key] = face
+	return face, nil
+}
+
+// FindFamily looks up an installed font family by name, ignoring case. The
+// regular, bold, italic and bold italic faces are used if found.
+func FindFamily(name string) (*Family, error) {
+	family := &Family{}
+	var first *systemFont
+	for _, sf := range systemFonts() {
+		if !strings.EqualFold(sf.family, name) {
+			continue
+		}
+		if first == nil {
+			first = sf
+		}
+		var dst **Face
+		switch styleOf(sf.subfamily) {
+		case STYLE_REGULAR:
+			dst = &family.Regular
+		case STYLE_BOLD:
+			dst = &family.Bold
+		case STYLE_ITALIC:
+			dst = &family.Italic
+		case STYLE_BOLD | STYLE_ITALIC:
+			dst = &family.BoldItalic
+		default:
+			continue
+		}
+		if *dst != nil {
+			continue
+		}
+		face, err := LoadFaceFile(sf.path, sf.index)
+		if err != nil {
+			return nil, err
+		}
+		*dst = face
+	}
+	if first == nil {
+		return nil, fmt.Errorf("font %q not found in %s", name, strings.Join(FontDirs, ", "))
+	}
+	if family.Regular == nil {
+		face, err := LoadFaceFile(first.path, first.index)
+		if err != nil {
+			return nil, err
+		}
+		family.Regular = face
+	}
+	return family, nil
+}
+
+// findSystemGlyph finds an installed font which has a glyph for r.
+func findSystemGlyph(r rune) *Face {
+	buf := &sfnt.Buffer{}
+	for _, sf := range systemFonts() {
+		i, err := sf.sf.GlyphIndex(buf, r)
+		if err != nil || i == 0 {
+			continue
+		}
+		if _, err := sf.sf.LoadGlyph(buf, i, fixed.I(12), nil); err != nil {
+			continue
+		}
+		face, err := LoadFaceFile(sf.path, sf.index)
+		if err != nil {
+			continue
+		}
+		return face
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/akavel/ditaa/fontmeasure"
+)
+
+// stringList is a flag which may be given many times.
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, ",") }
+func (l *stringList) Set(s string) error { *l = append(*l, s); return nil }
+
+// loadFonts builds the family of fonts from the --font, --fallback-font and
+// --system-fonts options. It returns nil, for only the embedded font, if
+// none of them was given.
+func loadFonts(name string, fallbacks []string, system bool) (*fontmeasure.Family, error) {
+	if name == "" && len(fallbacks) == 0 && !system {
+		return nil, nil
+	}
+	family := &fontmeasure.Family{Regular: baseFont}
+	if name != "" {
+		var err error
+		family, err = loadFont(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, fb := range fallbacks {
+		f, err := loadFont(fb)
+		if err != nil {
+			return nil, err
+		}
+		family.Fallbacks = append(family.Fallbacks, f.Regular)
+	}
+	family.SystemFallbacks = system
+	return family, nil
+}
+
+// loadFont reads a font from file, or finds an installed font family with
+// the given name. A file name may be followed by ":N" to use the N-th font
+// of a collection, counting from 0.
+func loadFont(name string) (*fontmeasure.Family, error) {
+	path, index := name, 0
+	if i := strings.LastIndexByte(name, ':'); i >= 0 && !isFile(name) {
+		n, err := strconv.Atoi(name[i+1:])
+		if err == nil && isFile(name[:i]) {
+			path, index = name[:i], n
+		}
+	}
+	if isFile(path) {
+		face, err := fontmeasure.LoadFaceFile(path, index)
+		if err != nil {
+			return nil, err
+		}
+		return &fontmeasure.Family{Regular: face}, nil
+	}
+	return fontmeasure.FindFamily(name)
+}
+
+func isFile(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
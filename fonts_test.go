@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+)
+
+// makeCollection joins TrueType fonts into a .ttc file.
+func makeCollection(fonts ...[]byte) []byte {
+	header := 12 + 4*len(fonts)
+	buf := make([]byte, header)
+	copy(buf, "ttcf")
+	binary.BigEndian.PutUint32(buf[4:], 0x00010000)
+	binary.BigEndian.PutUint32(buf[8:], uint32(len(fonts)))
+	for i, f := range fonts {
+		for len(buf)%4 != 0 {
+			buf = append(buf, 0)
+		}
+		base := len(buf)
+		binary.BigEndian.PutUint32(buf[12+4*i:], uint32(base))
+		buf = append(buf, f...)
+		// table offsets in a collection count from the start of the file
+		tables := int(binary.BigEndian.Uint16(f[4:]))
+		for t := 0; t < tables; t++ {
+			off := buf[base+12+16*t+8:]
+			binary.BigEndian.PutUint32(off, binary.BigEndian.Uint32(off)+uint32(base))
+		}
+	}
+	return buf
+}
+
+func TestLoadFonts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ditaa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ttc := filepath.Join(dir, "go.ttc")
+	err = ioutil.WriteFile(ttc, makeCollection(goregular.TTF, gobold.TTF), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	family, err := loadFonts("", nil, false)
+	if err != nil || family != nil {
+		t.Errorf("no fonts given: got %v, %v, expected only the embedded font", family, err)
+	}
+	family, err = loadFonts("", nil, true)
+	if err != nil || family == nil || family.Regular != baseFont || !family.SystemFallbacks {
+		t.Errorf("-system-fonts: got %+v, %v, expected the embedded font searching installed fonts", family, err)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		index string
+	}{
+		{ttc, ":0"},
+		{ttc + ":0", ":0"},
+		{ttc + ":1", ":1"},
+		{ttc + ":2", ""},
+	} {
+		family, err := loadFonts(tt.name, nil, false)
+		switch {
+		case tt.index == "" && err == nil:
+			t.Errorf("%s: loaded, expected an error", tt.name)
+		case tt.index == "":
+		case err != nil:
+			t.Errorf("%s: %s", tt.name, err)
+		case !strings.HasSuffix(family.Regular.ID(), tt.index) || family.Regular.FamilyName() != "Go":
+			t.Errorf("%s: got font %s of %q, expected font %s of \"Go\"", tt.name, family.Regular.ID(), family.Regular.FamilyName(), tt.index)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"io/ioutil"
+	"testing"
+
+	"github.com/akavel/ditaa/graphical"
+)
+
+// Limits keeping each fuzzing run fast.
+const (
+	maxFuzzInput  = 2048
+	maxFuzzPixels = 1 << 22
+)
+
+// addCorpus seeds the fuzzer with the testdata diagrams. Inputs which once
+// crashed the targets are kept in testdata/fuzz, and run as seeds too.
+func addCorpus(f *testing.F) {
+	for _, path := range corpusFiles(f) {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf)
+	}
+}
+
+// FuzzLoadFrom checks that reading any text into a TextGrid doesn't panic.
+func FuzzLoadFrom(f *testing.F) {
+	addCorpus(f)
+	f.Fuzz(func(t *testing.T, src []byte) {
+		grid := NewTextGrid(0, 0)
+		grid.LoadFrom(bytes.NewReader(src), ProcessingOptions{}, &Diagnostics{})
+	})
+}
+
+// FuzzRender checks that any diagram, however malformed, is either rendered
+// or reported as an error, without panicking.
+func FuzzRender(f *testing.F) {
+	addCorpus(f)
+	f.Fuzz(func(t *testing.T, src []byte) {
+		if len(src) > maxFuzzInput {
+			t.Skip()
+		}
+		opt := DefaultConversionOptions()
+		diags := &Diagnostics{}
+		grid := NewTextGrid(0, 0)
+		directives, err := grid.LoadFrom(bytes.NewReader(src), opt.Processing, diags)
+		if err != nil {
+			return
+		}
+		directives.Apply(&opt, diags)
+		d := NewDiagram(grid, opt, diags)
+		if d.G.Grid.W*d.G.Grid.H > maxFuzzPixels {
+			t.Skip()
+		}
+		img := image.NewRGBA(image.Rect(0, 0, d.G.Grid.W, d.G.Grid.H))
+		graphical.RenderDiagram(graphical.NewRasterCanvas(img), &d.G, opt.Rendering, opt.fonts())
+	})
+}
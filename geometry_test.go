@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/akavel/ditaa/graphical"
+)
+
+// The expected geometry of each testdata/*.txt file is kept in its .txt.xml
+// file. After an intended change to the shapes or labels, rewrite them with:
+//
+//	go test -run TestDiagramGeometry -update-geometry
+var (
+	updateGeometry = flag.Bool("update-geometry", false, "rewrite the geometry files in testdata")
+	labelTolerance = flag.Int("label-tolerance", 2, "maximum distance in pixels, along each axis, between positions of labels considered equal")
+)
+
+func loadDiagram(tb testing.TB, path string) *Diagram {
+	r, err := os.Open(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer r.Close()
+	opt := DefaultConversionOptions()
+	grid := NewTextGrid(0, 0)
+	directives, err := grid.LoadFrom(r, opt.Processing, nil)
+	if err != nil {
+		tb.Fatalf("%s: %s", path, err)
+	}
+	directives.Apply(&opt, nil)
+	return NewDiagram(grid, opt, nil)
+}
+
+func TestDiagramGeometry(t *testing.T) {
+	for _, path := range corpusFiles(t) {
+		d := loadDiagram(t, path)
+		golden := path + ".xml"
+		if *updateGeometry {
+			buf, err := xml.MarshalIndent(d.G, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ioutil.WriteFile(golden, append(buf, '\n'), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		buf, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		expected := graphical.Diagram{}
+		err = xml.Unmarshal(buf, &expected)
+		if err != nil {
+			t.Errorf("%s: %s", golden, err)
+			continue
+		}
+		for _, problem := range compareGeometry(&expected, &d.G) {
+			t.Errorf("%s: %s", path, problem)
+		}
+	}
+}
+
+func TestCompareLabels(t *testing.T) {
+	expected := &graphical.Diagram{Labels: []graphical.Label{{Text: "a", X: 10, Y: 20}}}
+	tests := []struct {
+		label    graphical.Label
+		problems int
+	}{
+		{graphical.Label{Text: "a", X: 10, Y: 20}, 0},
+		{graphical.Label{Text: "a", X: 11, Y: 18}, 0},
+		{graphical.Label{Text: "a", X: 10, Y: 25}, 2},
+		{graphical.Label{Text: "b", X: 10, Y: 20}, 2},
+		{graphical.Label{Text: "a", X: 10, Y: 20, OnLine: true}, 2},
+	}
+	for _, tt := range tests {
+		got := &graphical.Diagram{Labels: []graphical.Label{tt.label}}
+		if problems := compareGeometry(expected, got); len(problems) != tt.problems {
+			t.Errorf("%s: got problems %q", describeLabel(&tt.label), problems)
+		}
+	}
+}
+
+// compareGeometry lists the differences between the shapes and labels of
+// two diagrams, ignoring their order. Shapes are compared by type, flags,
+// colors, identifiers, links and the set of their points; labels by text,
+// position (give or take -label-tolerance) and whether they are on a line;
+// connectors by what they connect.
+func compareGeometry(expected, got *graphical.Diagram) []string {
+	problems := []string{}
+	if expected.Grid != got.Grid {
+		problems = append(problems, fmt.Sprintf("grid is %+v, expected %+v", got.Grid, expected.Grid))
+	}
+
+	sameShape := func(s1, s2 *graphical.Shape) bool {
+		return s1.Type == s2.Type && s1.Closed == s2.Closed && s1.Dashed == s2.Dashed &&
+			sameDecorations(s1, s2) && s1.ID == s2.ID && s1.Link == s2.Link &&
+			s1.StrokeColor == s2.StrokeColor &&
+			(s1.FillColor == nil) == (s2.FillColor == nil) &&
+			(s1.FillColor == nil || *s1.FillColor == *s2.FillColor) &&
+			s1.Equals(*s2)
+	}
+	matched := make([]bool, len(got.Shapes))
+	for i := range expected.Shapes {
+		found := false
+		for j := range got.Shapes {
+			if !matched[j] && sameShape(&expected.Shapes[i], &got.Shapes[j]) {
+				matched[j], found = true, true
+				break
+			}
+		}
+		if !found {
+			problems = append(problems, "missing shape "+describeShape(&expected.Shapes[i]))
+		}
+	}
+	for j := range got.Shapes {
+		if !matched[j] {
+			problems = append(problems, "unexpected shape "+describeShape(&got.Shapes[j]))
+		}
+	}
+
+	// label positions depend on font metrics, which may shift them slightly
+	near := func(a, b int) bool { return a-b <= *labelTolerance && b-a <= *labelTolerance }
+	sameLabel := func(l1, l2 *graphical.Label) bool {
+		return l1.Text == l2.Text && near(l1.X, l2.X) && near(l1.Y, l2.Y) && l1.OnLine == l2.OnLine
+	}
+	matched = make([]bool, len(got.Labels))
+	for i := range expected.Labels {
+		found := false
+		for j := range got.Labels {
+			if !matched[j] && sameLabel(&expected.Labels[i], &got.Labels[j]) {
+				matched[j], found = true, true
+				break
+			}
+		}
+		if !found {
+			l := &expected.Labels[i]
+			problems = append(problems, "missing label "+describeLabel(l))
+		}
+	}
+	for j := range got.Labels {
+		if !matched[j] {
+			l := &got.Labels[j]
+			problems = append(problems, "unexpected label "+describeLabel(l))
+		}
+	}
+
+	e, g := strings.Join(describeConnectors(expected), "\n"), strings.Join(describeConnectors(got), "\n")
+	if e != g {
+		problems = append(problems, fmt.Sprintf("got connectors:\n%s\nexpected:\n%s", g, e))
+	}
+	return problems
+}
+
+// sameDecorations compares the decorations of the ends of open shapes, which
+// may list their points in either direction.
+func sameDecorations(s1, s2 *graphical.Shape) bool {
+	none := graphical.DECORATION_NONE
+	if s1.StartDecoration == none && s1.EndDecoration == none {
+		return s2.StartDecoration == none && s2.EndDecoration == none
+	}
+	n1, n2 := len(s1.Points), len(s2.Points)
+	if n1 == 0 || n2 == 0 {
+		return false
+	}
+	if s1.Points[0] == s2.Points[0] {
+		return s1.StartDecoration == s2.StartDecoration && s1.EndDecoration == s2.EndDecoration
+	}
+	return s1.Points[0] == s2.Points[n2-1] &&
+		s1.StartDecoration == s2.EndDecoration && s1.EndDecoration == s2.StartDecoration
+}
+
+func describeShape(s *graphical.Shape) string {
+	desc := fmt.Sprintf("type=%d closed=%v dashed=%v decorations=%d,%d id=%q link=%q points=",
+		s.Type, s.Closed, s.Dashed, s.StartDecoration, s.EndDecoration, s.ID, s.Link)
+	for i, p := range s.Points {
+		if i > 0 {
+			desc += " "
+		}
+		desc += fmt.Sprintf("%g,%g", p.X, p.Y)
+	}
+	return desc
+}
+
+func describeLabel(l *graphical.Label) string {
+	desc := fmt.Sprintf("%q at %d,%d", l.Text, l.X, l.Y)
+	if l.OnLine {
+		desc += " on line"
+	}
+	return desc
+}
@@ -0,0 +1,174 @@
+package graphical
+
+import (
+	"github.com/akavel/ditaa/fontmeasure"
+)
+
+// PathBuilder receives the segments of a path.
+type PathBuilder interface {
+	MoveTo(p Point)
+	LineTo(p Point)
+	QuadTo(ctrl, p Point)
+	CubicTo(ctrl1, ctrl2, p Point)
+	// Close adds a line back to the point of the last MoveTo.
+	Close()
+}
+
+// Layer describes how a group of drawing operations is composited onto
+// the canvas: the whole group is moved by Offset, then blurred with the
+// given radius in pixels.
+type Layer struct {
+	Offset Point
+	Blur   int
+}
+
+// Canvas is an output backend of RenderDiagram. A path is built with the
+// PathBuilder methods, and then painted and cleared by Fill, Stroke or
+// Dash.
+type Canvas interface {
+	PathBuilder
+	Fill(c Color)
+	Stroke(c Color, width float64)
+	Dash(c Color, width, dashLength float64)
+
+	// Text draws text with the baseline starting at x, y. The style is
+	// applied to font, synthesizing it if the font's family lacks it.
+	Text(x, y int, text string, font fontmeasure.Font, style fontmeasure.Style, c Color)
+
+	// PushClip limits drawing to r, intersected with any previous clip,
+	// until the matching PopClip.
+	PushClip(r Rect)
+	PopClip()
+
+	// BeginLayer starts a group of drawing operations, composited onto
+	// the canvas as described by l at the matching EndLayer.
+	BeginLayer(l Layer)
+	EndLayer()
+}
+
+// Anchor describes a shape to a Canvas of a vector format.
+type Anchor struct {
+	ID   string // for linking to the shape
+	Link string // URL the shape links to
+	Tip  string // tooltip, like the <title> of an SVG element
+}
+
+// AnchorCanvas is a Canvas of a format with hyperlinks and accessibility
+// metadata, like SVG or PDF. RenderDiagram uses it, if implemented, to make
+// the shapes with an ID, a Link or a Tip into link targets, links and
+// described elements (in SVG: <a> or <g> with a <title> and an ARIA role).
+type AnchorCanvas interface {
+	Canvas
+	// Describe gives the title and the description of the whole document,
+	// either of which may be empty. It is called first, if needed.
+	Describe(title, description string)
+	// BeginAnchor starts the drawing of a shape described by a, ended by
+	// the matching EndAnchor.
+	BeginAnchor(a Anchor)
+	EndAnchor()
+}
+
+type pathOp int
+
+const (
+	pathMove pathOp = iota
+	pathLine
+	pathQuad
+	pathCubic
+	pathClose
+)
+
+type pathSegment struct {
+	op     pathOp
+	points [3]Point
+}
+
+// Path records segments built with the PathBuilder methods, to be replayed
+// later with AddTo.
+type Path struct {
+	segments []pathSegment
+}
+
+func (p *Path) MoveTo(pt Point) {
+	p.segments = append(p.segments, pathSegment{op: pathMove, points: [3]Point{pt}})
+}
+
+func (p *Path) LineTo(pt Point) {
+	p.segments = append(p.segments, pathSegment{op: pathLine, points: [3]Point{pt}})
+}
+
+func (p *Path) QuadTo(ctrl, pt Point) {
+	p.segments = append(p.segments, pathSegment{op: pathQuad, points: [3]Point{ctrl, pt}})
+}
+
+func (p *Path) CubicTo(ctrl1, ctrl2, pt Point) {
+	p.segments = append(p.segments, pathSegment{op: pathCubic, points: [3]Point{ctrl1, ctrl2, pt}})
+}
+
+func (p *Path) Close() { p.segments = append(p.segments, pathSegment{op: pathClose}) }
+
+// AddTo replays the recorded segments onto b.
+func (p *Path) AddTo(b PathBuilder) {
+	for _, s := range p.segments {
+		switch s.op {
+		case pathMove:
+			b.MoveTo(s.points[0])
+		case pathLine:
+			b.LineTo(s.points[0])
+		case pathQuad:
+			b.QuadTo(s.points[0], s.points[1])
+		case pathCubic:
+			b.CubicTo(s.points[0], s.points[1], s.points[2])
+		case pathClose:
+			b.Close()
+		}
+	}
+}
+
+// Polygon flattens the path into a list of points, approximating each curve
+// with the given number of line segments.
+func (p *Path) Polygon(steps int) []Point {
+	pts := []Point{}
+	var cur Point
+	for _, s := range p.segments {
+		switch s.op {
+		case pathMove, pathLine:
+			cur = s.points[0]
+			pts = append(pts, cur)
+		case pathQuad:
+			c, end := s.points[0], s.points[1]
+			for i := 1; i <= steps; i++ {
+				t := float64(i) / float64(steps)
+				u := 1 - t
+				pts = append(pts, Point{
+					X: u*u*cur.X + 2*u*t*c.X + t*t*end.X,
+					Y: u*u*cur.Y + 2*u*t*c.Y + t*t*end.Y,
+				})
+			}
+			cur = end
+		case pathCubic:
+			c1, c2, end := s.points[0], s.points[1], s.points[2]
+			for i := 1; i <= steps; i++ {
+				t := float64(i) / float64(steps)
+				u := 1 - t
+				pts = append(pts, Point{
+					X: u*u*u*cur.X + 3*u*u*t*c1.X + 3*u*t*t*c2.X + t*t*t*end.X,
+					Y: u*u*u*cur.Y + 3*u*u*t*c1.Y + 3*u*t*t*c2.Y + t*t*t*end.Y,
+				})
+			}
+			cur = end
+		}
+	}
+	return pts
+}
+
+// rectPath builds the outline of r.
+func rectPath(r Rect) *Path {
+	path := &Path{}
+	path.MoveTo(r.Min)
+	path.LineTo(Point{X: r.Max.X, Y: r.Min.Y})
+	path.LineTo(r.Max)
+	path.LineTo(Point{X: r.Min.X, Y: r.Max.Y})
+	path.Close()
+	return path
+}
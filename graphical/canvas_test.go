@@ -0,0 +1,140 @@
+package graphical
+
+import (
+	"image"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/akavel/ditaa/embd"
+	"github.com/akavel/ditaa/fontmeasure"
+)
+
+// recordingCanvas logs the painting operations made on it.
+type recordingCanvas struct {
+	Path
+	ops []string
+}
+
+func (c *recordingCanvas) paint(op string) {
+	c.ops = append(c.ops, op)
+	c.segments = nil
+}
+
+func (c *recordingCanvas) Fill(Color)                   { c.paint("fill") }
+func (c *recordingCanvas) Stroke(Color, float64)        { c.paint("stroke") }
+func (c *recordingCanvas) Dash(Color, float64, float64) { c.paint("dash") }
+func (c *recordingCanvas) PushClip(Rect)                { c.paint("clip") }
+func (c *recordingCanvas) PopClip()                     { c.paint("unclip") }
+func (c *recordingCanvas) BeginLayer(Layer)             { c.paint("layer") }
+func (c *recordingCanvas) EndLayer()                    { c.paint("endlayer") }
+func (c *recordingCanvas) Text(x, y int, text string, _ fontmeasure.Font, _ fontmeasure.Style, _ Color) {
+	c.paint("text " + text)
+}
+
+func TestRenderDiagramOrder(t *testing.T) {
+	box := func(x0, y0, x1, y1 float64) Shape {
+		s := NewShape(Point{X: x0, Y: y0}, Point{X: x1, Y: y0}, Point{X: x1, Y: y1}, Point{X: x0, Y: y1})
+		s.Closed = true
+		return *s
+	}
+	marker := NewShape(Point{X: 50, Y: 50})
+	marker.Type = TYPE_POINT_MARKER
+	d := &Diagram{
+		Grid:   Grid{W: 200, H: 200, CellW: 10, CellH: 14},
+		Shapes: []Shape{*marker, box(10, 10, 50, 50), box(0, 0, 150, 150)},
+		Labels: []Label{{Text: "hi", FontSize: 12}},
+	}
+	c := &recordingCanvas{}
+	face, err := fontmeasure.ParseFace(embd.File_font_ttf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	family := &fontmeasure.Family{Regular: face}
+	err = RenderDiagram(c, d, Options{DropShadows: true}, family)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// background; shadows; large box, then small box; marker; text
+	expected := "fill layer fill fill endlayer fill stroke fill stroke fill fill text hi"
+	if got := strings.Join(c.ops, " "); got != expected {
+		t.Errorf("got operations:\n%s\nexpected:\n%s", got, expected)
+	}
+	if d.Shapes[0].Type != TYPE_POINT_MARKER {
+		t.Errorf("shapes of the diagram were reordered")
+	}
+}
+
+// anchorCanvas also logs the anchors made on it.
+type anchorCanvas struct {
+	recordingCanvas
+}
+
+func (c *anchorCanvas) Describe(title, desc string) { c.paint("describe " + title + " " + desc) }
+func (c *anchorCanvas) BeginAnchor(a Anchor)        { c.paint("anchor " + a.ID + " " + a.Link + " " + a.Tip) }
+func (c *anchorCanvas) EndAnchor()                  { c.paint("endanchor") }
+
+func TestRenderDiagramAnchors(t *testing.T) {
+	box := NewShape(Point{X: 10, Y: 10}, Point{X: 50, Y: 10}, Point{X: 50, Y: 50}, Point{X: 10, Y: 50})
+	box.Closed = true
+	box.ID, box.Link = "api", "https://example.com"
+	line := NewShape(Point{X: 50, Y: 30}, Point{X: 90, Y: 30})
+	line.Tip = "calls"
+	d := &Diagram{
+		Grid:   Grid{W: 100, H: 100, CellW: 10, CellH: 14},
+		Shapes: []Shape{*box, *line},
+	}
+	c := &anchorCanvas{}
+	err := RenderDiagram(c, d, Options{Title: "Services"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "describe Services  fill anchor api https://example.com  fill stroke endanchor anchor   calls stroke endanchor"
+	if got := strings.Join(c.ops, " "); got != expected {
+		t.Errorf("got operations:\n%s\nexpected:\n%s", got, expected)
+	}
+}
+
+func TestDashCircle(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 40, 40))
+	c := NewRasterCanvas(img)
+	Circle(20, 20, 15).AddTo(c)
+	c.Dash(Color{A: 255}, 1, 4)
+
+	// the dashes follow the circle, leaving gaps
+	inked := 0
+	for a := 0.0; a < 2*math.Pi; a += math.Pi / 64 {
+		x, y := 20+15*math.Cos(a), 20+15*math.Sin(a)
+		if img.RGBAAt(int(x+0.5), int(y+0.5)).A > 0 || img.RGBAAt(int(x), int(y)).A > 0 {
+			inked++
+		}
+	}
+	if inked < 32 || inked > 120 {
+		t.Errorf("%d of 128 points on the circle are inked, expected a dashed outline", inked)
+	}
+	if img.RGBAAt(20, 20).A != 0 {
+		t.Errorf("center of the circle is inked")
+	}
+}
+
+func TestRenderDashedHop(t *testing.T) {
+	hop := NewShape(Point{X: 5, Y: 21}, Point{X: 25, Y: 21})
+	hop.Type, hop.Dashed = TYPE_LINE_HOP, true
+	d := &Diagram{
+		Grid:   Grid{W: 30, H: 28, CellW: 10, CellH: 14},
+		Shapes: []Shape{*hop},
+	}
+	img := image.NewRGBA(image.Rect(0, 0, d.Grid.W, d.Grid.H))
+	err := RenderDiagram(NewRasterCanvas(img), d, Options{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the top of the arc, and its sides
+	for _, p := range []image.Point{{15, 16}, {10, 18}, {19, 18}} {
+		if r, _, _, _ := img.At(p.X, p.Y).RGBA(); r > 0x8000 {
+			t.Errorf("arc of dashed hop is not drawn at %v", p)
+		}
+	}
+}
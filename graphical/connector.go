@@ -0,0 +1,62 @@
+package graphical
+
+import "fmt"
+
+// Side is a side of a shape, where a connector is attached to it.
+type Side int
+
+const (
+	SIDE_NONE Side = iota
+	SIDE_NORTH
+	SIDE_EAST
+	SIDE_SOUTH
+	SIDE_WEST
+)
+
+func (s Side) String() string {
+	switch s {
+	case SIDE_NONE:
+		return "none"
+	case SIDE_NORTH:
+		return "north"
+	case SIDE_EAST:
+		return "east"
+	case SIDE_SOUTH:
+		return "south"
+	case SIDE_WEST:
+		return "west"
+	}
+	return fmt.Sprintf("side(%d)", int(s))
+}
+
+// Connector relates an open line to the closed shapes at its ends. Shapes
+// and labels are referred to by their indexes in the Diagram; -1 means
+// there is none.
+//
+// Lines meeting at junctions, where an end of one touches another, make a
+// single connector with more than two ends: the ones beyond Source and
+// Target are its Branches. Ends without arrowheads come first, so a
+// connector with arrowheads at only some ends points from Source to the
+// others.
+type Connector struct {
+	// Lines are the open shapes making up the connector: lines joined by
+	// line hops, and the hops. Lines of a connector without branches are
+	// listed from Source to Target. Points of each line may run either
+	// way.
+	Lines       []int          `xml:"lines>shape"`
+	Source      int            `xml:"source"`
+	SourceSide  Side           `xml:"sourceSide"`
+	SourceArrow int            `xml:"sourceArrow"` // arrowhead shape at the Source end
+	Target      int            `xml:"target"`
+	TargetSide  Side           `xml:"targetSide"`
+	TargetArrow int            `xml:"targetArrow"`
+	Branches    []ConnectorEnd `xml:"branches>end,omitempty"`
+	Labels      []int          `xml:"labels>label,omitempty"` // text written on the line
+}
+
+// ConnectorEnd is an end of a connector beyond its Source and Target.
+type ConnectorEnd struct {
+	Shape int  `xml:"shape"`
+	Side  Side `xml:"side"`
+	Arrow int  `xml:"arrow"`
+}
@@ -96,6 +96,26 @@ func (d *DeBezierizer) Add2(p1, p2 fixed.Point26_6) {
 	// }
 }
 
+// Add3 approximates the cubic curve with two quadratic ones, split at its
+// middle.
+func (d *DeBezierizer) Add3(p1, p2, p3 fixed.Point26_6) {
+	p0 := d.P0
+	p01, p12, p23 := midpoint(p0, p1), midpoint(p1, p2), midpoint(p2, p3)
+	p012, p123 := midpoint(p01, p12), midpoint(p12, p23)
+	mid := midpoint(p012, p123)
+	d.Add2(quadControl(p0, p01, p012, mid), mid)
+	d.Add2(quadControl(mid, p123, p23, p3), p3)
+}
+
+// quadControl returns the control point of a quadratic curve approximating
+// the cubic one from p0 to p3.
+func quadControl(p0, p1, p2, p3 fixed.Point26_6) fixed.Point26_6 {
+	return fixed.Point26_6{
+		X: (3*(p1.X+p2.X) - p0.X - p3.X) / 4,
+		Y: (3*(p1.Y+p2.Y) - p0.Y - p3.Y) / 4,
+	}
+}
+
 func curvy(p0, p1, p2 fixed.Point26_6) bool {
 	// FIXME(akavel): make sure if this func makes any sense; improve if needed
 	vec01 := p1.Sub(p0)
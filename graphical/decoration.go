@@ -0,0 +1,123 @@
+package graphical
+
+import "math"
+
+// Decoration is a symbol drawn at an end of an open line, like the ones of
+// UML class diagrams and of the crow's foot notation of ER diagrams.
+type Decoration int
+
+const (
+	DECORATION_NONE Decoration = iota
+	DECORATION_OPEN_ARROW
+	DECORATION_TRIANGLE // hollow, for inheritance
+	DECORATION_DIAMOND  // hollow, for aggregation
+	DECORATION_FILLED_DIAMOND
+	DECORATION_CIRCLE
+	DECORATION_BAR
+	DECORATION_ONE // two bars
+	DECORATION_ZERO_OR_ONE
+	DECORATION_MANY // crow's foot
+	DECORATION_ONE_OR_MANY
+	DECORATION_ZERO_OR_MANY
+)
+
+type decorationPart int
+
+const (
+	partBar decorationPart = iota
+	partCircle
+	partFoot
+	partOpenArrow
+	partTriangle
+	partDiamond
+	partFilledDiamond
+)
+
+// decorationParts lists the parts of each decoration, starting from the end
+// of the line.
+var decorationParts = map[Decoration][]decorationPart{
+	DECORATION_OPEN_ARROW:     {partOpenArrow},
+	DECORATION_TRIANGLE:       {partTriangle},
+	DECORATION_DIAMOND:        {partDiamond},
+	DECORATION_FILLED_DIAMOND: {partFilledDiamond},
+	DECORATION_CIRCLE:         {partCircle},
+	DECORATION_BAR:            {partBar},
+	DECORATION_ONE:            {partBar, partBar},
+	DECORATION_ZERO_OR_ONE:    {partBar, partCircle},
+	DECORATION_MANY:           {partFoot},
+	DECORATION_ONE_OR_MANY:    {partFoot, partBar},
+	DECORATION_ZERO_OR_MANY:   {partFoot, partCircle},
+}
+
+// drawDecoration draws decoration d at the end of a line at tip, where back
+// is any other point of the line's last segment. The size of the parts is
+// relative to size, so that they look the same in any direction.
+func drawDecoration(c Canvas, d Decoration, tip, back Point, size float64, color Color) {
+	dx, dy := back.X-tip.X, back.Y-tip.Y
+	length := math.Hypot(dx, dy)
+	if length == 0 {
+		return
+	}
+	dx, dy = dx/length, dy/length
+	// at returns the point at distance along the line from tip, and across
+	// it to the left
+	at := func(along, across float64) Point {
+		return Point{X: tip.X + along*dx - across*dy, Y: tip.Y + along*dy + across*dx}
+	}
+	outline := func(fill Color, pts ...Point) {
+		c.MoveTo(pts[0])
+		for _, p := range pts[1:] {
+			c.LineTo(p)
+		}
+		c.Close()
+		c.Fill(fill)
+		c.MoveTo(pts[0])
+		for _, p := range pts[1:] {
+			c.LineTo(p)
+		}
+		c.Close()
+		c.Stroke(color, STROKE_WIDTH)
+	}
+
+	w := 0.6 * size // half of the width of parts
+	pos := 0.0
+	for _, part := range decorationParts[d] {
+		switch part {
+		case partBar:
+			c.MoveTo(at(pos+0.3*size, w))
+			c.LineTo(at(pos+0.3*size, -w))
+			c.Stroke(color, STROKE_WIDTH)
+			pos += 0.5 * size
+		case partCircle:
+			r := 0.35 * size
+			center := at(pos+0.15*size+r, 0)
+			Circle(center.X, center.Y, r+STROKE_WIDTH*0.5).AddTo(c)
+			c.Fill(color)
+			Circle(center.X, center.Y, r-STROKE_WIDTH*0.5).AddTo(c)
+			c.Fill(WHITE)
+			pos += 2*r + 0.3*size
+		case partFoot:
+			c.MoveTo(at(pos, w))
+			c.LineTo(at(pos+size, 0))
+			c.LineTo(at(pos, -w))
+			c.Stroke(color, STROKE_WIDTH)
+			pos += size
+		case partOpenArrow:
+			c.MoveTo(at(pos+size, w))
+			c.LineTo(at(pos, 0))
+			c.LineTo(at(pos+size, -w))
+			c.Stroke(color, STROKE_WIDTH)
+			pos += size
+		case partTriangle:
+			outline(WHITE, at(pos, 0), at(pos+1.5*size, w), at(pos+1.5*size, -w))
+			pos += 1.5 * size
+		case partDiamond, partFilledDiamond:
+			fill := WHITE
+			if part == partFilledDiamond {
+				fill = color
+			}
+			outline(fill, at(pos, 0), at(pos+size, w), at(pos+2*size, 0), at(pos+size, -w))
+			pos += 2 * size
+		}
+	}
+}
@@ -2,29 +2,61 @@ package graphical
 
 import (
 	"encoding/xml"
-	"image"
-	"image/color"
 	"sort"
 
 	"github.com/akavel/ditaa/fontmeasure"
-
-	"github.com/BurntSushi/graphics-go/graphics"
-	"github.com/BurntSushi/graphics-go/graphics/interp"
-	"github.com/golang/freetype"
-	"github.com/golang/freetype/truetype"
 )
 
 const DEBUG = true
 
+// TextRun is a piece of label text drawn in a single style.
+type TextRun struct {
+	Text  string            `xml:",chardata"`
+	Style fontmeasure.Style `xml:"style,attr,omitempty"`
+	Link  string            `xml:"href,attr,omitempty"`
+}
+
 type Label struct {
-	Text         string  `xml:"text"`
-	FontSize     float64 `xml:"font>size"`
-	X            int     `xml:"xPos"`
-	Y            int     `xml:"yPos"`
-	Color        Color   `xml:"color"`
-	OnLine       bool    `xml:"isTextOnLine"`
-	Outline      bool    `xml:"hasOutline"`
-	OutlineColor Color   `xml:"outlineColor"`
+	Text         string    `xml:"text"`
+	Runs         []TextRun `xml:"runs>run,omitempty"` // styled pieces of Text; plain if empty
+	FontSize     float64   `xml:"font>size"`
+	X            int       `xml:"xPos"`
+	Y            int       `xml:"yPos"`
+	Color        Color     `xml:"color"`
+	OnLine       bool      `xml:"isTextOnLine"`
+	Outline      bool      `xml:"hasOutline"`
+	OutlineColor Color     `xml:"outlineColor"`
+
+	// The knockout behind text on a line is split across the line, at
+	// LineAt on the Y axis, or the X axis if LineVertical. Its part above
+	// or left of the line is filled with Background, the other with
+	// BackgroundAfter; white if nil.
+	LineVertical    bool    `xml:"isLineVertical,omitempty"`
+	LineAt          float64 `xml:"lineAt,omitempty"`
+	Background      *Color  `xml:"backgroundColor,omitempty"`
+	BackgroundAfter *Color  `xml:"backgroundColorAfter,omitempty"`
+}
+
+// TextRuns returns the styled pieces of the label's text.
+func (l *Label) TextRuns() []TextRun {
+	if len(l.Runs) == 0 {
+		return []TextRun{{Text: l.Text}}
+	}
+	return l.Runs
+}
+
+// Width measures the label's text at the label's font size.
+func (l *Label) Width(font *fontmeasure.Font) int {
+	sizedFont := *font
+	sizedFont.Size = l.FontSize
+	if len(l.Runs) == 0 {
+		return sizedFont.WidthFor(l.Text)
+	}
+	w := 0
+	for _, run := range l.Runs {
+		w += sizedFont.StyledWidthFor(run.Text, run.Style)
+	}
+	return w
 }
 
 func (l *Label) CenterVerticallyBetween(minY, maxY int, font *fontmeasure.Font) {
@@ -36,17 +68,13 @@ func (l *Label) CenterVerticallyBetween(minY, maxY int, font *fontmeasure.Font)
 }
 
 func (l *Label) CenterHorizontallyBetween(minX, maxX int, font *fontmeasure.Font) {
-	sizedFont := *font
-	sizedFont.Size = l.FontSize
-	width := sizedFont.WidthFor(l.Text)
+	width := l.Width(font)
 	center := abs(maxX-minX) / 2
 	l.X += abs(center - width/2)
 }
 
 func (l *Label) AlignRightEdgeTo(x int, font *fontmeasure.Font) {
-	sizedFont := *font
-	sizedFont.Size = l.FontSize
-	width := sizedFont.WidthFor(l.Text)
+	width := l.Width(font)
 	l.X = x - width
 }
 
@@ -57,7 +85,7 @@ func (l *Label) BoundsFor(font *fontmeasure.Font) Rect {
 	ascent, advance := font.Ascent(), font.Advance()
 	r := Rect{
 		Min: Point{X: float64(l.X), Y: float64(l.Y - ascent)},
-		Max: Point{X: float64(l.X + font.WidthFor(l.Text)), Y: float64(l.Y - ascent + advance)},
+		Max: Point{X: float64(l.X + l.Width(font)), Y: float64(l.Y - ascent + advance)},
 	}
 	return r
 }
@@ -67,50 +95,73 @@ type Diagram struct {
 	Grid    Grid     `xml:"grid"`
 	Shapes  []Shape  `xml:"shapes>shape"`
 	Labels  []Label  `xml:"texts>text"`
+
+	Connectors []Connector `xml:"connectors>connector,omitempty"`
 }
 
-type Options struct {
-	DropShadows bool
+// LabelShapes finds the shape containing each label of the diagram, indexed
+// as Labels. A label belongs to the smallest closed shape containing the
+// start of its baseline; -1 means there is none.
+func (d *Diagram) LabelShapes() []int {
+	result := make([]int, len(d.Labels))
+	for j, l := range d.Labels {
+		p := Point{X: float64(l.X), Y: float64(l.Y)}
+		result[j] = -1
+		for i := range d.Shapes {
+			s := &d.Shapes[i]
+			if !s.Closed || s.Type == TYPE_ARROWHEAD || s.Type == TYPE_POINT_MARKER || !s.Contains(p) {
+				continue
+			}
+			if result[j] < 0 || s.SmallerThan(&d.Shapes[result[j]]) {
+				result[j] = i
+			}
+		}
+	}
+	return result
 }
 
-func renderShadows(img *image.RGBA, shapes []Shape, g Grid, opt Options) {
-	for _, shape := range shapes {
-		if len(shape.Points) == 0 || !shape.DropsShadow() || shape.Type == TYPE_CUSTOM {
+// ShapeTexts returns the text of the labels inside each shape of the
+// diagram, indexed as Shapes.
+func (d *Diagram) ShapeTexts() []string {
+	texts := make([]string, len(d.Shapes))
+	for j, i := range d.LabelShapes() {
+		if i < 0 {
 			continue
 		}
-		path := shape.MakeIntoRenderPath(g, false /*, opt*/)
-		if path == nil {
-			continue
+		if texts[i] != "" {
+			texts[i] += " "
 		}
-		Fill(img, path, color.RGBA{150, 150, 150, 255})
+		texts[i] += d.Labels[j].Text
 	}
+	return texts
+}
+
+type Options struct {
+	DropShadows bool
+	Scale       float64 // size of the output relative to default; 1 if 0
+	// of the whole diagram, for accessibility
+	Title, Description string
+}
+
+func renderShadows(c Canvas, shapes []Shape, g Grid, opt Options) {
 	offset := g.CellW
 	if g.CellH < offset {
 		offset = g.CellH
 	}
 	offsetf := float64(offset) / 3.3333
-	img2 := image.NewRGBA(img.Bounds())
-	graphics.I.Translate(float64(offsetf), float64(offsetf)).Transform(img2, img, interp.Bilinear)
-	*img = *img2
-}
-
-func blurShadows(img *image.RGBA) {
-	radius := 4
-	StackBlur(img, radius, true)
-
-	// remove blur artifacts from the top-left border of image
-	bb := img.Rect
-	radius += 2
-	for y := bb.Min.Y; y <= bb.Min.Y+radius; y++ {
-		for x := bb.Min.X; x <= bb.Max.X; x++ {
-			img.SetRGBA(x, y, WHITE.RGBA())
+	c.BeginLayer(Layer{Offset: Point{X: offsetf, Y: offsetf}, Blur: 4})
+	for _, shape := range shapes {
+		if len(shape.Points) == 0 || !shape.DropsShadow() || shape.Type == TYPE_CUSTOM {
+			continue
 		}
-	}
-	for y := bb.Min.Y + radius + 1; y <= bb.Max.Y; y++ {
-		for x := bb.Min.X; x <= bb.Min.X+radius; x++ {
-			img.SetRGBA(x, y, WHITE.RGBA())
+		path := shape.MakeIntoRenderPath(g, false /*, opt*/)
+		if path == nil {
+			continue
 		}
+		path.AddTo(c)
+		c.Fill(Color{150, 150, 150, 255})
 	}
+	c.EndLayer()
 }
 
 type LargeFirst []Shape
@@ -131,19 +182,38 @@ func (t BottomFirst) Less(i, j int) bool {
 	return y1 > y2
 }
 
-func RenderDiagram(img *image.RGBA, diagram *Diagram, opt Options, font *truetype.Font) error {
-	for y := 0; y < diagram.Grid.H; y++ {
-		for x := 0; x < diagram.Grid.W; x++ {
-			img.SetRGBA(x, y, WHITE.RGBA())
+// RenderDiagram draws the diagram on c: the drop shadows, storage shapes
+// bottom first, other shapes large first, then line end decorations, point
+// markers and text.
+func RenderDiagram(c Canvas, diagram *Diagram, opt Options, family *fontmeasure.Family) error {
+	fill := func(path *Path, color Color) {
+		path.AddTo(c)
+		c.Fill(color)
+	}
+	stroke := func(path *Path, color Color, dashed bool) {
+		path.AddTo(c)
+		if dashed {
+			c.Dash(color, STROKE_WIDTH, DASH_LENGTH)
+		} else {
+			c.Stroke(color, STROKE_WIDTH)
 		}
 	}
 
+	anchors, _ := c.(AnchorCanvas)
+	anchored := func(shape Shape) bool {
+		return anchors != nil && (shape.ID != "" || shape.Link != "" || shape.Tip != "")
+	}
+	if anchors != nil && (opt.Title != "" || opt.Description != "") {
+		anchors.Describe(opt.Title, opt.Description)
+	}
+
+	fill(rectPath(Rect{Max: Point{X: float64(diagram.Grid.W), Y: float64(diagram.Grid.H)}}), WHITE)
+
 	//TODO: antialiasing options
 
 	// drop shadows
 	if opt.DropShadows {
-		renderShadows(img, diagram.Shapes, diagram.Grid, opt)
-		blurShadows(img)
+		renderShadows(c, diagram.Shapes, diagram.Grid, opt)
 	}
 
 	//render storage shapes
@@ -158,27 +228,37 @@ func RenderDiagram(img *image.RGBA, diagram *Diagram, opt Options, font *truetyp
 			storageShapes = append(storageShapes, shape)
 		}
 	}
-	sort.Sort(BottomFirst(storageShapes))
+	sort.Stable(BottomFirst(storageShapes))
 	for _, shape := range storageShapes {
 		strokePath := shape.MakeIntoRenderPath(diagram.Grid, true /*, opt*/)
-		if shape.Dashed {
-			Dash(img, strokePath, shape.StrokeColor.RGBA())
-		} else {
-			fillPath := shape.MakeIntoRenderPath(diagram.Grid, false /*, opt*/)
+		if strokePath == nil {
+			continue
+		}
+		if anchored(shape) {
+			anchors.BeginAnchor(Anchor{ID: shape.ID, Link: shape.Link, Tip: shape.Tip})
+		}
+		if !shape.Dashed {
 			color := WHITE
 			if shape.FillColor != nil {
 				color = *shape.FillColor
 			}
-			Fill(img, fillPath, color.RGBA())
-			Stroke(img, strokePath, shape.StrokeColor.RGBA())
+			fill(shape.MakeIntoRenderPath(diagram.Grid, false /*, opt*/), color)
+		}
+		stroke(strokePath, shape.StrokeColor, shape.Dashed)
+		if anchored(shape) {
+			anchors.EndAnchor()
 		}
 	}
 
-	sort.Sort(LargeFirst(diagram.Shapes))
+	// stable, so that shapes of equal area are always drawn in the same order;
+	// sorted apart, as connectors refer to shapes by their order
+	shapes := append([]Shape(nil), diagram.Shapes...)
+	sort.Stable(LargeFirst(shapes))
 
-	// render rest of shapes + collect point markers
+	// render rest of shapes + collect point markers and decorated lines
 	pointMarkers := []Shape{}
-	for _, shape := range diagram.Shapes {
+	decorated := []Shape{}
+	for _, shape := range shapes {
 		switch shape.Type {
 		case TYPE_POINT_MARKER:
 			pointMarkers = append(pointMarkers, shape)
@@ -192,6 +272,9 @@ func RenderDiagram(img *image.RGBA, diagram *Diagram, opt Options, font *truetyp
 		if len(shape.Points) == 0 {
 			continue
 		}
+		if anchored(shape) {
+			anchors.BeginAnchor(Anchor{ID: shape.ID, Link: shape.Link, Tip: shape.Tip})
+		}
 
 		// fill
 		fillPath := shape.MakeIntoRenderPath(diagram.Grid, false /*, opt*/)
@@ -200,37 +283,54 @@ func RenderDiagram(img *image.RGBA, diagram *Diagram, opt Options, font *truetyp
 			if shape.FillColor != nil {
 				color = *shape.FillColor
 			}
-			Fill(img, fillPath, color.RGBA())
+			fill(fillPath, color)
 		}
 
 		// draw
 		strokePath := shape.MakeIntoRenderPath(diagram.Grid, true /*, opt*/)
-		if shape.Type != TYPE_ARROWHEAD {
-			if shape.Dashed {
-				Dash(img, strokePath, shape.StrokeColor.RGBA())
-			} else {
-				Stroke(img, strokePath, shape.StrokeColor.RGBA())
+		if shape.Type == TYPE_LINE_HOP && shape.Dashed {
+			straight, arc := shape.makeDashedHopPaths(diagram.Grid)
+			if straight != nil {
+				stroke(straight, shape.StrokeColor, true)
+				stroke(arc, shape.StrokeColor, false)
 			}
+		} else if strokePath != nil && shape.Type != TYPE_ARROWHEAD {
+			stroke(strokePath, shape.StrokeColor, shape.Dashed)
+		}
+		if anchored(shape) {
+			anchors.EndAnchor()
 		}
+		if !shape.Closed && len(shape.Points) >= 2 &&
+			(shape.StartDecoration != DECORATION_NONE || shape.EndDecoration != DECORATION_NONE) {
+			decorated = append(decorated, shape)
+		}
+	}
+
+	// render line end decorations, over any shapes they touch
+	size := diagram.Grid.MinimumOfCellDimensions()
+	for _, shape := range decorated {
+		n := len(shape.Points)
+		drawDecoration(c, shape.StartDecoration, shape.Points[0], shape.Points[1], size, shape.StrokeColor)
+		drawDecoration(c, shape.EndDecoration, shape.Points[n-1], shape.Points[n-2], size, shape.StrokeColor)
 	}
 
 	// render point markers
 	for _, shape := range pointMarkers {
 		outer, inner := shape.MakeMarkerPaths(diagram.Grid)
-		Fill(img, outer, shape.StrokeColor.RGBA())
-		Fill(img, inner, WHITE.RGBA())
+		if outer == nil {
+			continue
+		}
+		color := WHITE
+		if shape.FillColor != nil {
+			color = *shape.FillColor
+		}
+		fill(outer, shape.StrokeColor)
+		fill(inner, color)
 	}
 
 	// handle text
 	for _, label := range diagram.Labels {
-		ctx := freetype.NewContext()
-		ctx.SetFont(font)
-		ctx.SetFontSize(label.FontSize)
-		ctx.SetSrc(image.NewUniform(label.Color.RGBA()))
-		ctx.SetDst(img)
-		ctx.SetClip(img.Bounds())
-		//TODO: handle outline
-		ctx.DrawString(label.Text, P(Point{X: float64(label.X), Y: float64(label.Y)}))
+		drawLabel(c, label, family)
 	}
 	return nil
 }
@@ -13,6 +13,7 @@ import (
 
 const (
 	STROKE_WIDTH float64 = 1
+	DASH_LENGTH  float64 = 5 // FIXME(akavel): make this configurable, or auto-detect
 	MAGIC_K      float64 = 0.5522847498
 )
 
@@ -53,6 +54,11 @@ func P(p Point) fixed.Point26_6 {
 	return fixed.P(int(p.X), int(p.Y))
 }
 
+// fixp converts p to fixed point, keeping its fractional part.
+func fixp(p Point) fixed.Point26_6 {
+	return fixed.Point26_6{X: ftofix(p.X), Y: ftofix(p.Y)}
+}
+
 func ftofix(f float64) fixed.Int26_6 {
 	//TODO: verify this is OK
 	a := math.Trunc(f)
@@ -60,25 +66,21 @@ func ftofix(f float64) fixed.Int26_6 {
 	return fixed.Int26_6(a)<<6 + fixed.Int26_6(b)
 }
 
-func Stroke(img *image.RGBA, path raster.Path, color color.RGBA) {
-	stroke(img, path, color, nil)
-}
-
-func stroke(img *image.RGBA, path raster.Path, color color.RGBA, cr raster.Capper) {
+func stroke(img *image.RGBA, path raster.Path, color color.RGBA, width float64, cr raster.Capper) {
 	g := raster.NewRasterizer(img.Rect.Max.X+1, img.Rect.Max.Y+1) //TODO: +1 or not?
-	raster.Stroke(g, path, ftofix(STROKE_WIDTH), cr, nil)
+	raster.Stroke(g, path, ftofix(width), cr, nil)
 	painter := raster.NewRGBAPainter(img)
 	painter.SetColor(color)
 	g.Rasterize(painter)
 }
 
-func Dash(img *image.RGBA, path raster.Path, color color.RGBA) {
+func dash(img *image.RGBA, path raster.Path, color color.RGBA, width, length float64) {
 	p := func(x, y fixed.Int26_6) fixed.Point26_6 {
 		return fixed.Point26_6{x, y}
 	}
 	dashed := raster.Path{}
 	dasher := dasher.DeBezierizer{A: &dasher.Dasher{
-		Length: fixed.I(5), // FIXME(akavel): make this configurable, or auto-detect
+		Length: ftofix(length),
 		A:      &dashed,
 	}}
 	for len(path) > 0 {
@@ -93,12 +95,13 @@ func Dash(img *image.RGBA, path raster.Path, color color.RGBA) {
 			dasher.Add2(p(path[1], path[2]), p(path[3], path[4]))
 			path = path[6:]
 		case 3:
-			panic("Dash: cubic paths not implemented")
+			dasher.Add3(p(path[1], path[2]), p(path[3], path[4]), p(path[5], path[6]))
+			path = path[8:]
 		default:
 			panic("Dash: unknown code of path segment")
 		}
 	}
-	stroke(img, dashed, color, raster.ButtCapper)
+	stroke(img, dashed, color, width, raster.ButtCapper)
 }
 
 func Fill(img *image.RGBA, path raster.Path, color color.RGBA) {
@@ -109,24 +112,23 @@ func Fill(img *image.RGBA, path raster.Path, color color.RGBA) {
 	g.Rasterize(painter)
 }
 
-func Circle(x, y, r float64) raster.Path {
-	//panic(fmt.Sprint(x, y, r))
-	P := func(x, y float64) fixed.Point26_6 {
-		return fixed.Point26_6{ftofix(x), ftofix(y)}
+func Circle(x, y, r float64) *Path {
+	P := func(x, y float64) Point {
+		return Point{X: x, Y: y}
 	}
 	p1 := P(x+r, y)
 	p2 := P(x, y+r)
 	p3 := P(x-r, y)
 	p4 := P(x, y-r)
 	kr := MAGIC_K * r
-	path := raster.Path{}
+	path := &Path{}
 	// see: http://hansmuller-flex.blogspot.com/2011/04/approximating-circular-arc-with-cubic.html
 	//  or: http://www.whizkidtech.redprince.net/bezier/circle/
 	// etc. -- google "drawing circle with cubic curves"
-	path.Start(p1)
-	path.Add3(P(x+r, y+kr), P(x+kr, y+r), p2)
-	path.Add3(P(x-kr, y+r), P(x-r, y+kr), p3)
-	path.Add3(P(x-r, y-kr), P(x-kr, y-r), p4)
-	path.Add3(P(x+kr, y-r), P(x+r, y-kr), p1)
+	path.MoveTo(p1)
+	path.CubicTo(P(x+r, y+kr), P(x+kr, y+r), p2)
+	path.CubicTo(P(x-kr, y+r), P(x-r, y+kr), p3)
+	path.CubicTo(P(x-r, y-kr), P(x-kr, y-r), p4)
+	path.CubicTo(P(x+kr, y-r), P(x+r, y-kr), p1)
 	return path
 }
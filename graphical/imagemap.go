@@ -0,0 +1,68 @@
+package graphical
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"sort"
+	"strings"
+)
+
+// curveSteps is the number of straight segments approximating each curve
+// of the outline of an image map area.
+const curveSteps = 8
+
+// WriteImageMap writes an HTML image map with the given name, with an area
+// for each closed shape of d. Areas follow the outlines of shapes as drawn,
+// link to the shape's Link if any, and are titled with the shape's Tip or
+// else the text inside it. Smaller shapes come first, so that they take
+// precedence over the shapes around them.
+func WriteImageMap(w io.Writer, d *Diagram, name string) error {
+	texts := d.ShapeTexts()
+	type area struct {
+		Shape
+		text string
+	}
+	areas := []area{}
+	for i, s := range d.Shapes {
+		if s.Closed && s.Type != TYPE_ARROWHEAD && s.Type != TYPE_POINT_MARKER && len(s.Points) >= 3 {
+			areas = append(areas, area{s, texts[i]})
+		}
+	}
+	sort.SliceStable(areas, func(i, j int) bool { return areas[i].CalcArea() < areas[j].CalcArea() })
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "<map name=\"%s\">\n", html.EscapeString(name))
+	for _, a := range areas {
+		outline := a.Points
+		if path := a.MakeIntoRenderPath(d.Grid, false); path != nil {
+			outline = path.Polygon(curveSteps)
+		}
+		coords := []string{}
+		for _, p := range outline {
+			coord := fmt.Sprintf("%d,%d", int(p.X+0.5), int(p.Y+0.5))
+			if len(coords) == 0 || coords[len(coords)-1] != coord {
+				coords = append(coords, coord)
+			}
+		}
+		if len(coords) > 1 && coords[0] == coords[len(coords)-1] {
+			coords = coords[:len(coords)-1]
+		}
+		fmt.Fprintf(buf, "  <area shape=\"poly\" coords=\"%s\"", strings.Join(coords, ","))
+		if a.Link != "" {
+			fmt.Fprintf(buf, " href=\"%s\"", html.EscapeString(a.Link))
+		}
+		if a.ID != "" {
+			fmt.Fprintf(buf, " id=\"%s\"", html.EscapeString(a.ID))
+		}
+		title := a.text
+		if a.Tip != "" {
+			title = a.Tip
+		}
+		fmt.Fprintf(buf, " alt=\"%s\" title=\"%s\">\n", html.EscapeString(a.text), html.EscapeString(title))
+	}
+	buf.WriteString("</map>\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,38 @@
+package graphical
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteImageMap(t *testing.T) {
+	box := func(x0, y0, x1, y1 float64, id, link string) Shape {
+		s := NewShape(Point{X: x0, Y: y0}, Point{X: x1, Y: y0}, Point{X: x1, Y: y1}, Point{X: x0, Y: y1})
+		s.Closed = true
+		s.ID, s.Link = id, link
+		return *s
+	}
+	d := &Diagram{
+		Shapes: []Shape{
+			box(0, 0, 100, 100, "", "/outer?a=1&b=2"),
+			box(10, 10, 50, 50, "inner", "/inner"),
+			box(60, 60, 90, 90, "", ""),
+		},
+		Labels: []Label{{Text: "Inner", X: 20, Y: 30}, {Text: "<Outer>", X: 55, Y: 30}},
+	}
+	buf := &bytes.Buffer{}
+	err := WriteImageMap(buf, d, "diagram")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `<map name="diagram">
+  <area shape="poly" coords="60,60,90,60,90,90,60,90" alt="" title="">
+  <area shape="poly" coords="10,10,50,10,50,50,10,50" href="/inner" id="inner" alt="Inner" title="Inner">
+  <area shape="poly" coords="0,0,100,0,100,100,0,100" href="/outer?a=1&amp;b=2" alt="&lt;Outer&gt;" title="&lt;Outer&gt;">
+</map>
+`
+	if got := buf.String(); got != expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", got, expected)
+	}
+}
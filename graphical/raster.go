@@ -0,0 +1,124 @@
+package graphical
+
+import (
+	"image"
+
+	"github.com/akavel/ditaa/fontmeasure"
+
+	"github.com/BurntSushi/graphics-go/graphics"
+	"github.com/BurntSushi/graphics-go/graphics/interp"
+	"github.com/golang/freetype/raster"
+)
+
+// RasterCanvas is a Canvas drawing on an *image.RGBA with the freetype
+// rasterizer.
+type RasterCanvas struct {
+	img    *image.RGBA // the whole image
+	dst    *image.RGBA // img clipped by the current clip
+	path   raster.Path
+	start  Point
+	clips  []*image.RGBA
+	layers []rasterLayer
+}
+
+type rasterLayer struct {
+	Layer
+	dst   *image.RGBA
+	clips []*image.RGBA
+}
+
+func NewRasterCanvas(img *image.RGBA) *RasterCanvas {
+	return &RasterCanvas{img: img, dst: img}
+}
+
+func (c *RasterCanvas) MoveTo(p Point) {
+	c.path.Start(fixp(p))
+	c.start = p
+}
+
+func (c *RasterCanvas) LineTo(p Point) { c.path.Add1(fixp(p)) }
+
+func (c *RasterCanvas) QuadTo(ctrl, p Point) { c.path.Add2(fixp(ctrl), fixp(p)) }
+
+func (c *RasterCanvas) CubicTo(ctrl1, ctrl2, p Point) {
+	c.path.Add3(fixp(ctrl1), fixp(ctrl2), fixp(p))
+}
+
+func (c *RasterCanvas) Close() { c.path.Add1(fixp(c.start)) }
+
+func (c *RasterCanvas) Fill(color Color) {
+	Fill(c.dst, c.path, color.RGBA())
+	c.path = c.path[:0]
+}
+
+func (c *RasterCanvas) Stroke(color Color, width float64) {
+	stroke(c.dst, c.path, color.RGBA(), width, nil)
+	c.path = c.path[:0]
+}
+
+func (c *RasterCanvas) Dash(color Color, width, dashLength float64) {
+	dash(c.dst, c.path, color.RGBA(), width, dashLength)
+	c.path = c.path[:0]
+}
+
+func (c *RasterCanvas) Text(x, y int, text string, font fontmeasure.Font, style fontmeasure.Style, color Color) {
+	src := image.NewUniform(color.RGBA())
+	styled, synth := font.Styled(style)
+	if synth&fontmeasure.STYLE_ITALIC != 0 {
+		w := font.StyledWidthFor(text, style)
+		drawSlanted(c.dst, text, styled, synth, x, y, w, src)
+	} else {
+		drawRun(c.dst, text, styled, synth, x, y, src)
+	}
+}
+
+func (c *RasterCanvas) PushClip(r Rect) {
+	c.clips = append(c.clips, c.dst)
+	rect := image.Rect(int(r.Min.X), int(r.Min.Y), int(r.Max.X), int(r.Max.Y))
+	c.dst = c.dst.SubImage(rect).(*image.RGBA)
+}
+
+func (c *RasterCanvas) PopClip() {
+	c.dst = c.clips[len(c.clips)-1]
+	c.clips = c.clips[:len(c.clips)-1]
+}
+
+// BeginLayer starts a layer. The raster canvas draws the layer right onto
+// its image, and at EndLayer moves and blurs the whole image, as ditaa has
+// always drawn drop shadows: they are the first thing drawn over the
+// background, so only the background is moved and blurred along with them.
+func (c *RasterCanvas) BeginLayer(l Layer) {
+	c.layers = append(c.layers, rasterLayer{Layer: l, dst: c.dst, clips: c.clips})
+	c.dst, c.clips = c.img, nil
+}
+
+func (c *RasterCanvas) EndLayer() {
+	l := c.layers[len(c.layers)-1]
+	c.layers = c.layers[:len(c.layers)-1]
+	c.dst, c.clips = l.dst, l.clips
+	img := c.img
+	bb := img.Rect
+	background := img.RGBAAt(bb.Min.X, bb.Min.Y)
+	if l.Offset != (Point{}) {
+		moved := image.NewRGBA(bb)
+		graphics.I.Translate(l.Offset.X, l.Offset.Y).Transform(moved, img, interp.Bilinear)
+		copy(img.Pix, moved.Pix)
+	}
+	if l.Blur < 1 {
+		return
+	}
+	StackBlur(img, l.Blur, true)
+
+	// remove blur artifacts from the top-left border of image
+	margin := l.Blur + 2
+	for y := bb.Min.Y; y <= bb.Min.Y+margin; y++ {
+		for x := bb.Min.X; x <= bb.Max.X; x++ {
+			img.SetRGBA(x, y, background)
+		}
+	}
+	for y := bb.Min.Y + margin + 1; y <= bb.Max.Y; y++ {
+		for x := bb.Min.X; x <= bb.Min.X+margin; x++ {
+			img.SetRGBA(x, y, background)
+		}
+	}
+}
@@ -4,10 +4,7 @@ import (
 	"fmt"
 	"math"
 
-	"golang.org/x/image/math/fixed"
-
 	"github.com/akavel/polyclip-go"
-	"github.com/golang/freetype/raster"
 )
 
 type Grid struct {
@@ -47,6 +44,8 @@ const (
 	TYPE_MANUAL_OPERATION // upside-down trapezoid
 	TYPE_TRAPEZOID        // rightside-up trapezoid
 	TYPE_ELLIPSE
+	TYPE_LINE_HOP // horizontal line hopping over a vertical one
+
 	TYPE_CUSTOM ShapeType = 9999
 )
 
@@ -57,6 +56,13 @@ type Shape struct {
 	Closed      bool      `xml:"isClosed"`
 	Dashed      bool      `xml:"isStrokeDashed"`
 	Points      []Point   `xml:"points>point"`
+	// decorations of the first and last point of open shapes
+	StartDecoration Decoration `xml:"startDecoration,omitempty"`
+	EndDecoration   Decoration `xml:"endDecoration,omitempty"`
+	// identifier, hyperlink and tooltip of the shape, set with markup tags
+	ID   string `xml:"id,omitempty"`
+	Link string `xml:"link,omitempty"`
+	Tip  string `xml:"tip,omitempty"`
 }
 
 func NewShape(points ...Point) *Shape {
@@ -84,7 +90,7 @@ func (s *Shape) DropsShadow() bool {
 	return s.Closed && s.Type != TYPE_ARROWHEAD && s.Type != TYPE_POINT_MARKER && !s.Dashed
 }
 
-func (s *Shape) MakeMarkerPaths(g Grid) (outer, inner raster.Path) {
+func (s *Shape) MakeMarkerPaths(g Grid) (outer, inner *Path) {
 	if len(s.Points) != 1 {
 		return nil, nil
 	}
@@ -189,6 +195,11 @@ func Bounds(pp []Point) Rect {
 	return r
 }
 
+// pixel truncates p to whole pixels, as all shape outlines are drawn.
+func pixel(p Point) Point {
+	return Point{X: math.Trunc(p.X), Y: math.Trunc(p.Y)}
+}
+
 func specPoints(bb Rect) (p1, p2, p3, p4 Point) {
 	p1 = Point{X: bb.Min.X, Y: bb.Min.Y}
 	p2 = Point{X: bb.Max.X, Y: bb.Min.Y}
@@ -197,25 +208,25 @@ func specPoints(bb Rect) (p1, p2, p3, p4 Point) {
 	return
 }
 
-func (s *Shape) makeDocumentPath() raster.Path {
+func (s *Shape) makeDocumentPath() *Path {
 	bb := Bounds(s.Points)
 	p1, p2, p3, p4 := specPoints(bb)
 	pmid := Point{X: 0.5 * (bb.Min.X + bb.Max.X), Y: bb.Max.Y}
 
-	path := raster.Path{}
-	path.Start(P(p1))
-	path.Add1(P(p2))
-	path.Add1(P(p3))
+	path := &Path{}
+	path.MoveTo(pixel(p1))
+	path.LineTo(pixel(p2))
+	path.LineTo(pixel(p3))
 
 	controlDX := (bb.Max.X - bb.Min.X) / 6
 	controlDY := (bb.Max.Y - bb.Min.Y) / 8
-	path.Add2(P(Point{X: pmid.X + controlDX, Y: pmid.Y - controlDY}), P(pmid))
-	path.Add2(P(Point{X: pmid.X - controlDX, Y: pmid.Y + controlDY}), P(p4))
-	path.Add1(P(p1))
+	path.QuadTo(pixel(Point{X: pmid.X + controlDX, Y: pmid.Y - controlDY}), pixel(pmid))
+	path.QuadTo(pixel(Point{X: pmid.X - controlDX, Y: pmid.Y + controlDY}), pixel(p4))
+	path.LineTo(pixel(p1))
 	return path
 }
 
-func (s *Shape) makeIOPath(g Grid /*, opt Options*/) raster.Path {
+func (s *Shape) makeIOPath(g Grid /*, opt Options*/) *Path {
 	if len(s.Points) != 4 {
 		return nil
 	}
@@ -224,16 +235,16 @@ func (s *Shape) makeIOPath(g Grid /*, opt Options*/) raster.Path {
 	//TODO: handle opt.FixedSlope
 	offset := float64(g.CellW) * 0.5
 
-	path := raster.Path{}
-	path.Start(P(Point{X: p1.X + offset, Y: p1.Y}))
-	path.Add1(P(Point{X: p2.X + offset, Y: p2.Y}))
-	path.Add1(P(Point{X: p3.X - offset, Y: p3.Y}))
-	path.Add1(P(Point{X: p4.X - offset, Y: p4.Y}))
-	path.Add1(P(Point{X: p1.X + offset, Y: p1.Y})) // close path
+	path := &Path{}
+	path.MoveTo(pixel(Point{X: p1.X + offset, Y: p1.Y}))
+	path.LineTo(pixel(Point{X: p2.X + offset, Y: p2.Y}))
+	path.LineTo(pixel(Point{X: p3.X - offset, Y: p3.Y}))
+	path.LineTo(pixel(Point{X: p4.X - offset, Y: p4.Y}))
+	path.LineTo(pixel(Point{X: p1.X + offset, Y: p1.Y})) // close path
 	return path
 }
 
-func (s *Shape) makeTrapezoidPath(g Grid /*, opt Options*/, inverted bool) raster.Path {
+func (s *Shape) makeTrapezoidPath(g Grid /*, opt Options*/, inverted bool) *Path {
 	if len(s.Points) != 4 {
 		return nil
 	}
@@ -249,16 +260,16 @@ func (s *Shape) makeTrapezoidPath(g Grid /*, opt Options*/, inverted bool) raste
 	bl := Point{X: bb.Min.X - offset, Y: bb.Max.Y}
 	//pmid := Point{X:0.5*(bb.Min.X+bb.Max.X), Y:bb.Max.Y}
 
-	path := raster.Path{}
-	path.Start(P(ul))
-	path.Add1(P(ur))
-	path.Add1(P(br))
-	path.Add1(P(bl))
-	path.Add1(P(ul)) // close path
+	path := &Path{}
+	path.MoveTo(pixel(ul))
+	path.LineTo(pixel(ur))
+	path.LineTo(pixel(br))
+	path.LineTo(pixel(bl))
+	path.LineTo(pixel(ul)) // close path
 	return path
 }
 
-func (s *Shape) makeDecisionPath() raster.Path {
+func (s *Shape) makeDecisionPath() *Path {
 	if len(s.Points) != 4 {
 		return nil
 	}
@@ -269,16 +280,16 @@ func (s *Shape) makeDecisionPath() raster.Path {
 	top := Point{X: pmid.X, Y: bb.Min.Y}
 	bottom := Point{X: pmid.X, Y: bb.Max.Y}
 
-	path := raster.Path{}
-	path.Start(P(left))
-	path.Add1(P(top))
-	path.Add1(P(right))
-	path.Add1(P(bottom))
-	path.Add1(P(left)) // close path
+	path := &Path{}
+	path.MoveTo(pixel(left))
+	path.LineTo(pixel(top))
+	path.LineTo(pixel(right))
+	path.LineTo(pixel(bottom))
+	path.LineTo(pixel(left)) // close path
 	return path
 }
 
-func (s *Shape) makeStoragePath(g Grid, forStroke bool) raster.Path {
+func (s *Shape) makeStoragePath(g Grid, forStroke bool) *Path {
 	if len(s.Points) != 4 {
 		return nil
 	}
@@ -290,64 +301,85 @@ func (s *Shape) makeStoragePath(g Grid, forStroke bool) raster.Path {
 	offytop := float64(g.CellH) / 2
 	offybottom := float64(g.CellH) * 10 / 14
 
-	path := raster.Path{}
+	path := &Path{}
 	// FIXME(akavel): build with cubic Bezier curves and stroke with http://stackoverflow.com/q/408457
 	// //top of cylinder
-	// path.Start(P(p1))
-	// path.Add3(P(Point{X: p1.X + offx, Y: p1.Y + offytop}), P(Point{X: p2.X - offx, Y: p2.Y + offytop}), P(p2))
-	// path.Add3(P(Point{X: p2.X - offx, Y: p2.Y - offytop}), P(Point{X: p1.X + offx, Y: p1.Y - offytop}), P(p1))
+	// path.MoveTo(pixel(p1))
+	// path.CubicTo(pixel(Point{X: p1.X + offx, Y: p1.Y + offytop}), pixel(Point{X: p2.X - offx, Y: p2.Y + offytop}), pixel(p2))
+	// path.CubicTo(pixel(Point{X: p2.X - offx, Y: p2.Y - offytop}), pixel(Point{X: p1.X + offx, Y: p1.Y - offytop}), pixel(p1))
 	// //side of cylinder
-	// path.Add1(P(p4))
-	// path.Add3(P(Point{X: p4.X + offx, Y: p4.Y + offybottom}), P(Point{X: p3.X - offx, Y: p3.Y + offybottom}), P(p3))
-	// path.Add1(P(p2))
+	// path.LineTo(pixel(p4))
+	// path.CubicTo(pixel(Point{X: p4.X + offx, Y: p4.Y + offybottom}), pixel(Point{X: p3.X - offx, Y: p3.Y + offybottom}), pixel(p3))
+	// path.LineTo(pixel(p2))
 	// return path
 
-	Pxy := func(x, y float64) fixed.Point26_6 { return P(Point{X: x, Y: y}) }
+	Pxy := func(x, y float64) Point { return pixel(Point{X: x, Y: y}) }
 	offytop *= .72
 	offybottom *= .72
 	// outline of cylinder: top-left...
-	path.Start(P(p1))
+	path.MoveTo(pixel(p1))
 	// ...left side...
-	path.Add1(P(p4))
+	path.LineTo(pixel(p4))
 	// ...bottom curve...
-	path.Add2(Pxy(p4.X+offx, p4.Y+offybottom), Pxy((p4.X+p3.X)/2, p4.Y+offybottom))
-	path.Add2(Pxy(p3.X-offx, p3.Y+offybottom), P(p3))
+	path.QuadTo(Pxy(p4.X+offx, p4.Y+offybottom), Pxy((p4.X+p3.X)/2, p4.Y+offybottom))
+	path.QuadTo(Pxy(p3.X-offx, p3.Y+offybottom), pixel(p3))
 	// ...right side...
-	path.Add1(P(p2))
+	path.LineTo(pixel(p2))
 	// ...top curve
-	path.Add2(Pxy(p2.X-offx, p2.Y-offytop), Pxy((p1.X+p2.X)/2, p2.Y-offytop))
-	path.Add2(Pxy(p1.X+offx, p1.Y-offytop), P(p1))
+	path.QuadTo(Pxy(p2.X-offx, p2.Y-offytop), Pxy((p1.X+p2.X)/2, p2.Y-offytop))
+	path.QuadTo(Pxy(p1.X+offx, p1.Y-offytop), pixel(p1))
 	if forStroke {
 		// additional "3d" effect at the top - a down-bent curve
-		path.Add2(Pxy(p1.X+offx, p1.Y+offytop), Pxy((p1.X+p2.X)/2, p1.Y+offytop))
-		path.Add2(Pxy(p2.X-offx, p2.Y+offytop), P(p2))
+		path.QuadTo(Pxy(p1.X+offx, p1.Y+offytop), Pxy((p1.X+p2.X)/2, p1.Y+offytop))
+		path.QuadTo(Pxy(p2.X-offx, p2.Y+offytop), pixel(p2))
 	}
 	return path
 }
 
-func getCellEdgePointBetween(pointInCell, otherPoint Point, g Grid) Point {
-	if pointInCell == otherPoint {
-		panic("the two points cannot be the same")
-	}
+// getCellEdgePointBetween returns the point where the line from pointInCell
+// to otherPoint leaves the cell. Fails if the points coincide, as the line
+// has no direction then.
+func getCellEdgePointBetween(pointInCell, otherPoint Point, g Grid) (Point, error) {
 	cell := g.CellFor(pointInCell)
 	switch {
 	case otherPoint.NorthOf(pointInCell):
-		return Point{X: pointInCell.X, Y: float64(g.CellMinY(cell))}
+		return Point{X: pointInCell.X, Y: float64(g.CellMinY(cell))}, nil
 	case otherPoint.SouthOf(pointInCell):
-		return Point{X: pointInCell.X, Y: float64(g.CellMaxY(cell))}
+		return Point{X: pointInCell.X, Y: float64(g.CellMaxY(cell))}, nil
 	case otherPoint.WestOf(pointInCell):
-		return Point{X: float64(g.CellMinX(cell)), Y: pointInCell.Y}
+		return Point{X: float64(g.CellMinX(cell)), Y: pointInCell.Y}, nil
 	case otherPoint.EastOf(pointInCell):
-		return Point{X: float64(g.CellMaxX(cell)), Y: pointInCell.Y}
+		return Point{X: float64(g.CellMaxX(cell)), Y: pointInCell.Y}, nil
 	}
-	panic("should not reach")
+	return Point{}, fmt.Errorf("cannot round corner at %v, %v: it coincides with the next point", pointInCell.X, pointInCell.Y)
 }
 
-func (s *Shape) MakeIntoRenderPath(g Grid, forStroke bool /*, opt Options*/) raster.Path {
+// DegenerateCorners returns the indexes of the round corners of the shape
+// which coincide with a neighbouring point, so that they can't be rounded.
+// Shapes with such corners are not drawn.
+func (s *Shape) DegenerateCorners(g Grid) []int {
+	found := []int{}
+	n := len(s.Points)
+	for i, p := range s.Points {
+		if p.Type != POINT_ROUND {
+			continue
+		}
+		_, err1 := getCellEdgePointBetween(p, s.Points[(i+n-1)%n], g)
+		_, err2 := getCellEdgePointBetween(p, s.Points[(i+1)%n], g)
+		if err1 != nil || err2 != nil {
+			found = append(found, i)
+		}
+	}
+	return found
+}
+
+func (s *Shape) MakeIntoRenderPath(g Grid, forStroke bool /*, opt Options*/) *Path {
 	if s.Type == TYPE_POINT_MARKER {
-		panic("please handle markers separately")
+		// drawn separately, see MakeMarkerPaths
 		return nil
-		//return s.makeMarkerPath(g)
+	}
+	if s.Type == TYPE_LINE_HOP {
+		return s.makeHopPath(g)
 	}
 	if len(s.Points) == 4 {
 		switch s.Type {
@@ -374,20 +406,64 @@ func (s *Shape) MakeIntoRenderPath(g Grid, forStroke bool /*, opt Options*/) ras
 	return s.makeOtherPath(g)
 }
 
-func (s *Shape) makeOtherPath(g Grid) raster.Path {
-	if len(s.Points) < 2 {
+// makeHopPath draws a line between the two points of the shape, with a
+// half-circle arc over the vertical line halfway.
+func (s *Shape) makeHopPath(g Grid) *Path {
+	if len(s.Points) != 2 {
+		return nil
+	}
+	p1, p2 := pixel(s.Points[0]), pixel(s.Points[1])
+	x, y := (p1.X+p2.X)/2, p1.Y
+	r := float64(g.CellW) * 0.5
+	Pxy := func(x, y float64) Point { return Point{X: x, Y: y} }
+
+	path := &Path{}
+	path.MoveTo(p1)
+	path.LineTo(Pxy(x-r, y))
+	path.QuadTo(Pxy(x-r, y-r), Pxy(x, y-r))
+	path.QuadTo(Pxy(x+r, y-r), Pxy(x+r, y))
+	path.LineTo(p2)
+	return path
+}
+
+// makeDashedHopPaths splits the path of a dashed line hop into the straight
+// parts, and the arc. The arc is about as long as a dash, so it's drawn
+// solid, or it could end up all in a gap.
+func (s *Shape) makeDashedHopPaths(g Grid) (straight, arc *Path) {
+	if len(s.Points) != 2 {
+		return nil, nil
+	}
+	p1, p2 := pixel(s.Points[0]), pixel(s.Points[1])
+	x, y := (p1.X+p2.X)/2, p1.Y
+	r := float64(g.CellW) * 0.5
+	Pxy := func(x, y float64) Point { return Point{X: x, Y: y} }
+
+	straight = &Path{}
+	straight.MoveTo(p1)
+	straight.LineTo(Pxy(x-r, y))
+	straight.MoveTo(p2)
+	straight.LineTo(Pxy(x+r, y))
+	arc = &Path{}
+	arc.MoveTo(Pxy(x-r, y))
+	arc.QuadTo(Pxy(x-r, y-r), Pxy(x, y-r))
+	arc.QuadTo(Pxy(x+r, y-r), Pxy(x+r, y))
+	return straight, arc
+}
+
+func (s *Shape) makeOtherPath(g Grid) *Path {
+	if len(s.Points) < 2 || len(s.DegenerateCorners(g)) > 0 {
 		return nil
 	}
-	path := raster.Path{}
+	path := &Path{}
 	point, prev, next := s.Points[0], s.Points[len(s.Points)-1], s.Points[1]
 	switch point.Type {
 	case POINT_NORMAL:
-		path.Start(P(point))
+		path.MoveTo(pixel(point))
 	case POINT_ROUND:
-		entry := getCellEdgePointBetween(point, prev, g)
-		exit := getCellEdgePointBetween(point, next, g)
-		path.Start(P(entry))
-		path.Add2(P(point), P(exit))
+		entry, _ := getCellEdgePointBetween(point, prev, g)
+		exit, _ := getCellEdgePointBetween(point, next, g)
+		path.MoveTo(pixel(entry))
+		path.QuadTo(pixel(point), pixel(exit))
 	}
 	for i := 1; i < len(s.Points); i++ {
 		prev = point
@@ -399,12 +475,12 @@ func (s *Shape) makeOtherPath(g Grid) raster.Path {
 		}
 		switch point.Type {
 		case POINT_NORMAL:
-			path.Add1(P(point))
+			path.LineTo(pixel(point))
 		case POINT_ROUND:
-			entry := getCellEdgePointBetween(point, prev, g)
-			exit := getCellEdgePointBetween(point, next, g)
-			path.Add1(P(entry))
-			path.Add2(P(point), P(exit))
+			entry, _ := getCellEdgePointBetween(point, prev, g)
+			exit, _ := getCellEdgePointBetween(point, next, g)
+			path.LineTo(pixel(entry))
+			path.QuadTo(pixel(point), pixel(exit))
 		}
 	}
 	if s.Closed && len(s.Points) > 2 {
@@ -412,10 +488,10 @@ func (s *Shape) makeOtherPath(g Grid) raster.Path {
 		point = s.Points[0]
 		switch point.Type {
 		case POINT_NORMAL:
-			path.Add1(P(point))
+			path.LineTo(pixel(point))
 		case POINT_ROUND:
-			entry := getCellEdgePointBetween(point, prev, g)
-			path.Add1(P(entry))
+			entry, _ := getCellEdgePointBetween(point, prev, g)
+			path.LineTo(pixel(entry))
 		}
 	}
 	return path
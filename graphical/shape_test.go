@@ -0,0 +1,31 @@
+package graphical
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDegenerateCorners(t *testing.T) {
+	g := Grid{CellW: 10, CellH: 14}
+	round := func(x, y float64) Point { return Point{X: x, Y: y, Type: POINT_ROUND} }
+	normal := func(x, y float64) Point { return Point{X: x, Y: y} }
+	tests := []struct {
+		points   []Point
+		expected []int
+	}{
+		{[]Point{round(5, 7), round(45, 7), round(45, 35), round(5, 35)}, []int{}},
+		{[]Point{round(5, 7), round(5, 7), normal(45, 35), normal(5, 35)}, []int{0, 1}},
+		{[]Point{normal(5, 7), normal(5, 7), normal(45, 35)}, []int{}},
+	}
+	for _, tt := range tests {
+		s := NewShape(tt.points...)
+		s.Closed = true
+		got := s.DegenerateCorners(g)
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%v: got degenerate corners %v, expected %v", tt.points, got, tt.expected)
+		}
+		if path := s.MakeIntoRenderPath(g, false); (path == nil) != (len(got) > 0) {
+			t.Errorf("%v: got render path %v", tt.points, path)
+		}
+	}
+}
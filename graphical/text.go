@@ -0,0 +1,127 @@
+package graphical
+
+import (
+	"image"
+	"image/draw"
+	"math"
+
+	"github.com/akavel/ditaa/fontmeasure"
+
+	"github.com/golang/freetype"
+	xfont "golang.org/x/image/font"
+)
+
+// italicSlant is the horizontal shift per pixel of height, for synthesized
+// italics.
+const italicSlant = 0.2
+
+// drawLabel lays out the label's styled runs one after another.
+func drawLabel(c Canvas, label Label, family *fontmeasure.Family) {
+	base := fontmeasure.Font{Font: family.Regular, DPI: 72, Size: label.FontSize, Family: family}
+	x := label.X
+	if label.OnLine {
+		// knock the line out from behind the text, matching the
+		// background on either side of the line
+		r := label.BoundsFor(&base)
+		pad := label.FontSize / 4
+		r.Min.X -= pad
+		r.Max.X += pad
+		before, after := r, r
+		if label.LineVertical {
+			at := math.Max(r.Min.X, math.Min(label.LineAt, r.Max.X))
+			before.Max.X, after.Min.X = at, at
+		} else {
+			at := math.Max(r.Min.Y, math.Min(label.LineAt, r.Max.Y))
+			before.Max.Y, after.Min.Y = at, at
+		}
+		for _, part := range []struct {
+			r          Rect
+			background *Color
+		}{{before, label.Background}, {after, label.BackgroundAfter}} {
+			if part.r.Min.X >= part.r.Max.X || part.r.Min.Y >= part.r.Max.Y {
+				continue
+			}
+			background := WHITE
+			if part.background != nil {
+				background = *part.background
+			}
+			rectPath(part.r).AddTo(c)
+			c.Fill(background)
+		}
+	}
+	//TODO: handle outline
+	for _, run := range label.TextRuns() {
+		w := base.StyledWidthFor(run.Text, run.Style)
+		c.Text(x, label.Y, run.Text, base, run.Style, label.Color)
+		if run.Link != "" {
+			// links are underlined
+			y := label.Y + 1 + int(label.FontSize/12)
+			rectPath(Rect{
+				Min: Point{X: float64(x), Y: float64(y)},
+				Max: Point{X: float64(x + w), Y: float64(y + 1 + int(label.FontSize/24))},
+			}).AddTo(c)
+			c.Fill(label.Color)
+		}
+		x += w
+	}
+}
+
+// drawRun draws text with the baseline starting at x, y, synthesizing
+// bold and monospace styles if needed.
+func drawRun(dst draw.Image, text string, font fontmeasure.Font, synth fontmeasure.Style, x, y int, src image.Image) {
+	drawAt := func(x int) {
+		if synth&fontmeasure.STYLE_MONO == 0 {
+			drawString(dst, text, font, x, y, src)
+			return
+		}
+		pitch := font.MonoPitch()
+		for _, r := range text {
+			s := string(r)
+			offset := (pitch - font.WidthFor(s)) / 2
+			drawString(dst, s, font, x+offset, y, src)
+			x += pitch
+		}
+	}
+	drawAt(x)
+	if synth&fontmeasure.STYLE_BOLD != 0 {
+		drawAt(x + 1)
+	}
+}
+
+// drawString draws text, taking glyphs missing from the font from the
+// fallbacks of its family.
+func drawString(dst draw.Image, text string, font fontmeasure.Font, x, y int, src image.Image) {
+	for _, seg := range font.Segments(text) {
+		if tt := seg.Font.Font.TrueType(); tt != nil {
+			ctx := freetype.NewContext()
+			ctx.SetFont(tt)
+			ctx.SetFontSize(seg.Font.Size)
+			ctx.SetSrc(src)
+			ctx.SetDst(dst)
+			ctx.SetClip(dst.Bounds())
+			ctx.DrawString(seg.Text, P(Point{X: float64(x), Y: float64(y)}))
+		} else {
+			d := xfont.Drawer{
+				Dst:  dst,
+				Src:  src,
+				Face: seg.Font.Font.NewFace(seg.Font.Size, seg.Font.DPI),
+				Dot:  P(Point{X: float64(x), Y: float64(y)}),
+			}
+			d.DrawString(seg.Text)
+		}
+		x += seg.Font.WidthFor(seg.Text)
+	}
+}
+
+// drawSlanted draws text like drawRun, but sheared to the right.
+func drawSlanted(img *image.RGBA, text string, font fontmeasure.Font, synth fontmeasure.Style, x, y, w int, src image.Image) {
+	ascent := font.Ascent()
+	box := image.Rect(x, y-ascent, x+w+1, y-ascent+font.Advance())
+	mask := image.NewAlpha(box)
+	drawRun(mask, text, font, synth, x, y, image.Opaque)
+	for row := box.Min.Y; row < box.Max.Y; row++ {
+		shift := int(float64(y-row)*italicSlant + 0.5)
+		r := image.Rect(box.Min.X+shift, row, box.Max.X+shift, row+1)
+		draw.DrawMask(img, r, src, image.ZP, mask, image.Pt(box.Min.X, row), draw.Over)
+	}
+}
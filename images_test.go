@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"flag"
 	"fmt"
+	"html/template"
 	"image"
 	"image/color"
 	"image/png"
@@ -13,120 +14,301 @@ import (
 	"testing"
 )
 
-var reset = flag.Bool("reset", false, "rebuild reference images")
+// The golden images are the testdata/*.txt.png files. Most come from the
+// reference (Java) renderer, see referenceDiffs. After an intended change to
+// the rendering, list the changed images in goldenChanges and rewrite them
+// with:
+//
+//	go test -run TestGoldenImages -update
+var (
+	update    = flag.Bool("update", false, "rewrite the golden images listed in goldenChanges")
+	tolerance = flag.Int("tolerance", 16, "maximum difference of a color channel (0-255) between pixels considered equal")
+	maxDiff   = flag.Int("maxdiff", 10, "maximum number of differing pixels allowed in an image, over its referenceDiffs")
+	goldenOut = flag.String("golden-out", "tmp/golden", "directory for rendered and diff images, and report.html, of failed comparisons")
+)
 
-func init() {
-	flag.Parse()
+// goldenChanges lists the golden images rendered by this program, with the
+// reason they differ from the reference ones. Only these are rewritten by
+// -update.
+var goldenChanges = map[string]string{
+	"art1.txt":             "user-044: knockout behind X and Y written across lines",
+	"art2.txt":             "user-031: bullet text at its column, with a hanging indent",
+	"art2_5.txt":           "user-031: bullet text at its column, with a hanging indent",
+	"bug14.txt":            "user-031: bullet text at its column, with a hanging indent",
+	"art_text.txt":         "user-031: bullets, and lines in a shape as one left-aligned paragraph",
+	"bug17.txt":            "user-031: 1 and x in the shape as one left-aligned paragraph",
+	"art21.txt":            "user-038: new, no reference image",
+	"line_hops.txt":        "user-042: new, line hops",
+	"line_decorations.txt": "user-043: new, line end decorations",
+	"text_on_lines.txt":    "user-044: new, text on lines",
+	"links.txt":            "user-046: new, id and link tags",
 }
 
-func TestImageResults(test *testing.T) {
-	test.Skip("FIXME(akavel): shows stupid diffs in corners of rectangles :/")
+// referenceDiffs holds, for the golden images from the reference renderer,
+// how many pixels the baseline (509079e) renders differently at the default
+// tolerance, mostly in text, which the reference draws hinted and bolder.
+var referenceDiffs = map[string]int{
+	"art10.txt":           7549,
+	"art11.txt":           66,
+	"art12.txt":           65,
+	"art13.txt":           17,
+	"art14.txt":           544,
+	"art15.txt":           15,
+	"art16.txt":           181,
+	"art17.txt":           3016,
+	"art18.txt":           3509,
+	"art19.txt":           4,
+	"art20.txt":           3296,
+	"art3.txt":            32,
+	"art3_5.txt":          34,
+	"art4.txt":            10,
+	"art5.txt":            1622,
+	"art6.txt":            42,
+	"art7.txt":            34,
+	"art8.txt":            718,
+	"bug1.txt":            578,
+	"bug10.txt":           238,
+	"bug11.txt":           158,
+	"bug12.txt":           38,
+	"bug13.txt":           6,
+	"bug15.txt":           56,
+	"bug16.txt":           9647,
+	"bug18.txt":           420,
+	"bug2.txt":            634,
+	"bug3.txt":            906,
+	"bug4.txt":            560,
+	"bug5.txt":            517,
+	"bug6.txt":            768,
+	"bug7.txt":            693,
+	"bug8.txt":            630,
+	"bug9.txt":            494,
+	"bug9_5.txt":          458,
+	"color_codes.txt":     1762,
+	"corner_case01.txt":   992,
+	"corner_case02.txt":   776,
+	"ditaa_bug.txt":       21011,
+	"ditaa_bug2.txt":      5561,
+	"logo.txt":            140,
+	"simple_S01.txt":      27,
+	"simple_U01.txt":      16,
+	"simple_square01.txt": 10,
+}
 
-	err := filepath.Walk("orig-java/tests/text", func(path string, info os.FileInfo, err error) error {
-		switch {
-		case err != nil:
-			return err
-		case info.IsDir():
-			return nil
-		case filepath.Ext(info.Name()) != ".txt":
-			return nil
+func TestGoldenChanges(t *testing.T) {
+	for name := range goldenChanges {
+		_, err := os.Stat(filepath.Join("testdata", name+".png"))
+		if err != nil {
+			t.Error(err)
+		}
+		if _, ok := referenceDiffs[name]; ok {
+			t.Errorf("%s: listed in both goldenChanges and referenceDiffs", name)
 		}
+	}
+	for _, path := range corpusFiles(t) {
+		name := filepath.Base(path)
+		_, changed := goldenChanges[name]
+		_, reference := referenceDiffs[name]
+		if !changed && !reference {
+			t.Errorf("%s: listed in neither goldenChanges nor referenceDiffs", name)
+		}
+	}
+}
+
+type goldenCase struct {
+	Name     string
+	Source   string
+	Expected string // paths relative to the report
+	Rendered string
+	Diff     string
+	Status   string
+	Failed   bool
+}
 
-		r, err := os.Open(path)
+func TestGoldenImages(t *testing.T) {
+	outDir, err := filepath.Abs(*goldenOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel := func(path string) string {
+		abs, _ := filepath.Abs(path)
+		r, err := filepath.Rel(outDir, abs)
 		if err != nil {
-			test.Error(err)
-			return nil
+			return abs
 		}
-		defer r.Close()
+		return filepath.ToSlash(r)
+	}
 
-		w := bytes.NewBuffer(nil)
-		err = RenderPNG(r, w)
+	cases := []goldenCase{}
+	failed := 0
+	for _, path := range corpusFiles(t) {
+		source, err := ioutil.ReadFile(path)
 		if err != nil {
-			test.Errorf("%s: %s", path, err)
-			return nil
+			t.Fatal(err)
+		}
+		rendered := renderFile(t, path, DefaultConversionOptions())
+		golden := path + ".png"
+		name := filepath.Base(path)
+		_, changed := goldenChanges[name]
+		if *update && changed {
+			err = ioutil.WriteFile(golden, rendered, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			continue
 		}
 
-		fname, ext := info.Name(), filepath.Ext(info.Name())
-		fname = fname[:len(fname)-len(ext)]
-		fname = filepath.Join("testdata", fname+".png")
-		if *reset {
-			os.MkdirAll("testdata", 0755)
-			ioutil.WriteFile(fname, w.Bytes(), 0644)
+		c := goldenCase{Name: name, Source: string(source), Expected: rel(golden)}
+		diff, n, err := diffImages(golden, rendered, uint32(*tolerance))
+		limit := referenceDiffs[name] + *maxDiff
+		switch {
+		case err != nil:
+			c.Status = err.Error()
+			c.Failed = true
+		case n > limit:
+			c.Status = fmt.Sprintf("%d pixels differ, limit %d", n, limit)
+			c.Failed = true
+		case n > 0:
+			c.Status = fmt.Sprintf("%d pixels differ, within limit %d", n, limit)
+		default:
+			c.Status = "ok"
 		}
-		err = diffimg(fname, w)
-		if err != nil {
-			test.Errorf("%s: %s", path, err)
-			return nil
+		if c.Failed {
+			failed++
+			os.MkdirAll(outDir, 0755)
+			c.Rendered = name + ".png"
+			err = ioutil.WriteFile(filepath.Join(outDir, c.Rendered), rendered, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff != nil {
+				c.Diff = name + "-diff.png"
+				err = writePNG(filepath.Join(outDir, c.Diff), diff)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			t.Errorf("%s: %s, see %s", path, c.Status, filepath.Join(outDir, "report.html"))
 		}
-		return nil
-	})
+		cases = append(cases, c)
+	}
+	if *update || failed == 0 {
+		return
+	}
+
+	buf := bytes.NewBuffer(nil)
+	err = reportTemplate.Execute(buf, struct {
+		Cases              []goldenCase
+		Failed             int
+		Tolerance, MaxDiff int
+	}{cases, failed, *tolerance, *maxDiff})
 	if err != nil {
-		test.Error(err)
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(outDir, "report.html"), buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
 	}
 }
 
-func diffimg(path string, buf *bytes.Buffer) error {
+// diffImages compares the PNG image in file path with the rendered one. It
+// returns the number of pixels differing by more than tolerance in any
+// channel, and an image showing them in magenta over a faded copy of the
+// expected image.
+func diffImages(path string, rendered []byte, tolerance uint32) (*image.RGBA, int, error) {
 	r, err := os.Open(path)
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
 	defer r.Close()
 	oldImg, err := png.Decode(r)
 	if err != nil {
-		return fmt.Errorf("decoding %s: %s", path, err)
+		return nil, 0, fmt.Errorf("decoding %s: %s", path, err)
 	}
-	newBytes := buf.Bytes()
-	newImg, err := png.Decode(buf)
+	newImg, err := png.Decode(bytes.NewReader(rendered))
 	if err != nil {
-		return fmt.Errorf("decoding rendered PNG: %s", err)
+		return nil, 0, fmt.Errorf("decoding rendered PNG: %s", err)
 	}
 
-	// Compare the images.
-	bounds := oldImg.Bounds()
-	if newImg.Bounds() != bounds {
-		return fmt.Errorf("bounds differ, expected %v, got %v", bounds, newImg.Bounds())
-	}
-	var diff *image.RGBA
+	bounds := oldImg.Bounds().Union(newImg.Bounds())
+	diff := image.NewRGBA(bounds)
+	n := 0
 	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
 		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			oldpx := oldImg.At(x, y)
-			newpx := newImg.At(x, y)
-			if !colorsEqual(oldpx, newpx) {
-				// Difference - draw it in "pink" color.
-				if diff == nil {
-					diff = image.NewRGBA(bounds)
-				}
+			p := image.Pt(x, y)
+			if !p.In(oldImg.Bounds()) || !p.In(newImg.Bounds()) {
+				n++
+				diff.Set(x, y, color.RGBA{255, 0, 255, 255})
+				continue
+			}
+			oldpx, newpx := oldImg.At(x, y), newImg.At(x, y)
+			if !colorsClose(oldpx, newpx, tolerance) {
+				n++
 				diff.Set(x, y, color.RGBA{255, 0, 255, 255})
+				continue
 			}
+			gray := color.GrayModel.Convert(oldpx).(color.Gray)
+			gray.Y = 192 + gray.Y/4
+			diff.Set(x, y, gray)
 		}
 	}
-	// If images are different, write "difference mask" to testdata/*-diff.png, and
-	// "bad image" to testdata/*-testfail.png
-	if diff != nil {
-		fname, ext := filepath.Base(path), filepath.Ext(path)
-		fname = fname[:len(fname)-len(ext)]
-		diffname, outname := "testdata/"+fname+"-diff.png", "testdata/"+fname+"-testfail.png"
-		diffbuf := bytes.NewBuffer(nil)
-		err := png.Encode(diffbuf, diff)
-		if err != nil {
-			return fmt.Errorf("cannot encode %s: %s", diffname, err)
-		}
-		err = ioutil.WriteFile(diffname, diffbuf.Bytes(), 0644)
-		if err != nil {
-			return err
-		}
-		err = ioutil.WriteFile(outname, newBytes, 0644)
-		if err != nil {
-			return err
-		}
-		return fmt.Errorf("rendered image differs from %s, mask written to %s, image to %s",
-			path, diffname, outname)
+	if oldImg.Bounds() != newImg.Bounds() {
+		err = fmt.Errorf("bounds differ, expected %v, got %v", oldImg.Bounds(), newImg.Bounds())
 	}
-	return nil
+	if n == 0 {
+		diff = nil
+	}
+	return diff, n, err
 }
 
-func colorsEqual(c1, c2 color.Color) bool {
+// colorsClose checks if no channel of the colors differs by more than
+// tolerance, on a scale of 0-255.
+func colorsClose(c1, c2 color.Color, tolerance uint32) bool {
 	r1, g1, b1, a1 := c1.RGBA()
 	r2, g2, b2, a2 := c2.RGBA()
-	return r1 == r2 && g1 == g2 && b1 == b2 && a1 == a2
+	near := func(v1, v2 uint32) bool {
+		v1, v2 = v1>>8, v2>>8
+		if v1 > v2 {
+			return v1-v2 <= tolerance
+		}
+		return v2-v1 <= tolerance
+	}
+	return near(r1, r2) && near(g1, g2) && near(b1, b2) && near(a1, a2)
 }
+
+func writePNG(path string, img image.Image) error {
+	buf := bytes.NewBuffer(nil)
+	err := png.Encode(buf, img)
+	if err != nil {
+		return fmt.Errorf("cannot encode %s: %s", path, err)
+	}
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>ditaa golden images</title>
+<style>
+body { font-family: sans-serif; }
+td { vertical-align: top; border-top: 1px solid #ccc; padding: 8px; }
+tr.failed td:first-child { background: #fdd; }
+pre { font-size: 12px; }
+</style>
+</head>
+<body>
+<h1>ditaa golden images</h1>
+<p>{{.Failed}} of {{len .Cases}} images differ by more than {{.MaxDiff}} pixels
+over their limit (channel tolerance {{.Tolerance}}).</p>
+<table>
+<tr><th>source</th><th>expected</th><th>rendered</th><th>diff</th></tr>
+{{range .Cases}}<tr{{if .Failed}} class="failed"{{end}}>
+<td><b>{{.Name}}</b>: {{.Status}}<pre>{{.Source}}</pre></td>
+<td><img src="{{.Expected}}"></td>
+<td>{{if .Rendered}}<img src="{{.Rendered}}">{{end}}</td>
+<td>{{if .Diff}}<img src="{{.Diff}}">{{end}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// lintEntry is a single finding of the lint command, in a form suitable for
+// consumption by editors and other tools.
+type lintEntry struct {
+	File     string   `json:"file"`
+	Line     int      `json:"line"`
+	Col      int      `json:"column"`
+	Severity Severity `json:"severity"`
+	Code     string   `json:"code"`
+	Message  string   `json:"message"`
+}
+
+// lintMain implements the "ditaa lint FILE..." command. It runs the
+// recognition pipeline on each file without rendering, and prints all
+// findings to stdout, as a JSON array or in the compiler style. Returns the
+// process exit code: 0 if nothing was found, 1 if there were errors (or
+// warnings, with -strict), 2 if some file couldn't be read.
+func lintMain(args []string) int {
+	return lint(args, os.Stdout, os.Stderr)
+}
+
+func lint(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("lint", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	encoding := flags.String("encoding", "auto", "encoding of the FILEs: auto, utf-8, utf-16, utf-16le, utf-16be, latin1 or windows-1252")
+	format := flags.String("format", "json", "output format: json, or text for file:line:col: warning: message lines")
+	strict := flags.Bool("strict", false, "exit with 1 if any warnings are found, not only errors")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "USAGE: %s lint [OPTIONS] FILE...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 || (*format != "json" && *format != "text") {
+		flags.Usage()
+		return 2
+	}
+	opt := DefaultConversionOptions()
+	opt.Processing.Encoding, err = ParseEncoding(*encoding)
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %s\n", err)
+		return 2
+	}
+
+	entries := []lintEntry{}
+	status := 0
+	for _, path := range flags.Args() {
+		diags, err := lintFile(path, opt)
+		if err != nil {
+			fmt.Fprintf(stderr, "error: %s\n", err)
+			status = 2
+			continue
+		}
+		if *format == "text" {
+			diags.Print(stdout, path)
+		}
+		for _, d := range diags.List {
+			entries = append(entries, lintEntry{
+				File:     path,
+				Line:     d.Line,
+				Col:      d.Col,
+				Severity: d.Severity,
+				Code:     d.Code,
+				Message:  d.Message,
+			})
+			if status == 0 && (d.Severity == SEVERITY_ERROR || *strict) {
+				status = 1
+			}
+		}
+	}
+
+	if *format == "json" {
+		err = json.NewEncoder(stdout).Encode(entries)
+		if err != nil {
+			fmt.Fprintf(stderr, "error: %s\n", err)
+			return 2
+		}
+	}
+	return status
+}
+
+func lintFile(path string, opt ConversionOptions) (*Diagnostics, error) {
+	r, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	diags := &Diagnostics{}
+	grid := NewTextGrid(0, 0)
+	directives, err := grid.LoadFrom(r, opt.Processing, diags)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	directives.Apply(&opt, diags)
+	NewDiagram(grid, opt, diags)
+	diags.Sort()
+	return diags, nil
+}
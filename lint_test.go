@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ditaa-lint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	clean, gap := filepath.Join(dir, "clean.txt"), filepath.Join(dir, "gap.txt")
+	ioutil.WriteFile(clean, []byte("+---+\n| a |\n+---+\n"), 0644)
+	ioutil.WriteFile(gap, []byte("+---+\n| a |\n+-- +\n"), 0644)
+
+	tests := []struct {
+		args   []string
+		status int
+		output string
+	}{
+		{[]string{clean}, 0, "[]\n"},
+		{[]string{"-strict", clean}, 0, "[]\n"},
+		{[]string{gap}, 0, `[{"file":"` + gap + `","line":3,"column":4,"severity":"warning","code":"line-gap",` +
+			`"message":"gap in line, shape may be unclosed because of a stray space"}]` + "\n"},
+		{[]string{"-format", "text", gap, clean}, 0, gap + ":3:4: warning: gap in line, shape may be unclosed because of a stray space\n"},
+		{[]string{"-strict", "-format", "text", clean, gap}, 1, gap + ":3:4: warning: gap in line, shape may be unclosed because of a stray space\n"},
+		{[]string{"-strict", filepath.Join(dir, "none.txt")}, 2, "[]\n"},
+		{[]string{"-format", "xml", clean}, 2, ""},
+	}
+	for _, tt := range tests {
+		stdout, stderr := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+		status := lint(tt.args, stdout, stderr)
+		if status != tt.status {
+			t.Errorf("%v: got exit code %d, expected %d; stderr:\n%s", tt.args, status, tt.status, stderr.String())
+		}
+		if stdout.String() != tt.output {
+			t.Errorf("%v: got output:\n%s\nexpected:\n%s", tt.args, stdout.String(), tt.output)
+		}
+	}
+
+	// the JSON output is an array of entries even for a single file
+	stdout := bytes.NewBuffer(nil)
+	lint([]string{gap}, stdout, ioutil.Discard)
+	entries := []lintEntry{}
+	err = json.Unmarshal(stdout.Bytes(), &entries)
+	if err != nil || len(entries) != 1 || entries[0].Code != DIAG_LINE_GAP || !strings.HasSuffix(entries[0].File, "gap.txt") {
+		t.Errorf("got JSON %s, unmarshalled to %+v, %v", stdout.String(), entries, err)
+	}
+}
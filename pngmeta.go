@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+)
+
+// pngText is a text chunk of a PNG image, under a keyword like the Title or
+// Description defined by the PNG specification.
+type pngText struct {
+	Keyword, Text string
+	// Compressed text is always stored in an iTXt chunk.
+	Compressed bool
+}
+
+// Keywords of the text chunks holding what is needed to render the image
+// again, and the renderHash of it.
+const (
+	PNG_KEYWORD_SOURCE  = "ditaa:source"
+	PNG_KEYWORD_OPTIONS = "ditaa:options"
+	PNG_KEYWORD_HASH    = "ditaa:hash"
+)
+
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// pngHeaderSize is the size of the PNG signature and of the IHDR chunk,
+// which must come first in the image.
+const pngHeaderSize = 8 + 4 + 4 + 13 + 4
+
+// insertPNGText adds text chunks to an encoded PNG image, right after its
+// header. Text is stored in a tEXt chunk if it fits in Latin-1 and is not
+// compressed, and in an iTXt chunk as UTF-8 otherwise.
+func insertPNGText(img []byte, texts []pngText) ([]byte, error) {
+	if len(img) < pngHeaderSize || string(img[12:16]) != "IHDR" {
+		return nil, errors.New("not a PNG image")
+	}
+	buf := bytes.NewBuffer(nil)
+	buf.Write(img[:pngHeaderSize])
+	for _, t := range texts {
+		typ, data := t.chunk()
+		writePNGChunk(buf, typ, data)
+	}
+	buf.Write(img[pngHeaderSize:])
+	return buf.Bytes(), nil
+}
+
+// readPNGText returns the tEXt and iTXt chunks of an encoded PNG image.
+func readPNGText(img []byte) ([]pngText, error) {
+	if len(img) < pngHeaderSize || string(img[:8]) != pngSignature {
+		return nil, errors.New("not a PNG image")
+	}
+	texts := []pngText{}
+	for rest := img[8:]; len(rest) >= 12; {
+		n := binary.BigEndian.Uint32(rest)
+		if uint64(n) > uint64(len(rest)-12) {
+			return nil, errors.New("truncated PNG chunk")
+		}
+		typ, data := string(rest[4:8]), rest[8:8+n]
+		rest = rest[12+n:]
+		nul := bytes.IndexByte(data, 0)
+		if nul < 0 {
+			continue
+		}
+		keyword, text := data[:nul], data[nul+1:]
+		switch {
+		case typ == "tEXt":
+			runes := make([]rune, len(text))
+			for i, b := range text {
+				runes[i] = rune(b)
+			}
+			texts = append(texts, pngText{Keyword: string(keyword), Text: string(runes)})
+		case typ == "iTXt" && len(text) >= 2:
+			// skip the compression method, language tag and translated keyword
+			fields := bytes.SplitN(text[2:], []byte{0}, 3)
+			if len(fields) != 3 {
+				continue
+			}
+			t := pngText{Keyword: string(keyword), Text: string(fields[2]), Compressed: text[0] != 0}
+			if t.Compressed {
+				z, err := zlib.NewReader(bytes.NewReader(fields[2]))
+				if err != nil {
+					return nil, err
+				}
+				inflated, err := ioutil.ReadAll(z)
+				if err != nil {
+					return nil, err
+				}
+				t.Text = string(inflated)
+			}
+			texts = append(texts, t)
+		}
+	}
+	return texts, nil
+}
+
+func (t pngText) chunk() (typ string, data []byte) {
+	if t.Compressed {
+		data = append([]byte(t.Keyword), 0, 1, 0, 0, 0)
+		buf := bytes.NewBuffer(data)
+		z := zlib.NewWriter(buf)
+		z.Write([]byte(t.Text))
+		z.Close()
+		return "iTXt", buf.Bytes()
+	}
+	data = append([]byte(t.Keyword), 0)
+	for _, r := range t.Text {
+		if r > 0xff {
+			// not compressed, no language tag nor translated keyword
+			data = append([]byte(t.Keyword), 0, 0, 0, 0, 0)
+			return "iTXt", append(data, t.Text...)
+		}
+		data = append(data, byte(r))
+	}
+	return "tEXt", data
+}
+
+func writePNGChunk(buf *bytes.Buffer, typ string, data []byte) {
+	binary.Write(buf, binary.BigEndian, uint32(len(data)))
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(typ))
+	crc.Write(data)
+	buf.WriteString(typ)
+	buf.Write(data)
+	binary.Write(buf, binary.BigEndian, crc.Sum32())
+}
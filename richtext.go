@@ -0,0 +1,123 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/akavel/ditaa/fontmeasure"
+	"github.com/akavel/ditaa/graphical"
+)
+
+// styleMarkers are the characters which toggle text style when they
+// surround a word or phrase, like *this*.
+var styleMarkers = map[rune]fontmeasure.Style{
+	'*': fontmeasure.STYLE_BOLD,
+	'_': fontmeasure.STYLE_ITALIC,
+}
+
+const monoMarker = '`'
+
+// parseRichText splits text with inline markup into styled runs. Supported
+// are *bold*, _italic_, `monospace` and [text](url) links. Markup which is
+// not properly closed is kept as literal text. The returned plain text is
+// the concatenation of all runs.
+func parseRichText(s string) (plain string, runs []graphical.TextRun) {
+	rs := []rune(s)
+	runs = appendRichRuns(nil, rs, 0, "")
+	styled := false
+	for _, r := range runs {
+		plain += r.Text
+		if r.Style != fontmeasure.STYLE_REGULAR || r.Link != "" {
+			styled = true
+		}
+	}
+	if !styled {
+		return s, nil
+	}
+	return plain, runs
+}
+
+func appendRichRuns(runs []graphical.TextRun, rs []rune, style fontmeasure.Style, link string) []graphical.TextRun {
+	text := []rune{}
+	flush := func() {
+		if len(text) > 0 {
+			runs = append(runs, graphical.TextRun{Text: string(text), Style: style, Link: link})
+			text = []rune{}
+		}
+	}
+	for i := 0; i < len(rs); i++ {
+		ch := rs[i]
+		switch {
+		case ch == monoMarker:
+			end := indexRune(rs, i+1, monoMarker)
+			if end <= i+1 {
+				break
+			}
+			flush()
+			runs = append(runs, graphical.TextRun{Text: string(rs[i+1 : end]), Style: style | fontmeasure.STYLE_MONO, Link: link})
+			i = end
+			continue
+		case styleMarkers[ch] != 0 && style&styleMarkers[ch] == 0 && opensMarkup(rs, i):
+			end := closingMarker(rs, i)
+			if end < 0 {
+				break
+			}
+			flush()
+			runs = appendRichRuns(runs, rs[i+1:end], style|styleMarkers[ch], link)
+			i = end
+			continue
+		case ch == '[' && link == "":
+			textEnd := indexRune(rs, i+1, ']')
+			if textEnd < 0 || textEnd+1 >= len(rs) || rs[textEnd+1] != '(' {
+				break
+			}
+			urlEnd := indexRune(rs, textEnd+2, ')')
+			if urlEnd <= textEnd+2 || textEnd == i+1 {
+				break
+			}
+			flush()
+			url := strings.TrimSpace(string(rs[textEnd+2 : urlEnd]))
+			runs = appendRichRuns(runs, rs[i+1:textEnd], style, url)
+			i = urlEnd
+			continue
+		}
+		text = append(text, ch)
+	}
+	flush()
+	return runs
+}
+
+func indexRune(rs []rune, from int, r rune) int {
+	for i := from; i < len(rs); i++ {
+		if rs[i] == r {
+			return i
+		}
+	}
+	return -1
+}
+
+// opensMarkup checks if the marker at i starts a styled phrase: it must
+// not be inside a word, and must be followed by a non-blank character.
+func opensMarkup(rs []rune, i int) bool {
+	if i > 0 && isWordRune(rs[i-1]) {
+		return false
+	}
+	return i+1 < len(rs) && !unicode.IsSpace(rs[i+1]) && rs[i+1] != rs[i]
+}
+
+// closingMarker finds the marker closing the phrase opened at i, which must
+// follow a non-blank character and not be followed by a word character.
+func closingMarker(rs []rune, i int) int {
+	for j := i + 2; j < len(rs); j++ {
+		if rs[j] != rs[i] || unicode.IsSpace(rs[j-1]) {
+			continue
+		}
+		if j+1 < len(rs) && isWordRune(rs[j+1]) {
+			continue
+		}
+		return j
+	}
+	return -1
+}
+
+func isWordRune(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }
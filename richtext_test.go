@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/akavel/ditaa/fontmeasure"
+)
+
+func TestParseRichText(t *testing.T) {
+	tests := []struct {
+		input, plain string
+		runs         string // runs as text, with style flags and link
+	}{
+		{"plain text", "plain text", ""},
+		{"a *bold* word", "a bold word", "a |bold:b| word"},
+		{"_it_ and `x*y*`", "it and x*y*", "it:i| and |x*y*:m"},
+		{"*bold _both_ bold*", "bold both bold", "bold :b|both:bi| bold:b"},
+		{"_*both*_", "both", "both:bi"},
+		{"[docs](http://x/y)", "docs", "docs::http://x/y"},
+		{"see [*the* docs]( http://x )", "see the docs", "see |the:b:http://x| docs::http://x"},
+		// unbalanced or misplaced markers are literal
+		{"*open", "*open", ""},
+		{"close*", "close*", ""},
+		{"2 * 3 * 4", "2 * 3 * 4", ""},
+		{"*a _b* c_", "a _b c_", "a _b:b| c_"},
+		{"snake_case_name", "snake_case_name", ""},
+		{"``", "``", ""},
+		{"[text]", "[text]", ""},
+		{"[](http://x)", "[](http://x)", ""},
+		{"[a](b", "[a](b", ""},
+	}
+	for _, tt := range tests {
+		plain, runs := parseRichText(tt.input)
+		got := []string{}
+		for _, r := range runs {
+			s := r.Text
+			flags := ""
+			if r.Style&fontmeasure.STYLE_BOLD != 0 {
+				flags += "b"
+			}
+			if r.Style&fontmeasure.STYLE_ITALIC != 0 {
+				flags += "i"
+			}
+			if r.Style&fontmeasure.STYLE_MONO != 0 {
+				flags += "m"
+			}
+			if flags != "" || r.Link != "" {
+				s += ":" + flags
+			}
+			if r.Link != "" {
+				s += ":" + r.Link
+			}
+			got = append(got, s)
+		}
+		if plain != tt.plain || strings.Join(got, "|") != tt.runs {
+			t.Errorf("%q: got %q, runs %q; expected %q, runs %q", tt.input, plain, strings.Join(got, "|"), tt.plain, tt.runs)
+		}
+	}
+}
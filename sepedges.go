@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"sort"
 
 	"github.com/akavel/polyclip-go"
 
@@ -16,6 +17,11 @@ const (
 	edgeSloped
 )
 
+// edge is a side of a shape. Sloped edges have no axis, so the methods
+// measuring along one (DistanceFromOrigin, FixDirection, PointWithin and
+// MoveInwardsBy) panic on them. They are never called on one, as
+// touchingEdgePairs leaves sloped edges out, and TouchesWith checks for
+// them before anything else.
 type edge struct {
 	start, end *graphical.Point
 	owner      *graphical.Shape
@@ -27,9 +33,34 @@ func (e edge) String() string {
 
 func separateCommonEdges(gg graphical.Grid, shapes []graphical.Shape) []graphical.Shape {
 	offset := gg.MinimumOfCellDimensions() / 5
-	edges := []edge{}
+	edges := shapeEdges(shapes)
+
+	// group edges into pairs of touching edges
+	pairs := touchingEdgePairs(edges)
 
-	// get all edges
+	moved := []edge{}
+
+	// move equivalent edges inwards
+	for _, p := range pairs {
+	edges:
+		for _, e := range p[:] {
+			for _, m := range moved {
+				if m.Equals(e) {
+					continue edges
+				}
+			}
+			// e not_in moved
+			e.MoveInwardsBy(offset)
+			moved = append(moved, e)
+		}
+	}
+
+	return shapes
+}
+
+// shapeEdges returns all edges of the shapes, sharing points with them.
+func shapeEdges(shapes []graphical.Shape) []edge {
+	edges := []edge{}
 	for i := range shapes {
 		s := &shapes[i]
 		n := len(s.Points)
@@ -51,47 +82,61 @@ func separateCommonEdges(gg graphical.Grid, shapes []graphical.Shape) []graphica
 			})
 		}
 	}
+	return edges
+}
 
-	// group edges into pairs of touching edges
-	pairs := [][2]edge{}
-
-	// all-against-all touching test for the edges
-	startIndex := 1 //skip some to avoid duplicate comparisons and self-to-self comparisons
+// edgeLine identifies the line on which an edge lies. Only edges on the
+// same line can touch.
+type edgeLine struct {
+	typ      edgeType
+	distance float64
+}
 
-	for _, edge1 := range edges {
-		for _, edge2 := range edges[startIndex:] {
-			if edge1.TouchesWith(edge2) {
-				pairs = append(pairs, [2]edge{edge1, edge2})
-				if DEBUG {
-					fmt.Println(edge1, "touches with", edge2)
-				}
-			}
+// touchingEdgePairs finds all pairs of touching edges, in the order of an
+// all-against-all comparison. Edges are only compared with others on the
+// same line; sloped edges never touch.
+func touchingEdgePairs(edges []edge) [][2]edge {
+	type indexPair struct{ i, j int }
+	found := []indexPair{}
+	lines := map[edgeLine][]int{}
+	for i, e := range edges {
+		if e.Type() == edgeSloped {
+			continue
 		}
-		startIndex++
+		line := edgeLine{e.Type(), e.DistanceFromOrigin()}
+		lines[line] = append(lines[line], i)
 	}
-
-	moved := []edge{}
-
-	// move equivalent edges inwards
-	for _, p := range pairs {
-	edges:
-		for _, e := range p[:] {
-			for _, m := range moved {
-				if m.Equals(e) {
-					continue edges
+	for _, idx := range lines {
+		for a, i := range idx {
+			for _, j := range idx[a+1:] {
+				if edges[i].TouchesWith(edges[j]) {
+					found = append(found, indexPair{i, j})
 				}
 			}
-			// e not_in moved
-			e.MoveInwardsBy(offset)
-			moved = append(moved, e)
 		}
 	}
 
-	return shapes
+	sort.Slice(found, func(a, b int) bool {
+		if found[a].i != found[b].i {
+			return found[a].i < found[b].i
+		}
+		return found[a].j < found[b].j
+	})
+	pairs := make([][2]edge, len(found))
+	for k, p := range found {
+		pairs[k] = [2]edge{edges[p.i], edges[p.j]}
+		if DEBUG {
+			fmt.Println(edges[p.i], "touches with", edges[p.j])
+		}
+	}
+	return pairs
 }
 
 func (e1 edge) TouchesWith(e2 edge) bool {
 	switch {
+	case e1.Type() == edgeSloped || e2.Type() == edgeSloped:
+		// can't be moved apart anyway
+		return false
 	case e1.Equals(e2):
 		return true
 
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"github.com/akavel/ditaa/fontmeasure"
+	"github.com/akavel/ditaa/graphical"
+)
+
+type TextAlign int
+
+const (
+	ALIGN_AUTO TextAlign = iota
+	ALIGN_LEFT
+	ALIGN_CENTER
+	ALIGN_RIGHT
+)
+
+// alignTags are markup tags which override alignment of all text in the
+// containing shape.
+var alignTags = map[string]TextAlign{
+	"left":   ALIGN_LEFT,
+	"center": ALIGN_CENTER,
+	"right":  ALIGN_RIGHT,
+}
+
+const bullet = '•'
+
+// paragraph is a block of strings in consecutive rows, overlapping
+// horizontally, and inside the same shape. Strings outside of shapes are
+// paragraphs of their own.
+type paragraph struct {
+	lines []CellStringPair
+	shape *graphical.Shape
+}
+
+func (p *paragraph) last() CellStringPair { return p.lines[len(p.lines)-1] }
+
+func (p *paragraph) isList() bool {
+	for _, l := range p.lines {
+		if []rune(l.S)[0] == bullet {
+			return true
+		}
+	}
+	return false
+}
+
+// groupParagraphs splits strings found in a text group into paragraphs.
+// shapeOf returns the shape containing given cell, or nil.
+func groupParagraphs(strs []CellStringPair, shapeOf func(Cell) *graphical.Shape) []*paragraph {
+	result := []*paragraph{}
+	for _, s := range strs {
+		shape := shapeOf(s.C)
+		var found *paragraph
+		for _, p := range result {
+			last := p.last()
+			if last.C.Y == s.C.Y-1 && shape != nil && p.shape == shape &&
+				last.C.X < s.C.X+s.W && s.C.X < last.C.X+last.W {
+				found = p
+				break
+			}
+		}
+		if found != nil {
+			found.lines = append(found.lines, s)
+			continue
+		}
+		result = append(result, &paragraph{lines: []CellStringPair{s}, shape: shape})
+	}
+	return result
+}
+
+// inferAlign guesses the alignment of a multi-line paragraph from the
+// columns where its lines start and end.
+func (p *paragraph) inferAlign() TextAlign {
+	mostCommon := func(col func(CellStringPair) int) int {
+		counts := map[int]int{}
+		best := 0
+		for _, l := range p.lines {
+			counts[col(l)]++
+			if counts[col(l)] > best {
+				best = counts[col(l)]
+			}
+		}
+		return best
+	}
+	starts := mostCommon(func(l CellStringPair) int { return l.C.X })
+	ends := mostCommon(func(l CellStringPair) int { return l.C.X + l.W })
+	switch {
+	case ends > starts:
+		return ALIGN_RIGHT
+	case starts == 1 && ends == 1:
+		// no common edge at all
+		return ALIGN_CENTER
+	case starts == len(p.lines) && ends == len(p.lines):
+		// lines of the same width, one below the other
+		return ALIGN_CENTER
+	}
+	return ALIGN_LEFT
+}
+
+// inferSingleAlign guesses the alignment of a standalone string from other
+// strings starting and ending in the same columns of the grid.
+func inferSingleAlign(grid *TextGrid, pair CellStringPair) TextAlign {
+	lastCell := Cell{pair.C.X + pair.W - 1, pair.C.Y}
+	otherStart := grid.OtherStringsStartInTheSameColumn(pair.C)
+	otherEnd := grid.OtherStringsEndInTheSameColumn(lastCell)
+	if otherStart == 0 && otherEnd == 0 {
+		return ALIGN_CENTER
+	} else if otherEnd > 0 && otherStart == 0 {
+		return ALIGN_RIGHT
+	} else if otherEnd > 0 && otherStart > 0 {
+		if otherEnd > otherStart {
+			return ALIGN_RIGHT
+		} else if otherEnd == otherStart {
+			return ALIGN_CENTER
+		}
+	}
+	return ALIGN_LEFT
+}
+
+// layoutParagraph creates labels for all lines of the paragraph. All lines
+// get the same alignment, and the same font size if there is more than one
+// line. Lines of bulleted lists are always aligned to the left, with
+// continuation lines indented to the text of the item they belong to.
+func layoutParagraph(p *paragraph, grid *TextGrid, gg graphical.Grid, font *fontmeasure.Font, align TextAlign) []graphical.Label {
+	// split bullets from the text of list items
+	type piece struct {
+		CellStringPair
+		listX int // column of left edge, for lists
+	}
+	pieces := []piece{}
+	list := p.isList()
+	itemX := -1
+	for _, l := range p.lines {
+		rs := []rune(l.S)
+		switch {
+		case !list:
+			pieces = append(pieces, piece{l, 0})
+		case rs[0] == bullet:
+			itemX = l.C.X + 1
+			pieces = append(pieces,
+				piece{CellStringPair{l.C, string(bullet), 1}, l.C.X},
+				piece{CellStringPair{Cell{itemX, l.C.Y}, string(rs[1:]), l.W - 1}, itemX})
+		case itemX >= 0 && l.C.X >= itemX:
+			// continuation of a list item, indented to the item's text
+			pieces = append(pieces, piece{l, itemX})
+		default:
+			pieces = append(pieces, piece{l, l.C.X})
+		}
+	}
+
+	// choose alignment
+	if list {
+		align = ALIGN_LEFT
+	}
+	if align == ALIGN_AUTO {
+		if len(p.lines) == 1 {
+			align = inferSingleAlign(grid, p.lines[0])
+		} else {
+			align = p.inferAlign()
+		}
+	}
+
+	// Lines of a multi-line paragraph keep their own aligned edge, and may
+	// extend up to the common opposite edge of the paragraph.
+	left, right := p.lines[0].C.X, p.lines[0].C.X+p.lines[0].W
+	for _, l := range p.lines {
+		if l.C.X < left {
+			left = l.C.X
+		}
+		if l.C.X+l.W > right {
+			right = l.C.X + l.W
+		}
+	}
+	span := func(pc piece) (minX, maxX float64) {
+		cell := graphical.Cell(pc.C)
+		minX = gg.CellMinX(cell)
+		maxX = gg.CellMaxX(graphical.Cell{cell.X + pc.W - 1, cell.Y})
+		if len(p.lines) == 1 || list {
+			return minX, maxX
+		}
+		if align != ALIGN_RIGHT {
+			maxX = gg.CellMaxX(graphical.Cell{right - 1, cell.Y})
+		}
+		if align != ALIGN_LEFT {
+			minX = gg.CellMinX(graphical.Cell{left, cell.Y})
+		}
+		return minX, maxX
+	}
+
+	// choose font size
+	labels := make([]graphical.Label, len(pieces))
+	minSize := font.Size
+	for i, pc := range pieces {
+		minX, maxX := span(pc)
+		text, runs := parseRichText(pc.S)
+		labels[i] = graphical.Label{
+			Text:     text,
+			Runs:     runs,
+			FontSize: font.Size,
+			Y:        int(gg.CellMaxY(graphical.Cell(pc.C)) + 0.5),
+			Color:    graphical.Color{A: 255},
+		}
+		if float64(labels[i].Width(font)) > maxX-minX { // does not fit horizontally
+			sized := labels[i]
+			lessWideFont := fontmeasure.GetFontForWidthMeasured(font.Font, int(maxX-minX+0.5), func(f fontmeasure.Font) int {
+				f.Family = font.Family
+				sized.FontSize = f.Size
+				return sized.Width(&f)
+			})
+			labels[i].FontSize = lessWideFont.Size
+		}
+		if labels[i].FontSize < minSize {
+			minSize = labels[i].FontSize
+		}
+	}
+	if len(p.lines) > 1 {
+		for i := range labels {
+			labels[i].FontSize = minSize
+		}
+	}
+
+	for i := range labels {
+		label := &labels[i]
+		pc := pieces[i]
+		cell := graphical.Cell(pc.C)
+		label.CenterVerticallyBetween(int(gg.CellMinY(cell)), int(gg.CellMaxY(cell)), font)
+
+		minX, maxX := span(pc)
+		label.X = int(minX + 0.5)
+		switch {
+		case list:
+			label.X = int(gg.CellMinX(graphical.Cell{pc.listX, cell.Y}) + 0.5)
+		case align == ALIGN_CENTER:
+			label.CenterHorizontallyBetween(int(minX), int(maxX), font)
+		case align == ALIGN_RIGHT:
+			label.AlignRightEdgeTo(int(maxX), font)
+		}
+	}
+	return labels
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestInferAlign(t *testing.T) {
+	// lines are given as column where they start, and their width
+	tests := []struct {
+		lines    [][2]int
+		expected TextAlign
+	}{
+		{[][2]int{{2, 5}, {2, 8}, {2, 3}}, ALIGN_LEFT},
+		{[][2]int{{5, 5}, {2, 8}, {7, 3}}, ALIGN_RIGHT},
+		{[][2]int{{4, 4}, {2, 8}, {3, 6}}, ALIGN_CENTER},
+		{[][2]int{{2, 5}, {4, 3}}, ALIGN_RIGHT},
+		{[][2]int{{2, 5}, {2, 5}}, ALIGN_CENTER}, // both edges common
+		{[][2]int{{2, 5}, {2, 3}, {4, 3}}, ALIGN_LEFT},
+		{[][2]int{{2, 5}, {4, 3}, {1, 6}}, ALIGN_RIGHT},
+	}
+	for _, tt := range tests {
+		p := &paragraph{}
+		for y, l := range tt.lines {
+			p.lines = append(p.lines, CellStringPair{Cell{l[0], y}, strings.Repeat("x", l[1]), l[1]})
+		}
+		if got := p.inferAlign(); got != tt.expected {
+			t.Errorf("%v: got align %d, expected %d", tt.lines, got, tt.expected)
+		}
+	}
+}
+
+func TestLayoutBullets(t *testing.T) {
+	source := `
++--------------------+
+| * first item       |
+|   continued        |
+| * second           |
+|                    |
+|    centered        |
+|  is a paragraph    |
++--------------------+
+`
+	grid := NewTextGrid(0, 0)
+	_, err := grid.LoadFrom(strings.NewReader(source), ProcessingOptions{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDiagram(grid, DefaultConversionOptions(), nil)
+	got := []string{}
+	for _, l := range d.G.Labels {
+		got = append(got, fmt.Sprintf("%d:%s", l.X, l.Text))
+	}
+	// list items are left aligned with continuation lines indented to the
+	// item text, the lines after the list are centered together
+	expected := []string{
+		"50:•", "60:first item", "60:continued", "50:•", "60:second",
+		"87:centered", "67:is a paragraph",
+	}
+	if strings.Join(got, "|") != strings.Join(expected, "|") {
+		t.Errorf("got labels:\n%s\nexpected:\n%s", strings.Join(got, "\n"), strings.Join(expected, "\n"))
+	}
+}
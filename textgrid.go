@@ -6,6 +6,7 @@ import (
 	"regexp"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/akavel/ditaa/graphical"
 )
@@ -31,10 +32,36 @@ var markupTags = map[string]struct{}{
 	"o":  struct{}{},
 }
 
+// valueTags are markup tags which carry a value, written as {name=value} or
+// {name:value}.
+var valueTags = map[string]struct{}{
+	"id":   struct{}{},
+	"link": struct{}{},
+	"href": struct{}{},
+	"tip":  struct{}{},
+}
+
+// splitValueTag splits a markup tag with a value into its name and value.
+func splitValueTag(tag string) (name, value string, ok bool) {
+	i := strings.IndexAny(tag, "=:")
+	if i < 0 {
+		return "", "", false
+	}
+	name, value = tag[:i], strings.TrimSpace(tag[i+1:])
+	_, ok = valueTags[name]
+	return name, value, ok && value != ""
+}
+
 var _SPACE = []byte{' '}
 
 type TextGrid struct {
 	Rows [][]rune
+
+	// srcLines maps rows loaded from source (not counting the blank border)
+	// to line numbers in the source, and srcCols their columns to columns
+	// in the source
+	srcLines []int
+	srcCols  [][]int
 }
 
 func NewTextGrid(w, h int) *TextGrid {
@@ -45,7 +72,7 @@ func NewTextGrid(w, h int) *TextGrid {
 }
 
 func CopyTextGrid(other *TextGrid) *TextGrid {
-	t := TextGrid{}
+	t := TextGrid{srcLines: other.srcLines, srcCols: other.srcCols}
 	t.Rows = make([][]rune, len(other.Rows))
 	for y, row := range other.Rows {
 		t.Rows[y] = append([]rune(nil), row...)
@@ -162,7 +189,7 @@ func BlankRows(w, h int) [][]rune {
 }
 
 func FillCellsWith(rows [][]rune, cells *CellSet, ch rune) {
-	for c := range cells.Set {
+	for _, c := range cells.Cells() {
 		switch {
 		case c.Y >= len(rows):
 			continue
@@ -212,6 +239,9 @@ func (t *TextGrid) fillContinuousArea(c Cell, ch rune) *CellSet {
 
 // Makes blank all the cells that contain non-text elements.
 func (t *TextGrid) RemoveNonText() {
+	// remove markup tags, first as their values may contain anything
+	t.removeMarkupTags(func(string) bool { return true })
+
 	//the following order is significant
 	//since the south-pointing arrowheads
 	//are determined based on the surrounding boundaries
@@ -245,14 +275,24 @@ func (t *TextGrid) RemoveNonText() {
 	for _, c := range rm {
 		t.Set(c, ' ')
 	}
+}
 
-	// remove markup tags
+// RemoveValueTags removes the markup tags with values, like links and
+// tooltips, which may contain characters of lines.
+func (t *TextGrid) RemoveValueTags() {
+	t.removeMarkupTags(func(tag string) bool {
+		_, _, ok := splitValueTag(tag)
+		return ok
+	})
+}
+
+func (t *TextGrid) removeMarkupTags(selected func(tag string) bool) {
 	for _, pair := range t.findMarkupTags() {
 		tag := pair.Tag
-		if tag == "" {
+		if tag == "" || !selected(tag) {
 			continue
 		}
-		length := 2 + len(tag)
+		length := 2 + utf8.RuneCountInString(tag)
 		t.WriteStringTo(pair.Cell, strings.Repeat(" ", length))
 	}
 }
@@ -292,7 +332,7 @@ func (t *TextGrid) findMarkupTags() []CellTagPair {
 			continue
 		}
 		tagName := m[1]
-		if _, ok := markupTags[tagName]; !ok {
+		if !isKnownTag(tagName) {
 			continue
 		}
 		result = append(result, CellTagPair{c, tagName})
@@ -300,6 +340,30 @@ func (t *TextGrid) findMarkupTags() []CellTagPair {
 	return result
 }
 
+func isKnownTag(name string) bool {
+	_, shape := markupTags[name]
+	_, align := alignTags[name]
+	_, _, value := splitValueTag(name)
+	return shape || align || value
+}
+
+// checkMarkupTags reports tags in braces that are not known shape names.
+func (t *TextGrid) checkMarkupTags(diags *Diagnostics) {
+	for it := t.Iter(); it.Next(); {
+		c := it.Cell()
+		if t.Get(c) != '{' {
+			continue
+		}
+		m := tagPattern.FindStringSubmatch(string(t.Rows[c.Y][c.X:]))
+		if len(m) == 0 {
+			continue
+		}
+		if !isKnownTag(m[1]) {
+			diags.Warnf(t.SourcePos(c), DIAG_UNKNOWN_TAG, "unknown markup tag {%s}", m[1])
+		}
+	}
+}
+
 type Color uint32
 
 type CellColorPair struct {
@@ -342,8 +406,11 @@ func (t *TextGrid) FindColorCodes() []CellColorPair {
 	return result
 }
 
+// CopySelectedCells copies the cells from src to dst, which then maps them
+// to the same source positions.
 func CopySelectedCells(dst *TextGrid, cells *CellSet, src *TextGrid) {
-	for c := range cells.Set {
+	dst.srcLines, dst.srcCols = src.srcLines, src.srcCols
+	for _, c := range cells.Cells() {
 		dst.Set(c, src.Get(c))
 	}
 }
@@ -357,27 +424,103 @@ func (t *TextGrid) DEBUG() string {
 	return buf.String()
 }
 
-// ReplaceTypeOnLine replaces letters or numbers that are on horizontal
-// or vertical lines, with the appropriate character that will make the
-// line continuous (| for vertical and - for horizontal lines)
-func (t *TextGrid) ReplaceTypeOnLine() {
+// ReplaceTypeOnLine replaces text written across horizontal or vertical
+// lines, with the appropriate character that will make the line continuous
+// (| for vertical and - for horizontal lines):
+//
+//	---- some label --->
+//
+// Text on horizontal lines may contain single blanks, text on vertical lines
+// must be letters or numbers only. It returns the cells that were replaced.
+func (t *TextGrid) ReplaceTypeOnLine() []Cell {
+	replacements := map[Cell]rune{}
+	for _, run := range t.findTypeOnLine(false) {
+		for _, c := range run.cells {
+			replacements[c] = run.line
+		}
+	}
+	for _, run := range t.findTypeOnLine(true) {
+		for _, c := range run.cells {
+			if _, ok := replacements[c]; ok {
+				replacements[c] = '+'
+			} else {
+				replacements[c] = run.line
+			}
+		}
+	}
+	replaced := []Cell{}
 	for it := t.Iter(); it.Next(); {
 		c := it.Cell()
-		ch := t.Get(c)
-		if !unicode.In(ch, unicode.Digit, unicode.Letter) {
-			continue
+		if ch, ok := replacements[c]; ok {
+			t.Set(c, ch)
+			replaced = append(replaced, c)
+		}
+	}
+	return replaced
+}
+
+// GetTypeBreakingLines returns the letters and numbers left between two
+// ends of a line by ReplaceTypeOnLine, because the line is too short on
+// either side for the text to be taken as written across it.
+func (t *TextGrid) GetTypeBreakingLines() []Cell {
+	result := []Cell{}
+	for it := t.Iter(); it.Next(); {
+		c := it.Cell()
+		if unicode.In(t.Get(c), unicode.Digit, unicode.Letter) && (t.isOnHorizontalLine(c) || t.isOnVerticalLine(c)) {
+			result = append(result, c)
 		}
-		onH := t.isOnHorizontalLine(c)
-		onV := t.isOnVerticalLine(c)
+	}
+	return result
+}
+
+// typeOnLine is a piece of text found between two ends of a line.
+type typeOnLine struct {
+	cells []Cell
+	line  rune // character of the line before the text
+}
+
+// findTypeOnLine finds text written across vertical or horizontal lines.
+func (t *TextGrid) findTypeOnLine(vertical bool) []typeOnLine {
+	isLine, back, step := t.IsHorizontalLine, Cell.West, Cell.East
+	if vertical {
+		isLine, back, step = t.IsVerticalLine, Cell.North, Cell.South
+	}
+	// the text must be surrounded by lines at least two characters long, so
+	// that dashes in prose are not taken for lines
+	isLong := func(c, next Cell) bool {
+		return isLine(c) && (isLine(next) || isOneOf(t.Get(next), text_cornerChars+text_arrowHeads))
+	}
+	// allowed checks if ch may be a part of the text, after prev
+	allowed := func(ch, prev rune) bool {
 		switch {
-		case onH && onV:
-			t.Set(c, '+')
-		case onH:
-			t.Set(c, '-')
-		case onV:
-			t.Set(c, '|')
+		case unicode.In(ch, unicode.Digit, unicode.Letter):
+			return true
+		case vertical:
+			return false
+		case ch == ' ':
+			return prev != ' '
 		}
+		return !isOneOf(ch, text_boundaries+text_cornerChars+text_lineHops+"<>^{}")
 	}
+	result := []typeOnLine{}
+	for it := t.Iter(); it.Next(); {
+		start := it.Cell()
+		if !isLong(start, back(start)) {
+			continue
+		}
+		run := typeOnLine{line: t.Get(start)}
+		hasType := false
+		c, prev := step(start), t.Get(start)
+		for ; t.Get(c) != 0 && !isLine(c) && allowed(t.Get(c), prev); c = step(c) {
+			hasType = hasType || unicode.In(t.Get(c), unicode.Digit, unicode.Letter)
+			run.cells = append(run.cells, c)
+			prev = t.Get(c)
+		}
+		if hasType && isLong(c, step(c)) {
+			result = append(result, run)
+		}
+	}
+	return result
 }
 
 func (t *TextGrid) ReplacePointMarkersOnLine() {
@@ -400,6 +543,22 @@ func (t *TextGrid) ReplacePointMarkersOnLine() {
 	}
 }
 
+// ReplaceLineHops replaces each line hop with the vertical line below it,
+// breaking the horizontal line, and returns the cells of the hops.
+func (t *TextGrid) ReplaceLineHops() []Cell {
+	hops := []Cell{}
+	for it := t.Iter(); it.Next(); {
+		c := it.Cell()
+		if t.IsLineHop(c) {
+			hops = append(hops, c)
+		}
+	}
+	for _, c := range hops {
+		t.Set(c, t.Get(c.South()))
+	}
+	return hops
+}
+
 func (t *TextGrid) GetPointMarkersOnLine() []Cell {
 	result := []Cell{}
 	for it := t.Iter(); it.Next(); {
@@ -426,6 +585,7 @@ func (t *TextGrid) FindArrowheads() []Cell {
 type CellStringPair struct {
 	C Cell
 	S string
+	W int // width in cells, wide characters take two
 }
 
 func (t *TextGrid) FindStrings() []CellStringPair {
@@ -440,7 +600,9 @@ func (t *TextGrid) FindStrings() []CellStringPair {
 			x++
 			ch := t.Get(Cell{x, y})
 			for {
-				s += string(ch)
+				if ch != wideCharFiller {
+					s += string(ch)
+				}
 				x++
 				c := Cell{x, y}
 				ch = t.Get(c)
@@ -449,7 +611,7 @@ func (t *TextGrid) FindStrings() []CellStringPair {
 					break
 				}
 			}
-			result = append(result, CellStringPair{start, s})
+			result = append(result, CellStringPair{start, s, x - start.X})
 		}
 	}
 	return result
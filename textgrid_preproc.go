@@ -1,39 +1,89 @@
 package main
 
 import (
-	"bufio"
 	"io"
+	"io/ioutil"
 	"strings"
 )
 
-func (t *TextGrid) LoadFrom(r io.Reader) error {
-	lines, err := preSplit(r)
+// ProcessingOptions control how the diagram source is read and recognized.
+// The zero value is ready to use.
+type ProcessingOptions struct {
+	Encoding        Encoding
+	TabSize         int // DEFAULT_TAB_SIZE if 0
+	AllCornersRound bool
+	// LineHops makes horizontal lines hop over vertical ones at plain '+'
+	// crossings which are not corners of closed shapes.
+	LineHops bool
+	// JunctionDots marks with a dot the places where open lines meet.
+	JunctionDots bool
+}
+
+// LoadFrom reads the diagram source from r into the grid. Directives found in
+// the source are applied to the processing of this source, and returned so
+// that the caller can apply them to any other options.
+func (t *TextGrid) LoadFrom(r io.Reader, opt ProcessingOptions, diags *Diagnostics) (Directives, error) {
+	lines, err := preSplit(r, opt.Encoding, diags)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	// remove comments and directives
+	var directives Directives
+	lines, t.srcLines, directives = preExtractDirectives(lines)
+	directives.ApplyProcessing(&opt, diags)
 	lines = preTrimTrailing(lines)
-	// convert tabs to spaces (or remove them if setting is 0)
-	preFixTabs(lines, DEFAULT_TAB_SIZE)
+	tabSize := opt.TabSize
+	if tabSize == 0 {
+		tabSize = DEFAULT_TAB_SIZE
+	}
+	t.srcCols = preMapColumns(lines, tabSize)
+	// give wide characters two cells, same as editors display them
+	preExpandWide(lines)
+	// convert tabs to spaces
+	preFixTabs(lines, tabSize)
 	// make all lines of equal length
 	// add blank outline around the buffer to prevent fill glitch
 	lines = preAddOutline(lines)
 	t.Rows = lines
 	t.replaceBullets()
 	t.replaceHumanColorCodes()
+	t.checkMarkupTags(diags)
 
-	return nil
+	return directives, nil
 }
 
-func preSplit(r io.Reader) (lines [][]rune, err error) {
-	scan := bufio.NewScanner(r)
-	for scan.Scan() {
-		lines = append(lines,
-			[]rune(scan.Text()))
+// preSplit decodes the whole input and splits it into lines. Any of CRLF,
+// LF and CR is accepted as a line terminator.
+func preSplit(r io.Reader, enc Encoding, diags *Diagnostics) (lines [][]rune, err error) {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	text, invalid := decode(buf, enc)
+	line := []rune{}
+	for i := 0; i < len(text); i++ {
+		switch ch := text[i]; ch {
+		case '\r':
+			if i+1 < len(text) && text[i+1] == '\n' {
+				i++
+			}
+			fallthrough
+		case '\n':
+			lines = append(lines, line)
+			line = []rune{}
+		default:
+			if len(invalid) > 0 && invalid[0] == i {
+				invalid = invalid[1:]
+				diags.Warnf(SourcePos{Line: len(lines) + 1, Col: len(line) + 1}, DIAG_INVALID_ENCODING,
+					"invalid byte sequence in input, replaced with U+FFFD")
+			}
+			line = append(line, ch)
+		}
 	}
-	if scan.Err() != nil {
-		return nil, scan.Err()
+	if len(line) > 0 {
+		lines = append(lines, line)
 	}
-	return
+	return lines, nil
 }
 func preTrimTrailing(lines [][]rune) [][]rune {
 	// strip trailing blank lines
@@ -44,6 +94,47 @@ func preTrimTrailing(lines [][]rune) [][]rune {
 	}
 	return nil
 }
+
+// preMapColumns returns, for each column of each line as it is after
+// expanding wide characters and tabs, the column in the source.
+func preMapColumns(rows [][]rune, tabSize int) [][]int {
+	cols := make([][]int, len(rows))
+	for y, row := range rows {
+		for x, c := range row {
+			n := 1
+			switch {
+			case c == '\t':
+				n = tabSize - len(cols[y])%tabSize
+			case isWide(c):
+				n = 2
+			}
+			for ; n > 0; n-- {
+				cols[y] = append(cols[y], x+1)
+			}
+		}
+	}
+	return cols
+}
+func preExpandWide(rows [][]rune) {
+	for y, row := range rows {
+		var newrow []rune
+		for x, c := range row {
+			if !isWide(c) {
+				if newrow != nil {
+					newrow = append(newrow, c)
+				}
+				continue
+			}
+			if newrow == nil {
+				newrow = append(make([]rune, 0, 2*len(row)), row[:x]...)
+			}
+			newrow = append(newrow, c, wideCharFiller)
+		}
+		if newrow != nil {
+			rows[y] = newrow
+		}
+	}
+}
 func preFixTabs(rows [][]rune, tabSize int) {
 	for y, row := range rows {
 		newrow := make([]rune, 0, len(row))
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPreExpandWide(t *testing.T) {
+	const F = string(wideCharFiller)
+	tests := []struct {
+		line, expected string
+	}{
+		{"abc", "abc"},
+		{"中文", "中" + F + "文" + F},
+		{"|日本語|", "|日" + F + "本" + F + "語" + F + "|"},
+		{"한글 ok", "한" + F + "글" + F + " ok"},
+		{"ｶﾀｶﾅ", "ｶﾀｶﾅ"}, // halfwidth forms are narrow
+		{"Ａ1", "Ａ" + F + "1"},
+	}
+	for _, tt := range tests {
+		rows := [][]rune{[]rune(tt.line)}
+		preExpandWide(rows)
+		if string(rows[0]) != tt.expected {
+			t.Errorf("%q: got %q, expected %q", tt.line, string(rows[0]), tt.expected)
+		}
+	}
+}
+
+func TestFindStringsWide(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected string
+	}{
+		{"中文 abc", `[{"中文 abc" 8}]`},
+		{"| 日本語のテキスト |", `[{"| 日本語のテキスト |" 20}]`},
+		{"a中 b", `[{"a中 b" 5}]`},
+		{"中  bc  文字", `[{"中" 2} {"bc" 2} {"文字" 4}]`},
+	}
+	for _, tt := range tests {
+		grid := NewTextGrid(0, 0)
+		_, err := grid.LoadFrom(strings.NewReader(tt.source), ProcessingOptions{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, p := range grid.FindStrings() {
+			got = append(got, fmt.Sprintf("{%q %d}", p.S, p.W))
+		}
+		if s := "[" + strings.Join(got, " ") + "]"; s != tt.expected {
+			t.Errorf("%q: got strings %s, expected %s", tt.source, s, tt.expected)
+		}
+	}
+}
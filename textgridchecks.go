@@ -58,10 +58,43 @@ func (t *TextGrid) IsBoundary(c Cell) bool {
 			t.IsCorner(c) ||
 			t.IsStub(c) ||
 			t.IsCrossOnLine(c)
+	case '*':
+		if t.IsStyleMarker(c) {
+			return false
+		}
 	}
 	return isOneOf(ch, text_boundaries) && !t.IsLoneDiagonal(c)
 }
 
+// IsStyleMarker checks if the asterisk at c opens or closes a *bold* phrase
+// of text, instead of being a part of a line.
+func (t *TextGrid) IsStyleMarker(c Cell) bool {
+	if t.Get(c) != '*' {
+		return false
+	}
+	row := t.Rows[c.Y]
+	textLike := func(ch rune) bool { return !isOneOf(ch, text_boundaries+text_cornerChars+" ") }
+	phraseEnd := func(open int) int {
+		if !opensMarkup(row, open) || !textLike(row[open+1]) {
+			return -1
+		}
+		end := closingMarker(row, open)
+		if end < 0 || !textLike(row[end-1]) || strings.Contains(string(row[open:end]), "  ") {
+			return -1
+		}
+		return end
+	}
+	if phraseEnd(c.X) >= 0 {
+		return true
+	}
+	for x := c.X - 2; x >= 0; x-- {
+		if row[x] == '*' && phraseEnd(x) == c.X {
+			return true
+		}
+	}
+	return false
+}
+
 func (t *TextGrid) IsIntersection(c Cell) bool {
 	return intersectionCriteria.AnyMatch(t.TestingSubGrid(c))
 }
@@ -117,20 +150,22 @@ func (t *TextGrid) IsVerticalLine(c Cell) bool {
 }
 func (t *TextGrid) IsLine(c Cell) bool { return t.IsHorizontalLine(c) || t.IsVerticalLine(c) }
 
-func (t *TextGrid) FollowCell(c Cell, blocked *Cell) *CellSet {
+// FollowCell returns the cells to which a line going through c continues,
+// except the blocked one it came from. Fails if c is not a part of a line.
+func (t *TextGrid) FollowCell(c Cell, blocked *Cell) (*CellSet, error) {
 	switch {
 	case t.IsIntersection(c):
-		return t.followIntersection(c, blocked)
+		return t.followIntersection(c, blocked), nil
 	case t.IsCorner(c):
-		return t.followCorner(c, blocked)
+		return t.followCorner(c, blocked), nil
 	case t.IsLine(c):
-		return t.followLine(c, blocked)
+		return t.followLine(c, blocked), nil
 	case t.IsStub(c):
-		return t.followStub(c, blocked)
+		return t.followStub(c, blocked), nil
 	case t.IsCrossOnLine(c):
-		return t.followCrossOnLine(c, blocked)
+		return t.followCrossOnLine(c, blocked), nil
 	}
-	panic("Cannot follow cell: cannot determine cell type")
+	return nil, fmt.Errorf("cannot follow line through %q: cannot determine cell type", t.Get(c))
 }
 
 func (t *TextGrid) followIntersection(c Cell, blocked *Cell) *CellSet {
@@ -254,6 +289,23 @@ func (t *TextGrid) IsArrowhead(c Cell) bool {
 	return t.IsNorthArrowhead(c) || t.IsSouthArrowhead(c) || t.IsWestArrowhead(c) || t.IsEastArrowhead(c)
 }
 
+// IsAttachedArrowhead checks if the arrowhead at c has a line leading into it
+// from the side opposite to the one it points to.
+func (t *TextGrid) IsAttachedArrowhead(c Cell) bool {
+	lineLike := func(c Cell) bool { return isOneOf(t.Get(c), text_boundaries+text_cornerChars) }
+	switch {
+	case t.IsNorthArrowhead(c):
+		return lineLike(c.South())
+	case t.IsSouthArrowhead(c):
+		return lineLike(c.North())
+	case t.IsWestArrowhead(c):
+		return lineLike(c.East())
+	case t.IsEastArrowhead(c):
+		return lineLike(c.West())
+	}
+	return false
+}
+
 func (t *TextGrid) IsNorthArrowhead(c Cell) bool { return t.Get(c) == '^' }
 func (t *TextGrid) IsWestArrowhead(c Cell) bool  { return t.Get(c) == '<' }
 func (t *TextGrid) IsEastArrowhead(c Cell) bool  { return t.Get(c) == '>' }
@@ -277,6 +329,7 @@ const (
 	text_arrowHeads             = `<>^vV`
 	text_cornerChars            = `\/+`
 	text_pointMarkers           = `*`
+	text_lineHops               = `()`
 	text_dashedLines            = `:~=`
 	text_entryPoints1           = `\`
 	text_entryPoints2           = `|:+\/`
@@ -295,3 +348,19 @@ func (t *TextGrid) isOnHorizontalLine(c Cell) bool {
 func (t *TextGrid) isOnVerticalLine(c Cell) bool {
 	return t.IsVerticalLine(c.North()) && t.IsVerticalLine(c.South())
 }
+
+// IsLineHop checks if c is a '(' or ')' where a horizontal line hops over a
+// vertical one:
+//
+//	   |
+//	---)---
+//	   |
+func (t *TextGrid) IsLineHop(c Cell) bool {
+	return isOneOf(t.Get(c), text_lineHops) && t.isOnHorizontalLine(c) && t.isOnVerticalLine(c)
+}
+
+// IsStraightCross checks if c is a '+' where straight horizontal and
+// vertical lines cross.
+func (t *TextGrid) IsStraightCross(c Cell) bool {
+	return t.Get(c) == '+' && t.isOnHorizontalLine(c) && t.isOnVerticalLine(c)
+}